@@ -2,54 +2,263 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"io"
 	"fmt"
 	"net"
-	"net/rpc"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // Cola representa una cola de mensajes.
 // Tiene un canal de mensajes (`mensajes`) y un mutex (`mux`) para sincronización.
+// El canal `rechazado` contiene el turno de lectura de la cola: nil si el siguiente
+// consumidor debe leer de `mensajes`, o un mensaje rechazado que debe volver a entregarse.
+// Los mensajes obtenidos con `Obtener` o `Recibir` sin confirmación automática se guardan en `pendientes`,
+// indexados por su etiqueta de entrega, hasta que se confirman, se rechazan o vence su visibilidad.
+// Todas las publicaciones y confirmaciones pasan por el almacén de la cola (`almacen`), del que
+// `tipoAlmacen` es el tipo y `politica` la política de sincronización.
+// `encolando` se bloquea al añadir al canal un mensaje publicado y mientras se exporta la cola, de modo
+// que la exportación no altera el orden de los mensajes.
+// `compresion` es el algoritmo con que se comprimen los mensajes en el almacén de una cola duradera, y
+// `compresionAlmacen` y `compresionTransporte` cuentan lo que ahorra la compresión en el almacén y en
+// las conexiones con los clientes.
 type Cola struct {
-	mensajes chan string
+	nombre string
+	mensajes chan *Mensaje
 	durability bool
+	rechazado chan *Mensaje
+	mux sync.Mutex
+	encolando sync.Mutex
+	pendientes map[uint64]*Pendiente
+	siguienteEtiqueta uint64
+	almacen Almacen
+	tipoAlmacen string
+	politica PoliticaSync
+	compresion string
+	compresionAlmacen *contadorCompresion
+	compresionTransporte contadorCompresion
+	config ConfiguracionCola
+	// sinConfirmar contiene los mensajes de una cola duradera que aún no se han confirmado en el almacén,
+	// indexados por offset, para las instantáneas de los seguidores (ver `Instantanea`); `mux` lo protege.
+	sinConfirmar map[uint64]*Mensaje
+	// total y bytes cuentan los mensajes de la cola que aún no se han consumido, incluidos los
+	// entregados que esperan confirmación, y el tamaño de su contenido.
+	total atomic.Int64
+	bytes atomic.Int64
 }
 
+// ConfiguracionCola contiene los parámetros con que se declara una cola. En las colas duraderas se
+// guardan en el manifiesto y se restauran al arrancar el broker.
+//
+// - TTLMensajes: el TTL de los mensajes que se publican sin TTL propio (cero si no caducan: se quedan en
+// la cola hasta que se consumen).
+// - MaxMensajes: el número máximo de mensajes sin consumir de la cola (cero si no hay límite).
+// - MaxBytes: el tamaño máximo del contenido de los mensajes sin consumir (cero si no hay límite).
+//
+// Cuando una publicación superaría un límite, se rechaza con `errColaLlena`.
+type ConfiguracionCola struct {
+	TTLMensajes time.Duration
+	MaxMensajes int64
+	MaxBytes int64
+}
+
+// errColaLlena es el error que se devuelve al publicar en una cola que ha alcanzado alguno de sus límites.
+var errColaLlena = errors.New("la cola ha alcanzado su límite de mensajes o de bytes")
+
+// validar comprueba que los parámetros de una cola no son negativos.
+func (c ConfiguracionCola) validar() error {
+	if c.TTLMensajes < 0 || c.MaxMensajes < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("parámetros de cola no válidos: %+v", c)
+	}
+	return nil
+}
+
+// reservar cuenta un mensaje nuevo en la cola si no supera sus límites.
+//
+// Retorna:
+// - `errColaLlena` si la cola ha alcanzado alguno de sus límites; en ese caso el mensaje no se cuenta.
+func (cola *Cola) reservar(m *Mensaje) error {
+	total := cola.total.Add(1)
+	bytes := cola.bytes.Add(int64(len(m.Cuerpo)))
+	if (cola.config.MaxMensajes > 0 && total > cola.config.MaxMensajes) || (cola.config.MaxBytes > 0 && bytes > cola.config.MaxBytes) {
+		cola.liberar(m)
+		return errColaLlena
+	}
+	return nil
+}
+
+// liberar descuenta de la cola un mensaje consumido o descartado.
+func (cola *Cola) liberar(m *Mensaje) {
+	cola.total.Add(-1)
+	cola.bytes.Add(-int64(len(m.Cuerpo)))
+}
+
+// Mensaje representa un mensaje de una cola.
+// Offset identifica el mensaje dentro de su cola; lo asigna el almacén de la cola y crece con cada publicación.
+// ID identifica el mensaje ante los clientes, Publicado es el momento en que se publicó y TTL el tiempo
+// tras el cual caduca si nadie lo ha consumido (cero si no caduca). Los mensajes caducados se descartan
+// al llegar a la cabeza de la cola (ver `extraer` y `Leer`); no hay otra caducidad.
+type Mensaje struct {
+	Offset uint64
+	ID string
+	Publicado time.Time
+	TTL time.Duration
+	Cabeceras map[string]string
+	Cuerpo string
+}
+
+// caducado indica si el TTL del mensaje ha vencido en el momento especificado.
+func (m *Mensaje) caducado(ahora time.Time) bool {
+	return m.TTL > 0 && ahora.After(m.Publicado.Add(m.TTL))
+}
+
+// nuevoIDMensaje genera un identificador aleatorio de mensaje de 128 bits en hexadecimal.
+func nuevoIDMensaje() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// Pendiente representa un mensaje entregado que espera confirmación.
+// El mensaje vuelve a la cola cuando vence su `temporizador`.
+type Pendiente struct {
+	mensaje *Mensaje
+	temporizador *time.Timer
+}
+
+// capacidadCola es el número de mensajes que admite una cola antes de que las publicaciones esperen.
+const capacidadCola = 100
+
+// extensionDirectorioCola es la extensión del directorio donde se guarda el almacén de una cola duradera.
+const extensionDirectorioCola = ".cola"
+
 //Estructura que representa el broker.
 type Broker struct {
     // colas es un mapa que asocia nombres de cola con canales de tipo string.
     // Cada canal representa una cola donde se pueden enviar y recibir mensajes de tipo string.
-    colas map[string]Cola
+    colas map[string]*Cola
     // consumidores es un mapa que asocia nombres de cola con listas de consumidores.
-    // Cada consumidor está representado por una cadena (string).
-    consumidores map[string][]string
-	mensajeConsumido chan bool
-	mensajeRechazado chan string
+    // Cada consumidor está representado por su suscripción.
+    consumidores map[string][]*Suscripcion
+	// siguienteTag es el contador con el que se generan las etiquetas de consumidor.
+	siguienteTag atomic.Uint64
+	// mux protege el acceso concurrente a los mapas `colas` y `consumidores`.
+	mux sync.Mutex
+	// latido es el intervalo máximo de latidos que el broker acepta negociar con los clientes.
+	// Si es cero, el broker acepta el intervalo que proponga el cliente.
+	latido time.Duration
+	// listener es el listener TCP del broker, sesiones las conexiones abiertas y enCurso el número
+	// de entregas a consumidores pendientes de confirmar; se usan para apagar el broker ordenadamente.
+	listener net.Listener
+	sesiones map[*Sesion]struct{}
+	enCurso atomic.Int64
+	// apagando se cierra cuando empieza el apagado del broker.
+	apagando chan struct{}
+	// datos es el directorio de datos del broker y manifiesto las colas duraderas de su manifiesto,
+	// indexadas por nombre; `mux` protege también `manifiesto`.
+	datos string
+	manifiesto map[string]EntradaManifiesto
+	// llavero contiene las claves con que se cifran los mensajes de las colas duraderas; es nil si no se cifran.
+	llavero *Llavero
+	// almacenPorDefecto es el tipo de almacén de las colas duraderas que no indican otro y
+	// compresionPorDefecto el algoritmo con que comprimen sus mensajes (vacío si no se comprimen).
+	almacenPorDefecto string
+	compresionPorDefecto string
+	// politicaSync es la política de sincronización con el disco de las colas duraderas que no indican otra.
+	politicaSync PoliticaSync
+	// persistencia se bloquea para lectura durante cada escritura en los almacenes de las colas
+	// y para escritura al apagar el broker, de modo que ninguna escritura quede a medias.
+	persistencia sync.RWMutex
+	// replicacion guarda las operaciones sobre las colas duraderas para los seguidores y seguidor es
+	// la replicación desde el primario si el broker es seguidor (nil si es primario); `mux` protege `seguidor`.
+	replicacion registroReplicacion
+	seguidor *Seguidor
+	// direccionReplicacion es la dirección en la que el broker atiende a sus seguidores (vacía si no los
+	// atiende) y listenerReplicacion su listener; `mux` protege `listenerReplicacion`.
+	direccionReplicacion string
+	listenerReplicacion net.Listener
+	// cluster es el clúster del que el broker es un nodo, o nil si no lo es; no cambia después de arrancar.
+	cluster *Cluster
+	// palas son las palas que reenvían mensajes de las colas del broker a otros brokers; `mux` las protege.
+	palas []*Pala
 }
 
 
 // ArgsDeclararCola representa los argumentos para declarar una nueva cola.
 // Contiene el nombre de la cola que se va a declarar.
+// Sincronizacion e IntervaloSincronizacion indican la política de sincronización con el disco de una
+// cola duradera (`siempre`, `grupo` u `so`); si Sincronizacion está vacío se usa la del broker.
+// TTLMensajes, MaxMensajes y MaxBytes son los de `ConfiguracionCola`, Almacen el tipo de almacén de
+// una cola duradera (`registro` o `kv`) y Compresion el algoritmo con que comprime sus mensajes en el
+// almacén (`gzip` o `zlib`); si están vacíos se usan los del broker.
 type ArgsDeclararCola struct{
 	Nombre string
 	Durability bool
+	Sincronizacion string
+	IntervaloSincronizacion time.Duration
+	TTLMensajes time.Duration
+	MaxMensajes int64
+	MaxBytes int64
+	Almacen string
+	Compresion string
 }
 
 // ArgsPublicar representa los argumentos para publicar un mensaje en una cola.
 // Contiene el nombre de la cola y el mensaje que se va a publicar.
+// TTL es el tiempo tras el cual el mensaje caduca si no se ha consumido (cero para aplicar el de la
+// configuración de la cola, que a su vez es cero si no caduca) y Cabeceras
+// son metadatos que se entregan al consumidor junto con el mensaje.
+// Compresion es el algoritmo con que está comprimido Mensaje, o vacío si no lo está.
+// Llamada identifica la llamada para que el cliente pueda dejar de esperar sitio en la cola con `Abortar`;
+// cero si no se puede abortar.
 type ArgsPublicar struct{
 	Nombre string
 	Mensaje string
+	TTL time.Duration
+	Cabeceras map[string]string
+	Compresion string
+	Llamada uint64
+}
+
+// ArgsPublicarLote representa los argumentos para publicar varios mensajes en una sola llamada.
+// Los mensajes pueden ir dirigidos a colas distintas; las colas que no existan se declaran
+// con la durabilidad indicada. Llamada identifica la llamada como en `ArgsPublicar`; la de cada
+// mensaje se ignora.
+type ArgsPublicarLote struct{
+	Mensajes []ArgsPublicar
+	Durability bool
+	Llamada uint64
+}
+
+// ReplyLote representa la respuesta de una publicación por lotes.
+// Errores[i] está vacío si el mensaje i se publicó correctamente, o contiene la causa del fallo.
+type ReplyLote struct{
+	Errores []string
 }
 
 // ArgsConsumir representa los argumentos para consumir mensajes de una cola.
-// Contiene el nombre de la cola y una función de callback que se llamará para cada mensaje consumido.
+// Contiene el nombre de la cola; los mensajes se entregan por la misma conexión del consumidor.
 type ArgsConsumir struct{
 	Nombre string
-	Callback func(*ArgsCallback, *Reply) error
-	Ip string
+	// TiempoEntrega es el plazo que tiene el consumidor para recoger cada mensaje y confirmar el
+	// resultado de su callback. Si es cero, no hay plazo.
+	TiempoEntrega time.Duration
+}
+
+// ReplyConsumir representa la respuesta de `Consumir`.
+// Contiene la etiqueta de consumidor que identifica la suscripción.
+type ReplyConsumir struct{
+	Tag string
 }
 
 // Reply representa la respuesta de una llamada RPC.
@@ -62,6 +271,71 @@ type ArgsCallback struct{
 	Mensaje string
 }
 
+// ArgsObtener representa los argumentos para obtener un mensaje de una cola bajo demanda.
+// Si AutoAck es verdadero el mensaje se da por consumido en cuanto se entrega.
+type ArgsObtener struct{
+	Nombre string
+	AutoAck bool
+}
+
+// ReplyObtener representa la respuesta de `Obtener`.
+// Contiene el mensaje y su etiqueta de entrega, o Vacia a verdadero si la cola no tenía mensajes.
+// ID y Cabeceras son el identificador y las cabeceras con que se publicó el mensaje.
+// Compresion es el algoritmo con que está comprimido Mensaje, o vacío si no lo está.
+type ReplyObtener struct{
+	Mensaje string
+	Etiqueta uint64
+	Vacia bool
+	ID string
+	Cabeceras map[string]string
+	Compresion string
+}
+
+// ArgsAck representa los argumentos para confirmar o rechazar un mensaje obtenido sin confirmación automática.
+// Reencolar indica si un mensaje rechazado debe volver a la cola o descartarse.
+type ArgsAck struct{
+	Nombre string
+	Etiqueta uint64
+	Reencolar bool
+}
+
+// ArgsRecibir representa los argumentos para recibir mensajes de una cola con espera.
+// Espera es el tiempo máximo que se aguarda a que llegue algún mensaje, MaxMensajes el número máximo
+// de mensajes devueltos y Visibilidad el tiempo durante el que los mensajes quedan ocultos a otros
+// consumidores antes de volver a la cola si no se confirman.
+// Llamada identifica la llamada para que el cliente pueda dejar de esperar con `Abortar`; cero si no
+// se puede abortar.
+type ArgsRecibir struct{
+	Nombre string
+	MaxMensajes int
+	Espera time.Duration
+	Visibilidad time.Duration
+	Llamada uint64
+}
+
+// MensajeRecibido representa un mensaje devuelto por `Recibir` junto con su etiqueta de entrega, su ID y sus cabeceras.
+// Compresion es el algoritmo con que está comprimido Mensaje, o vacío si no lo está.
+type MensajeRecibido struct{
+	Mensaje string
+	Etiqueta uint64
+	ID string
+	Cabeceras map[string]string
+	Compresion string
+}
+
+// ReplyRecibir representa la respuesta de `Recibir`.
+// Mensajes está vacío si no llegó ningún mensaje durante la espera.
+type ReplyRecibir struct{
+	Mensajes []MensajeRecibido
+}
+
+// maxMensajesRecibir es el número máximo de mensajes que devuelve una llamada a `Recibir`.
+const maxMensajesRecibir = 10
+
+// visibilidadPorDefecto es el tiempo de visibilidad que se aplica si `ArgsRecibir.Visibilidad` es cero y a
+// los mensajes obtenidos con `Obtener` sin confirmación automática.
+const visibilidadPorDefecto = 30 * time.Second
+
 
 // NuevoBroker crea y devuelve una nueva instancia de `Broker`.
 // Inicializa los mapas `colas` y `consumidores` vacíos.
@@ -71,10 +345,15 @@ type ArgsCallback struct{
 func NuevoBroker() *Broker {
 	// fmt.Println("Broker")
 	return &Broker{
-		colas : make(map[string]Cola),
-		consumidores : make(map[string][]string),
-		mensajeConsumido: make(chan bool),
-		mensajeRechazado: make(chan string, 1),
+		colas : make(map[string]*Cola),
+		consumidores : make(map[string][]*Suscripcion),
+		latido: latidoPorDefecto,
+		politicaSync: PoliticaSync{Modo: syncGrupo, Intervalo: intervaloGrupoPorDefecto},
+		datos: datosPorDefecto,
+		almacenPorDefecto: almacenRegistro,
+		manifiesto: make(map[string]EntradaManifiesto),
+		sesiones: make(map[*Sesion]struct{}),
+		apagando: make(chan struct{}),
 	}
 }
 
@@ -88,43 +367,147 @@ func NuevoBroker() *Broker {
 //
 // Retorna:
 // - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si ocurre un problema.
+//
+// Comportamiento:
+// - Si la cola es duradera, la añade al manifiesto del directorio de datos junto con sus parámetros y abre su almacén (`Almacen`, el indicado o el del broker) en `colas/<nombre>.cola` con la política de sincronización y la compresión indicadas o las del broker. Si ya estaba en el manifiesto, conserva el almacén, la política, la compresión y los parámetros con que se declaró y empieza con los mensajes que quedaron sin consumir y no han caducado.
+// - Si no es duradera, sus mensajes solo se guardan en memoria (`almacenMemoria`).
+// - Si el broker es un nodo de un clúster, responde cuando la declaración de una cola duradera está confirmada en el clúster, o falla si no se puede proponer. Si la cola ya existía no espera: su declaración se confirma antes que cualquier publicación posterior en ella.
 func (l *Broker) Declarar_cola(args *ArgsDeclararCola, reply *Reply) error{
+	indice, err := l.declararCola(args)
+	if err != nil {
+		return err
+	}
+	return l.esperarCluster(indice)
+}
+
+// declararCola declara una cola si no existe, como `Declarar_cola` pero sin esperar al clúster.
+//
+// Retorna:
+// - El índice en el registro del clúster de la declaración de la cola, o cero si la cola ya existía, no es duradera o el broker no es un nodo de un clúster.
+// - Un error si no se puede declarar la cola o no se puede proponer su declaración en el clúster.
+func (l *Broker) declararCola(args *ArgsDeclararCola) (uint64, error){
+	l.mux.Lock()
+	defer l.mux.Unlock()
 	if(l.colas == nil){
-		l.colas = make(map[string]Cola)
+		l.colas = make(map[string]*Cola)
 	}
 	if _, ok := l.colas[args.Nombre]; !ok {
-		l.colas[args.Nombre] = Cola{make(chan string, 100), args.Durability}
-		l.consumidores[args.Nombre] = []string{}
+		var mensajes []Mensaje
+		var politica PoliticaSync
+		config := ConfiguracionCola{TTLMensajes: args.TTLMensajes, MaxMensajes: args.MaxMensajes, MaxBytes: args.MaxBytes}
+		if err := config.validar(); err != nil {
+			return 0, err
+		}
+		tipo, err := tipoAlmacen(args.Durability, args.Almacen, l.almacenPorDefecto)
+		if err != nil {
+			return 0, err
+		}
+		if err := validarCompresion(args.Compresion); err != nil {
+			return 0, err
+		}
+		if args.Compresion != "" && !args.Durability {
+			return 0, fmt.Errorf("solo las colas duraderas comprimen sus mensajes en el almacén")
+		}
+		compresion := ""
+		var contador *contadorCompresion
+		almacen := Almacen(&AlmacenMemoria{})
+		if args.Durability {
+			if err := validarNombreDuradero(args.Nombre); err != nil {
+				return 0, err
+			}
+			politica, err = l.politicaCola(args)
+			if err != nil {
+				return 0, err
+			}
+			_, existia := l.manifiesto[args.Nombre]
+			compresion = args.Compresion
+			if compresion == "" {
+				compresion = l.compresionPorDefecto
+			}
+			entrada, err := l.registrarDuradera(EntradaManifiesto{Nombre: args.Nombre, Almacen: tipo, Sincronizacion: politica, Compresion: compresion, Configuracion: config})
+			if err != nil {
+				fmt.Println("Error al guardar el manifiesto:", err)
+				return 0, err
+			}
+			tipo, politica, compresion, config = entrada.Almacen, entrada.Sincronizacion, entrada.Compresion, entrada.Configuracion
+			contador = &contadorCompresion{}
+			cod := codificacion{llavero: l.llavero, compresion: compresion, contador: contador}
+			almacen, mensajes, err = abrirAlmacen(tipo, filepath.Join(l.datos, entrada.Directorio), politica, cod)
+			if err != nil {
+				fmt.Println("Error al abrir el almacén de la cola:", err)
+				// Una cola que ya existía sigue en el manifiesto para no perder sus mensajes.
+				if !existia {
+					l.olvidarDuradera(args.Nombre)
+				}
+				return 0, err
+			}
+		}
+		// Con un límite de mensajes el canal tiene sitio para todos, de modo que las publicaciones se
+		// rechazan al llegar al límite en lugar de esperar.
+		capacidad := max(capacidadCola, len(mensajes))
+		if config.MaxMensajes > 0 {
+			capacidad = max(int(config.MaxMensajes), len(mensajes))
+		}
+		cola := &Cola{
+			nombre: args.Nombre,
+			mensajes: make(chan *Mensaje, capacidad),
+			durability: args.Durability,
+			rechazado: make(chan *Mensaje, 1),
+			pendientes: make(map[uint64]*Pendiente),
+			almacen: almacen,
+			tipoAlmacen: tipo,
+			politica: politica,
+			compresion: compresion,
+			compresionAlmacen: contador,
+			config: config,
+		}
+		if args.Durability {
+			cola.sinConfirmar = make(map[uint64]*Mensaje)
+		}
+		l.colas[args.Nombre] = cola
+		l.consumidores[args.Nombre] = []*Suscripcion{}
 		fmt.Println("Cola declarada")
-		l.mensajeRechazado <- "ok"
+		// Aunque la declaración no se pueda proponer en el clúster, la cola se termina de preparar: el nodo
+		// deja de ser líder y la descarta al reconstruir sus colas desde el registro.
+		indice, errCluster := l.anotarReplica(cola, OperacionReplica{Tipo: opDeclarar, Cola: l.manifiesto[args.Nombre]})
+		cola.rechazado <- nil
+		ahora := time.Now()
+		for i := range mensajes {
+			if mensajes[i].caducado(ahora) {
+				l.confirmarAlmacen(cola, &mensajes[i])
+				continue
+			}
+			cola.sinConfirmar[mensajes[i].Offset] = &mensajes[i]
+			cola.total.Add(1)
+			cola.bytes.Add(int64(len(mensajes[i].Cuerpo)))
+			cola.mensajes <- &mensajes[i]
+		}
+		return indice, errCluster
+	}
+	return 0, nil
+}
 
+// validarNombreDuradero comprueba que el nombre de una cola duradera se puede usar como nombre de directorio.
+func validarNombreDuradero(nombre string) error {
+	if nombre == "" || nombre == "." || nombre == ".." || strings.ContainsAny(nombre, "/\\\x00") {
+		return fmt.Errorf("nombre de cola duradera no válido: %q", nombre)
 	}
 	return nil
 }
 
-// mensajeCaducado es una función que maneja la expiración de un mensaje en una cola específica.
-// Configura un temporizador de caducidad para los mensajes en la cola y elimina el mensaje
-// si no se consume dentro del período especificado.
+// cola devuelve la cola con el nombre especificado y si existe.
 //
 // Parámetros:
-// - nombre: El nombre de la cola en la que se está manejando la caducidad de los mensajes.
+// - nombre: El nombre de la cola buscada.
 //
-// Comportamiento:
-// - Configura un temporizador (`timer`) con una duración de 300 segundos (5 minutos).
-// - Utiliza una instrucción `select` para esperar a que se produzca una de dos condiciones:
-//     - El temporizador expira (`<-timer.C`), lo que indica que el mensaje ha caducado.
-//     - Un mensaje ha sido consumido (`<-l.mensajeConsumido`), lo que indica que el mensaje ha sido procesado.
-// - Si el temporizador expira primero, imprime un mensaje indicando que el mensaje ha caducado y elimina el mensaje de la cola.
-// - Si se consume el mensaje antes de que el temporizador expire, imprime un mensaje indicando que el mensaje ha sido consumido.
-func (l *Broker) mensajeCaducado( nombre string){
-	timer := time.NewTimer(300 * time.Second)
-	select {	
-	case <-timer.C:
-		fmt.Println("Mensaje caducado")
-		<- l.colas[nombre].mensajes
-	case <-l.mensajeConsumido:
-		fmt.Println("Mensaje consumido")
-	}
+// Retorna:
+// - Un puntero a la cola, o nil si no existe.
+// - Un valor booleano que indica si la cola existe.
+func (l *Broker) cola(nombre string) (*Cola, bool){
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	cola, ok := l.colas[nombre]
+	return cola, ok
 }
 
 // Publicar es un método RPC que publica un mensaje en una cola específica.
@@ -136,170 +519,539 @@ func (l *Broker) mensajeCaducado( nombre string){
 //
 // Retorna:
 // - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si ocurre un problema.
+//
+// Comportamiento:
+// - En una cola duradera, la respuesta sirve de confirmación al productor: no se envía hasta que el mensaje está sincronizado con el disco según la política de la cola.
+// - Si la cola no tiene sitio, espera a que un consumidor lo libere.
 func (l *Broker) Publicar(args *ArgsPublicar, reply *Reply) error{
-	if _, ok := l.colas[args.Nombre]; ok {
-		fmt.Println("Publicando", args.Nombre," ", args.Mensaje)
-		l.colas[args.Nombre].mensajes <- args.Mensaje
-		if(l.colas[args.Nombre].durability){
-            // Abre el archivo con el nombre args.Nombre.txtx en modo append.
-            file, err := os.OpenFile(args.Nombre+".txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-            if err != nil {
-                fmt.Println("Error al abrir el archivo:", err)
-                return err
-            }
-            defer file.Close()
-            // Escribe args.Mensaje en el archivo.
-            if _, err := file.WriteString(args.Mensaje); err != nil {
-                fmt.Println("Error al escribir en el archivo:", err)
-                return err
-            }
-			
-		}
-		go l.mensajeCaducado(args.Nombre)
+	return l.publicarAbortable(args, nil)
+}
+
+// publicarAbortable es `Publicar`, pero deja de esperar sitio en la cola en cuanto se cierra `abortada`.
+func (l *Broker) publicarAbortable(args *ArgsPublicar, abortada <-chan struct{}) error{
+	cola, mensaje, indice, err := l.publicar(args, abortada)
+	if err != nil || cola == nil {
+		return err
 	}
-	return nil
+	return l.esperarSincronizado(cola, mensaje.Offset, indice)
 }
 
-// eliminarPrimeraLinea elimina la primera línea de un archivo especificado por `nombreArchivo`.
+// publicar añade un mensaje a una cola sin esperar a que se sincronice con el disco.
 //
 // Parámetros:
-// - nombreArchivo: El nombre del archivo del que se desea eliminar la primera línea.
+// - args: Los argumentos de la publicación.
+// - abortada: Un canal que, al cerrarse, deja de esperar sitio en la cola; puede ser nil.
 //
 // Retorna:
-// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si ocurre un problema al leer o escribir en el archivo.
-//
-// Comportamiento:
-// - Lee todas las líneas del archivo especificado por `nombreArchivo` utilizando `os.ReadFile`.
-// - Convierte el contenido leído en una slice de strings utilizando `strings.Split`.
-// - Elimina la primera línea de la slice de strings.
-// - Si solo queda una línea después de eliminar la primera línea, elimina el archivo completo utilizando `os.Remove`.
-// - Si quedan más líneas, las convierte de nuevo en una cadena utilizando `strings.Join`.
-// - Escribe las líneas restantes de nuevo en el archivo utilizando `os.WriteFile` con permisos de escritura (0644).
-// - Retorna un error si ocurre algún problema al leer, escribir o eliminar el archivo.
-func eliminarPrimeraLinea(nombreArchivo string) error {
-    // Lee todas las líneas del archivo.
-    lineas, err := os.ReadFile(nombreArchivo)
-    if err != nil {
-        return err
-    }
-    // Convierte las líneas a una slice de strings.
-    todasLasLineas := strings.Split(string(lineas), "\n")
-    // Elimina la primera línea.
-    lineasRestantes := todasLasLineas[1:]
-	if(len(lineasRestantes) == 1 ){
-		fmt.Println("Borrando archivo")
-		err = os.Remove(nombreArchivo)
+// - La cola y el mensaje publicado, o una cola nil si la cola no existe.
+// - El índice de la publicación en el registro del clúster, como en `anadirMensaje`.
+// - Un error si el broker se está apagando, el mensaje viene comprimido y no se puede descomprimir, no se pudo guardar en el almacén de la cola, no se pudo proponer en el clúster o se abortó la llamada.
+func (l *Broker) publicar(args *ArgsPublicar, abortada <-chan struct{}) (*Cola, *Mensaje, uint64, error){
+	if l.apagandose() {
+		return nil, nil, 0, errApagando
+	}
+	if args.TTL < 0 {
+		return nil, nil, 0, fmt.Errorf("TTL negativo: %v", args.TTL)
+	}
+	cola, ok := l.cola(args.Nombre)
+	if !ok {
+		return nil, nil, 0, nil
+	}
+	cuerpo := args.Mensaje
+	if args.Compresion != "" {
+		descomprimido, err := descomprimir(args.Compresion, []byte(args.Mensaje), maxCuerpoEntrada)
 		if err != nil {
-			fmt.Println("Borrando archivo"+err.Error())
-			return err
+			return nil, nil, 0, err
 		}
-		return nil
-	}else{
-		// Convierte las líneas restantes a una cadena.
-		nuevoContenido := strings.Join(lineasRestantes, "\n")
+		cola.compresionTransporte.anotar(len(descomprimido), len(args.Mensaje))
+		cuerpo = string(descomprimido)
+	}
+	fmt.Println("Publicando", args.Nombre," ", cuerpo)
+	mensaje := &Mensaje{
+		ID: nuevoIDMensaje(),
+		Publicado: time.Now(),
+		TTL: args.TTL,
+		Cabeceras: args.Cabeceras,
+		Cuerpo: cuerpo,
+	}
+	indice, err := l.anadirMensaje(cola, mensaje, abortada)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return cola, mensaje, indice, nil
+}
 
-		// Escribe las líneas restantes de nuevo en el archivo.
-		err = os.WriteFile(nombreArchivo, []byte(nuevoContenido), 0644)
-		if err != nil {
-			return err
-		}
-		return nil
+// anadirMensaje guarda un mensaje en el almacén de una cola y lo pone a disposición de los consumidores,
+// sin esperar a que se sincronice con el disco.
+//
+// Comportamiento:
+// - Si el mensaje no tiene TTL, se le aplica el de la configuración de la cola.
+// - Rechaza el mensaje con `errColaLlena` si la cola ha alcanzado alguno de sus límites.
+// - Si la cola no tiene sitio, espera a que lo haya. Si se cierra `abortada` (que puede ser nil) mientras
+// espera, confirma el mensaje en el almacén para deshacer la publicación y devuelve `errLlamadaAbortada`.
+// - Si el broker es un nodo de un clúster y la publicación no se puede proponer, también la deshace y
+// devuelve el error.
+//
+// Retorna:
+// - El índice de la publicación en el registro del clúster, o cero si la cola no es duradera o el broker no es un nodo de un clúster.
+// - Un error si no se ha publicado el mensaje.
+func (l *Broker) anadirMensaje(cola *Cola, mensaje *Mensaje, abortada <-chan struct{}) (uint64, error){
+	if mensaje.TTL == 0 {
+		mensaje.TTL = cola.config.TTLMensajes
+	}
+	if err := cola.reservar(mensaje); err != nil {
+		return 0, err
+	}
+	// El mensaje se guarda en el almacén antes de ponerlo a disposición de los consumidores. `encolando`
+	// se mantiene desde que se le asigna el offset para que los seguidores reciban los mensajes en orden.
+	cola.encolando.Lock()
+	l.persistencia.RLock()
+	err := cola.almacen.Anadir(mensaje)
+	l.persistencia.RUnlock()
+	if err != nil {
+		cola.encolando.Unlock()
+		fmt.Println("Error al guardar el mensaje en el almacén:", err)
+		cola.liberar(mensaje)
+		return 0, err
+	}
+	if cola.durability {
+		cola.mux.Lock()
+		cola.sinConfirmar[mensaje.Offset] = mensaje
+		cola.mux.Unlock()
+	}
+	indice, err := l.anotarReplica(cola, OperacionReplica{Tipo: opPublicar, Mensaje: *mensaje})
+	if err != nil {
+		cola.encolando.Unlock()
+		l.mensajeProcesado(cola, mensaje)
+		return 0, err
+	}
+	select {
+	case cola.mensajes <- mensaje:
+		cola.encolando.Unlock()
+		return indice, nil
+	case <-abortada:
+		cola.encolando.Unlock()
+		l.mensajeProcesado(cola, mensaje)
+		return 0, errLlamadaAbortada
 	}
 }
 
+// esperarSincronizado espera a que el mensaje con el offset especificado de una cola esté
+// sincronizado con el disco según la política de la cola; en las colas no duraderas no espera.
+// Si el broker es un nodo de un clúster, espera también a que esté confirmada en el clúster la entrada
+// del registro con el índice especificado, la de la publicación del mensaje.
+func (l *Broker) esperarSincronizado(cola *Cola, offset, indice uint64) error{
+	if err := cola.almacen.EsperarSincronizado(offset); err != nil {
+		fmt.Println("Error al sincronizar el almacén:", err)
+		return err
+	}
+	return l.esperarCluster(indice)
+}
 
-// leerArchivo es un método del tipo `Broker` que lee todas las líneas de un archivo con el nombre especificado,
-// declara una cola con el nombre del archivo, y publica cada línea no vacía como un mensaje en esa cola.
+// PublicarLote es un método RPC que publica varios mensajes, posiblemente en colas distintas,
+// en una única llamada.
 //
 // Parámetros:
-// - nombreArchivo: El nombre del archivo del que se van a leer las líneas (sin la extensión .txt).
+// - args: Un puntero a una estructura `ArgsPublicarLote` con los mensajes a publicar y la durabilidad de las colas que haya que declarar.
+// - reply: Un puntero a una estructura `ReplyLote` donde se devuelve el resultado de cada mensaje.
 //
 // Retorna:
-// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si ocurre un problema al leer el archivo o al publicar mensajes.
+// - Un valor de tipo `error` que es `nil` si la llamada se ha procesado; los fallos de cada mensaje se informan en `reply.Errores`.
 //
 // Comportamiento:
-// - Lee todas las líneas del archivo con el nombre especificado y extensión `.txt` utilizando `os.ReadFile`.
-// - Convierte el contenido leído en una slice de strings utilizando `strings.Split`.
-// - Declara una cola con el nombre del archivo, especificando que la cola es duradera (opcional).
-// - Itera sobre las líneas de la slice de strings y publica cada línea no vacía como un mensaje en la cola declarada.
-// - Retorna un error si ocurre algún problema al leer el archivo o al publicar mensajes.
-func (l *Broker) leerArchivo(nombreArchivo string) error{
-	// Lee todas las líneas del archivo.
-    lineas, err := os.ReadFile(nombreArchivo+".txt")
-    if err != nil {
-        return err
-    }
-    // Convierte las líneas a una slice de strings.
-    todasLasLineas := strings.Split(string(lineas), "\n")
-	l.Declarar_cola(&ArgsDeclararCola{Nombre: nombreArchivo, Durability: true}, &Reply{Mensaje: ""})
-	for i := 0; i < len(todasLasLineas); i++{
-		if(todasLasLineas[i] != ""){
-			l.Publicar(&ArgsPublicar{Nombre: nombreArchivo, Mensaje: todasLasLineas[i]}, &Reply{Mensaje: ""})
+// - Declara las colas que no existan con la durabilidad indicada en `args.Durability`.
+// - Publica los mensajes en el orden recibido y después espera a que los de las colas duraderas estén sincronizados con el disco, de modo que todo el lote comparte las sincronizaciones.
+// - Guarda en `reply.Errores[i]` el error producido al publicar el mensaje i, o una cadena vacía si no hubo error.
+func (l *Broker) PublicarLote(args *ArgsPublicarLote, reply *ReplyLote) error{
+	return l.publicarLote(args, reply, nil)
+}
+
+// publicarLote es `PublicarLote`, pero deja de esperar sitio en las colas en cuanto se cierra `abortada`;
+// los mensajes que quedan sin publicar fallan con `errLlamadaAbortada`.
+func (l *Broker) publicarLote(args *ArgsPublicarLote, reply *ReplyLote, abortada <-chan struct{}) error{
+	reply.Errores = make([]string, len(args.Mensajes))
+	// ultimo guarda el mayor offset publicado en cada cola, cluster el mayor índice de sus publicaciones
+	// en el registro del clúster e indices los mensajes publicados en ella.
+	ultimo := make(map[*Cola]uint64)
+	cluster := make(map[*Cola]uint64)
+	indices := make(map[*Cola][]int)
+	for i, mensaje := range args.Mensajes {
+		select {
+		case <-abortada:
+			reply.Errores[i] = errLlamadaAbortada.Error()
+			continue
+		default:
+		}
+		if mensaje.Nombre == "" {
+			reply.Errores[i] = "nombre de cola vacío"
+			continue
+		}
+		if err := l.Declarar_cola(&ArgsDeclararCola{Nombre: mensaje.Nombre, Durability: args.Durability}, &Reply{}); err != nil {
+			reply.Errores[i] = err.Error()
+			continue
+		}
+		cola, publicado, indice, err := l.publicar(&mensaje, abortada)
+		if err != nil {
+			reply.Errores[i] = err.Error()
+			continue
+		}
+		if cola != nil {
+			ultimo[cola] = publicado.Offset
+			cluster[cola] = indice
+			indices[cola] = append(indices[cola], i)
+		}
+	}
+	for cola, offset := range ultimo {
+		if err := l.esperarSincronizado(cola, offset, cluster[cola]); err != nil {
+			for _, i := range indices[cola] {
+				reply.Errores[i] = err.Error()
+			}
 		}
 	}
-    return nil
+	return nil
 }
 
-
 // Leer es una función que se ejecuta como una goroutine para leer mensajes de una cola.
-// Consume mensajes de la cola con el nombre especificado y llama al callback para cada mensaje leído.
+// Consume mensajes de la cola con el nombre especificado y los entrega a la suscripción, que los
+// hace llegar al consumidor por su propia conexión.
 //
 // Parámetros:
 // - nombre: El nombre de la cola de la que se desean consumir mensajes.
-// - callback: Una función de callback que se ejecutará con cada mensaje consumido.
-func (l *Broker) Leer(nombre string, client *rpc.Client){
+// - sus: La suscripción a la que se entregan los mensajes.
+//
+// Comportamiento:
+// - Espera el turno de la cola y toma el mensaje rechazado pendiente o el siguiente de la cola, descartando los que han caducado.
+// - Entrega el mensaje a la suscripción y espera a que el consumidor confirme el resultado del callback.
+// - Si el callback falla o el consumidor no recoge y confirma el mensaje dentro del tiempo de entrega de la suscripción, el mensaje vuelve a entregarse; si no, se da por consumido.
+// - Si la suscripción termina, devuelve el mensaje en curso a la cola y termina.
+// - Si el broker se está apagando, no toma mensajes nuevos pero termina la entrega en curso.
+func (l *Broker) Leer(nombre string, sus *Suscripcion){
+	cola, _ := l.cola(nombre)
+	var etiqueta uint64
 	for {
-		var mensaje string
-		mensaje = <- l.mensajeRechazado
-		if(mensaje == "ok"){
-			mensaje = <- l.colas[nombre].mensajes
-		}
-		args := &ArgsCallback{Mensaje: mensaje}
-		var reply Reply
-		err := client.Call("Consumidor.Callback", args, &reply)
-		fmt.Println("Mensaje error:", err)
-		if err != nil {
-			fmt.Println("Error al llamar a la función callback:", err)
-			// Decide qué hacer en caso de error.
-			l.mensajeRechazado <- mensaje
-			client.Close()
-			break;
-		}else{
-			fmt.Println("Else ",l.colas[nombre].durability)
-			if(l.colas[nombre].durability){
-				fmt.Println("Eliminando mensaje")
-				eliminarPrimeraLinea(nombre+".txt")
+		var mensaje *Mensaje
+		select {
+		case mensaje = <- cola.rechazado:
+		case <-sus.fin:
+			return
+		case <-l.apagando:
+			return
+		}
+		if(mensaje == nil){
+			select {
+			case mensaje = <- cola.mensajes:
+			case <-sus.fin:
+				cola.rechazado <- nil
+				return
+			case <-l.apagando:
+				cola.rechazado <- nil
+				return
 			}
-			l.mensajeRechazado <- "ok"
-			l.mensajeConsumido <- true
+		}
+		if mensaje.caducado(time.Now()) {
+			cola.rechazado <- nil
+			l.descartarCaducado(cola, mensaje)
+			continue
+		}
+		etiqueta++
+		l.enCurso.Add(1)
+		resultado, estado := sus.entregar(ReplyEntrega{Mensaje: mensaje.Cuerpo, Etiqueta: etiqueta, ID: mensaje.ID, Cabeceras: mensaje.Cabeceras})
+		l.enCurso.Add(-1)
+		switch {
+		case estado == entregaTerminada:
+			cola.rechazado <- mensaje
+			return
+		case estado == entregaVencida:
+			fmt.Println("Tiempo de entrega agotado para", sus.tag)
+			sus.vencidos.Add(1)
+			cola.rechazado <- mensaje
+		case resultado != "":
+			fmt.Println("Error al llamar a la función callback:", resultado)
+			sus.fallidos.Add(1)
+			cola.rechazado <- mensaje
+		default:
+			sus.entregados.Add(1)
+			cola.rechazado <- nil
+			l.mensajeProcesado(cola, mensaje)
 		}
 		time.Sleep(300*time.Millisecond)
 	}
 }
 
 
-// Consumir es un método RPC que inicia una goroutine para consumir mensajes de una cola específica.
-// Toma argumentos `ArgsConsumir` que contienen el nombre de la cola y la función de callback, y una respuesta `Reply`.
+// mensajeProcesado da por consumido un mensaje de la cola especificada.
 //
 // Parámetros:
-// - args: Un puntero a una estructura `ArgsConsumir` que contiene el nombre de la cola y la función de callback para consumir mensajes.
-// - reply: Un puntero a una estructura `Reply` que puede contener la respuesta del servidor RPC.
+// - cola: La cola a la que pertenece el mensaje.
+// - mensaje: El mensaje consumido.
 //
-// Retorna:
-// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si ocurre un problema.
-func (l *Broker) Consumir(args *ArgsConsumir, reply *Reply) error{
-	if _, ok := l.colas[args.Nombre]; ok {
-		client, err := rpc.Dial("tcp", args.Ip)
-		if err != nil {
-			fmt.Println("Dialing:", err)
+// Comportamiento:
+// - Confirma el mensaje en el almacén de la cola utilizando `confirmarAlmacen`.
+func (l *Broker) mensajeProcesado(cola *Cola, mensaje *Mensaje){
+	cola.liberar(mensaje)
+	l.confirmarAlmacen(cola, mensaje)
+}
+
+// descartarCaducado da por consumido un mensaje cuyo TTL ha vencido antes de entregarse.
+func (l *Broker) descartarCaducado(cola *Cola, mensaje *Mensaje){
+	fmt.Println("Mensaje caducado:", mensaje.ID)
+	l.mensajeProcesado(cola, mensaje)
+}
+
+// confirmarAlmacen marca un mensaje como consumido en el almacén de su cola.
+func (l *Broker) confirmarAlmacen(cola *Cola, mensaje *Mensaje){
+	l.persistencia.RLock()
+	defer l.persistencia.RUnlock()
+	if err := cola.almacen.Confirmar(mensaje.Offset); err != nil {
+		fmt.Println("Error al confirmar el mensaje en el almacén:", err)
+		return
+	}
+	if cola.durability {
+		cola.mux.Lock()
+		delete(cola.sinConfirmar, mensaje.Offset)
+		cola.mux.Unlock()
+		// Si el nodo deja de ser líder, los consumidores ya no lo confirman aquí: se descartan sus colas y el
+		// mensaje se vuelve a entregar desde el nuevo líder.
+		if _, err := l.anotarReplica(cola, OperacionReplica{Tipo: opConfirmar, Offset: mensaje.Offset}); err != nil {
+			fmt.Println("Error al replicar la confirmación en el clúster:", err)
 		}
-		go l.Leer(args.Nombre, client)
+	}
+}
+
+// Obtener es un método RPC que extrae el siguiente mensaje de una cola sin bloquearse.
+// Permite consumir mensajes bajo demanda sin que el consumidor tenga que levantar un servidor RPC.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsObtener` con el nombre de la cola y si el mensaje se confirma automáticamente.
+// - reply: Un puntero a una estructura `ReplyObtener` donde se devuelve el mensaje y su etiqueta de entrega.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la cola no existe.
+//
+// Comportamiento:
+// - Si hay un mensaje rechazado pendiente de volver a entregarse, lo devuelve antes que los de la cola.
+// - Si la cola está vacía, devuelve `reply.Vacia` a verdadero.
+// - Si `args.AutoAck` es verdadero, da el mensaje por consumido; si no, lo guarda como pendiente hasta que se llame a `Ack` o `Rechazar` con su etiqueta. Si no se confirma antes de `visibilidadPorDefecto`, vuelve a la cola.
+func (l *Broker) Obtener(args *ArgsObtener, reply *ReplyObtener) error{
+	cola, ok := l.cola(args.Nombre)
+	if !ok {
+		return fmt.Errorf("la cola %s no existe", args.Nombre)
+	}
+	mensaje, encontrado := l.extraer(cola, 0, nil)
+	if !encontrado {
+		reply.Vacia = true
+		return nil
+	}
+	reply.Mensaje = mensaje.Cuerpo
+	reply.ID = mensaje.ID
+	reply.Cabeceras = mensaje.Cabeceras
+	if args.AutoAck {
+		l.mensajeProcesado(cola, mensaje)
 		return nil
+	}
+	reply.Etiqueta = cola.guardarPendiente(mensaje, visibilidadPorDefecto)
+	return nil
+}
 
-	}else{
-		//poner error
+// Recibir es un método RPC que espera mensajes de una cola durante un tiempo máximo y los oculta
+// a otros consumidores durante un tiempo de visibilidad.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsRecibir` con el nombre de la cola, la espera máxima, el número máximo de mensajes y el tiempo de visibilidad.
+// - reply: Un puntero a una estructura `ReplyRecibir` donde se devuelven los mensajes y sus etiquetas.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la cola no existe.
+//
+// Comportamiento:
+// - Espera hasta `args.Espera` a que haya un primer mensaje y después recoge sin esperar los que ya estén en la cola, hasta `args.MaxMensajes` (entre 1 y `maxMensajesRecibir`).
+// - Cada mensaje devuelto queda pendiente; si no se confirma con `Ack` antes de `args.Visibilidad` vuelve a la cola y puede entregarse de nuevo.
+func (l *Broker) Recibir(args *ArgsRecibir, reply *ReplyRecibir) error{
+	return l.recibir(args, reply, nil)
+}
+
+// recibir es `Recibir`, pero deja de esperar el primer mensaje en cuanto se cierra `abortada`.
+func (l *Broker) recibir(args *ArgsRecibir, reply *ReplyRecibir, abortada <-chan struct{}) error{
+	cola, ok := l.cola(args.Nombre)
+	if !ok {
+		return fmt.Errorf("la cola %s no existe", args.Nombre)
+	}
+	maximo := args.MaxMensajes
+	if maximo < 1 {
+		maximo = 1
+	} else if maximo > maxMensajesRecibir {
+		maximo = maxMensajesRecibir
+	}
+	visibilidad := args.Visibilidad
+	if visibilidad <= 0 {
+		visibilidad = visibilidadPorDefecto
+	}
+	espera := args.Espera
+	for len(reply.Mensajes) < maximo {
+		mensaje, ok := l.extraer(cola, espera, abortada)
+		if !ok {
+			break
+		}
+		espera = 0
+		etiqueta := cola.guardarPendiente(mensaje, visibilidad)
+		reply.Mensajes = append(reply.Mensajes, MensajeRecibido{Mensaje: mensaje.Cuerpo, Etiqueta: etiqueta, ID: mensaje.ID, Cabeceras: mensaje.Cabeceras})
+	}
+	return nil
+}
+
+// extraer saca el siguiente mensaje de la cola, esperando como mucho el tiempo indicado.
+//
+// Parámetros:
+// - espera: El tiempo máximo que se espera a que llegue un mensaje; si es cero no se espera.
+// - abortada: Un canal que, al cerrarse, deja de esperar; puede ser nil.
+//
+// Retorna:
+// - El mensaje extraído y un valor booleano que indica si se ha extraído alguno.
+//
+// Comportamiento:
+// - Si hay un mensaje rechazado pendiente de volver a entregarse, lo devuelve antes que los de la cola.
+// - Si no hay mensajes y `espera` es mayor que cero, espera a que se publique uno o a que venza la espera.
+func (cola *Cola) extraer(espera time.Duration, abortada <-chan struct{}) (*Mensaje, bool){
+	select {
+	case turno := <-cola.rechazado:
+		cola.rechazado <- nil
+		if turno != nil {
+			return turno, true
+		}
+	default:
+		// Un consumidor tiene el turno de la cola; se lee directamente de los mensajes.
+	}
+	select {
+	case mensaje := <-cola.mensajes:
+		return mensaje, true
+	default:
+	}
+	if espera <= 0 {
+		return nil, false
+	}
+	timer := time.NewTimer(espera)
+	defer timer.Stop()
+	select {
+	case mensaje := <-cola.mensajes:
+		return mensaje, true
+	case <-timer.C:
+		return nil, false
+	case <-abortada:
+		return nil, false
+	}
+}
+
+// extraer saca el siguiente mensaje de la cola que no ha caducado, esperando como mucho el tiempo indicado.
+// Los mensajes caducados que encuentra por el camino se descartan. Si se cierra `abortada`, deja de esperar.
+func (l *Broker) extraer(cola *Cola, espera time.Duration, abortada <-chan struct{}) (*Mensaje, bool){
+	limite := time.Now().Add(espera)
+	for {
+		mensaje, ok := cola.extraer(espera, abortada)
+		if !ok {
+			return nil, false
+		}
+		ahora := time.Now()
+		if !mensaje.caducado(ahora) {
+			return mensaje, true
+		}
+		l.descartarCaducado(cola, mensaje)
+		if espera > 0 {
+			espera = max(limite.Sub(ahora), 0)
+		}
+	}
+}
+
+// guardarPendiente guarda un mensaje entregado a la espera de confirmación y le asigna una etiqueta de entrega.
+// Cada entrega tiene su propio temporizador, que `pendiente` detiene al confirmarla o rechazarla.
+//
+// Parámetros:
+// - mensaje: El mensaje entregado.
+// - visibilidad: El tiempo tras el cual el mensaje vuelve a la cola si no se confirma.
+//
+// Retorna:
+// - La etiqueta de entrega asignada al mensaje.
+func (cola *Cola) guardarPendiente(mensaje *Mensaje, visibilidad time.Duration) uint64{
+	cola.mux.Lock()
+	defer cola.mux.Unlock()
+	cola.siguienteEtiqueta++
+	etiqueta := cola.siguienteEtiqueta
+	pendiente := &Pendiente{mensaje: mensaje}
+	pendiente.temporizador = time.AfterFunc(visibilidad, func() {
+		cola.mux.Lock()
+		defer cola.mux.Unlock()
+		if _, ok := cola.pendientes[etiqueta]; ok {
+			fmt.Println("Visibilidad vencida, reencolando mensaje", etiqueta)
+			delete(cola.pendientes, etiqueta)
+			go func() { cola.mensajes <- mensaje }()
+		}
+	})
+	cola.pendientes[etiqueta] = pendiente
+	return etiqueta
+}
+
+// pendiente extrae de la cola el mensaje pendiente de confirmación con la etiqueta especificada.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsAck` con el nombre de la cola y la etiqueta de entrega.
+//
+// Retorna:
+// - La cola y el mensaje pendiente, o un error si la cola o la etiqueta no existen.
+func (l *Broker) pendiente(args *ArgsAck) (*Cola, *Mensaje, error){
+	cola, ok := l.cola(args.Nombre)
+	if !ok {
+		return nil, nil, fmt.Errorf("la cola %s no existe", args.Nombre)
+	}
+	cola.mux.Lock()
+	defer cola.mux.Unlock()
+	pendiente, ok := cola.pendientes[args.Etiqueta]
+	if !ok {
+		return nil, nil, fmt.Errorf("etiqueta de entrega desconocida: %d", args.Etiqueta)
+	}
+	pendiente.temporizador.Stop()
+	delete(cola.pendientes, args.Etiqueta)
+	return cola, pendiente.mensaje, nil
+}
+
+// Ack es un método RPC que confirma un mensaje obtenido con `Obtener` sin confirmación automática
+// o con `Recibir`, eliminándolo definitivamente de la cola.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsAck` con el nombre de la cola y la etiqueta de entrega.
+// - reply: Un puntero a una estructura `Reply` que puede contener la respuesta del servidor RPC.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la etiqueta no está pendiente.
+func (l *Broker) Ack(args *ArgsAck, reply *Reply) error{
+	cola, mensaje, err := l.pendiente(args)
+	if err != nil {
+		return err
+	}
+	l.mensajeProcesado(cola, mensaje)
+	return nil
+}
+
+// Rechazar es un método RPC que rechaza un mensaje obtenido con `Obtener` sin confirmación automática.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsAck` con el nombre de la cola, la etiqueta de entrega y si se reencola.
+// - reply: Un puntero a una estructura `Reply` que puede contener la respuesta del servidor RPC.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la etiqueta no está pendiente.
+//
+// Comportamiento:
+// - Si `args.Reencolar` es verdadero, el mensaje vuelve a la cola; si no, se descarta como si se hubiera consumido.
+func (l *Broker) Rechazar(args *ArgsAck, reply *Reply) error{
+	cola, mensaje, err := l.pendiente(args)
+	if err != nil {
+		return err
+	}
+	if args.Reencolar {
+		go func() { cola.mensajes <- mensaje }()
 		return nil
 	}
+	l.mensajeProcesado(cola, mensaje)
+	return nil
 }
 
 // EjecutarBroker inicia el servidor RPC del broker y escucha conexiones entrantes en la dirección IP especificada.
@@ -308,25 +1060,38 @@ func (l *Broker) Consumir(args *ArgsConsumir, reply *Reply) error{
 // - ip: La dirección IP en la que el servidor debe escuchar las conexiones entrantes.
 //
 // Comportamiento:
-// - Registra el broker (instancia de `Broker`) como un servicio RPC utilizando `rpc.Register`.
 // - Inicia un listener TCP en la dirección IP especificada utilizando `net.Listen`.
 // - Verifica si hay un error al iniciar el servidor y, de ser así, imprime el error y retorna.
 // - Usa `defer` para asegurarse de cerrar el listener cuando la función termine.
 // - Imprime un mensaje indicando que el servidor está escuchando en la dirección IP especificada.
-// - En un bucle infinito, acepta conexiones entrantes y maneja los clientes conectados utilizando `rpc.Accept`.
+// - En un bucle, acepta conexiones entrantes y atiende cada una con `atenderConexion`, hasta que `Apagar` cierra el listener. En un clúster, las atiende `Cluster.atender`.
 func (l * Broker) EjecutarBroker( ip string){
-	rpc.Register(l)
 	ln, err := net.Listen("tcp", ip)
 	if err != nil {
 		fmt.Println("Error al iniciar el servidor:", err)
 		return
 	}
 	defer ln.Close()
+	l.mux.Lock()
+	l.listener = ln
+	l.mux.Unlock()
 	fmt.Println("Servidor escuchando en ", ip)
 	for{
 		// Aceptar conexiones entrantes
-		rpc.Accept(ln)
+		conn, err := ln.Accept()
+		if err != nil {
+			if l.apagandose() {
+				return
+			}
+			fmt.Println("Error al aceptar la conexión:", err)
+			continue
+		}
 		fmt.Println("Cliente conectado")
+		if l.cluster != nil {
+			go l.cluster.atender(conn)
+			continue
+		}
+		go l.atenderConexion(conn)
 	}
 }
 
@@ -335,14 +1100,47 @@ func (l * Broker) EjecutarBroker( ip string){
 // Comportamiento:
 // - Imprime un encabezado ("Colas:").
 // - Verifica si no hay colas disponibles y, de ser así, imprime un mensaje indicando que no hay colas.
-// - Si hay colas disponibles, itera sobre las claves (nombres) de las colas y las imprime en la consola.
+// - Si hay colas disponibles, itera sobre las claves (nombres) de las colas y las imprime en la consola junto con el número de consumidores suscritos.
+// - Muestra lo que ahorra la compresión de cada cola en el almacén y en las conexiones con los clientes.
+// - Por cada consumidor muestra sus entregas completadas, fallidas y vencidas.
+// - Si el broker es seguidor o un nodo de un clúster, muestra antes el estado de la replicación y las colas replicadas.
+// - Muestra antes también el estado de las palas.
 func (l *Broker) ListarColas(){
+	l.mux.Lock()
+	seguidor := l.seguidor
+	l.mux.Unlock()
+	if seguidor != nil {
+		seguidor.mostrar()
+	}
+	if l.cluster != nil {
+		l.cluster.mostrar()
+	}
+	l.mostrarPalas()
+	l.mux.Lock()
+	defer l.mux.Unlock()
 	fmt.Println("Colas:")
 	if len(l.colas) == 0 {
 		fmt.Println("No hay colas disponibles")
 	} else {
 		for key := range l.colas {
-			fmt.Println(key)
+			cola := l.colas[key]
+			fmt.Println(key, "-", len(l.consumidores[key]), "consumidores", "-", cola.total.Load(), "mensajes,", cola.bytes.Load(), "bytes")
+			if cola.durability {
+				fmt.Println("   almacén:", cola.tipoAlmacen, "sincronización:", cola.politica)
+			}
+			if cola.compresion != "" {
+				fmt.Println("   compresión en el almacén con", cola.compresion+":", cola.compresionAlmacen)
+			}
+			if cola.compresionTransporte.mensajes.Load() > 0 {
+				fmt.Println("   compresión en el transporte:", &cola.compresionTransporte)
+			}
+			if cola.config != (ConfiguracionCola{}) {
+				fmt.Println("   TTL de mensajes:", cola.config.TTLMensajes, "máximo de mensajes:", cola.config.MaxMensajes, "máximo de bytes:", cola.config.MaxBytes)
+			}
+			for _, sus := range l.consumidores[key] {
+				e := sus.estadisticas()
+				fmt.Println("  ", sus.tag, "entregados:", e.Entregados, "fallidos:", e.Fallidos, "vencidos:", e.Vencidos)
+			}
 		}
 	}	
 }
@@ -356,59 +1154,165 @@ func (l *Broker) ListarColas(){
 // Comportamiento:
 // - Verifica si la cola con el nombre especificado existe en el broker.
 // - Si la cola existe, imprime un mensaje indicando que se va a eliminar la cola y la elimina utilizando `delete`.
+// - Si la cola es duradera, la quita del manifiesto y borra también su almacén del disco.
 func (l *Broker) BorrarCola(nombre string){
-	if _, ok := l.colas[nombre]; ok {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if cola, ok := l.colas[nombre]; ok {
 		fmt.Println("Borrando cola", nombre)
 		delete(l.colas, nombre)
-	}
-}
-
-// RescatarColasAnteriores lee los archivos en el directorio actual y carga colas a partir de ellos.
-//
-// Comportamiento:
-// - Lee los archivos en el directorio actual utilizando `os.ReadDir`.
-// - Verifica si hay un error al leer los archivos y, de ser así, imprime el error y retorna.
-// - Itera sobre los archivos en el directorio, omitiendo el primer archivo (índice 0).
-// - Por cada archivo, imprime su nombre, extrae el nombre de la cola (sin la extensión) y llama a `leerArchivo` para cargar las colas.
-func (l *Broker) RescatarColasAnteriores(){
-    archivos, err := os.ReadDir(".")
-    if err != nil {
-		fmt.Println("Error al rescatar colas antiguas:", err)
-        return
-    }
-    for index, archivo := range archivos {
-		if(index != 0){
-			fmt.Println(archivo.Name()+";")
-			name := strings.Split(archivo.Name(), ".")[0]			 
-			l.leerArchivo(name)
+		// Una cola duradera sale del manifiesto antes de borrar su almacén, para no recuperar un almacén borrado a medias.
+		if err := l.olvidarDuradera(nombre); err != nil {
+			fmt.Println("Error al guardar el manifiesto:", err)
 		}
-    }
+		if err := cola.almacen.Borrar(); err != nil {
+			fmt.Println("Error al borrar el almacén de la cola:", err)
+		}
+		if _, err := l.anotarReplica(cola, OperacionReplica{Tipo: opBorrar}); err != nil {
+			fmt.Println("Error al replicar el borrado en el clúster:", err)
+		}
+	}
 }
 
-
 // main es la función principal que inicia el servidor RPC y espera conexiones.
-// Crea una instancia de `Broker`, la registra en RPC y comienza a escuchar en el puerto 8080.
+// Crea una instancia de `Broker`, la registra en RPC y comienza a escuchar en la dirección indicada.
+// La opción -latido fija el intervalo máximo de latidos que se negocia con los clientes y -plazo el tiempo
+// que se espera a las entregas en curso al apagar el broker con SIGINT, SIGTERM o la operación "apagar".
+// Las opciones -sync y -grupo fijan la política de sincronización con el disco de las colas duraderas y
+// -datos el directorio donde el broker guarda su manifiesto y sus colas duraderas. La opción -almacen fija
+// el tipo de almacén de las colas duraderas que no indican otro al declararse, -compresion el algoritmo
+// con que comprimen sus mensajes en el disco y -claves el archivo de claves con que se cifran (ver `Llavero`).
+// Con -replicacion el broker atiende a sus seguidores en la dirección indicada, y con -seguir el broker es
+// seguidor del primario con la dirección de replicación indicada: replica sus colas duraderas y no acepta
+// clientes hasta que se promociona con la operación "promocionar" (ver `Seguidor`). Con -cluster el broker es un nodo
+// del clúster formado por los nodos indicados, que se comunican en las direcciones -raft (ver `Cluster`).
+// La opción -palas indica el archivo con las palas que reenvían mensajes a otros brokers (ver `Pala`).
 func main(){
-	args := os.Args
+	latido := flag.Duration("latido", latidoPorDefecto, "intervalo máximo de latidos con los clientes (0 acepta el del cliente)")
+	plazo := flag.Duration("plazo", plazoApagadoPorDefecto, "tiempo que se espera a las entregas en curso al apagar el broker")
+	sincronizacion := flag.String("sync", syncGrupo, "política de sincronización con el disco de las colas duraderas: siempre, grupo o so")
+	grupo := flag.Duration("grupo", intervaloGrupoPorDefecto, "intervalo entre sincronizaciones con la política grupo")
+	almacen := flag.String("almacen", almacenRegistro, "tipo de almacén de las colas duraderas: registro o kv")
+	compresion := flag.String("compresion", "", "algoritmo con que se comprimen los mensajes de las colas duraderas que no indican otro: gzip o zlib (sin comprimir si está vacío)")
+	claves := flag.String("claves", "", "archivo de claves con que se cifran los mensajes de las colas duraderas (sin cifrar si está vacío)")
+	datos := flag.String("datos", datosPorDefecto, "directorio de datos del broker, donde se guardan el manifiesto y las colas duraderas")
+	seguir := flag.String("seguir", "", "dirección de replicación (ip:puerto) del broker primario del que este broker es seguidor")
+	replicacion := flag.String("replicacion", "", "dirección (ip:puerto) en la que el broker atiende a sus seguidores (sin seguidores si está vacía)")
+	cluster := flag.String("cluster", "", "direcciones (ip:puerto,...) en las que atienden a los demás nodos todos los nodos del clúster, incluido este")
+	raft := flag.String("raft", "", "dirección (ip:puerto) en la que este nodo del clúster atiende a los demás nodos")
+	palas := flag.String("palas", "", "archivo JSON con las palas que reenvían mensajes de colas locales a otros brokers")
+	flag.Parse()
+	politica, err := nuevaPoliticaSync(*sincronizacion, *grupo)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	args := flag.Args()
 	//Verifica número correcto de argumentos
-	if len(args) < 2 {
+	if len(args) < 1 {
         fmt.Println("No se ha proporcionado ningún argumento. Ejemplo de uso:")
-        fmt.Println("  go run MOM direccionIP:puerto")
+        fmt.Println("  go run MOM [-latido 10s] [-plazo 10s] [-sync siempre|grupo|so] [-grupo 10ms] [-almacen registro|kv] [-compresion gzip|zlib] [-claves archivo] [-datos datos] [-replicacion ip:puerto] [-seguir ip:puerto | -cluster ip:puerto,... -raft ip:puerto] [-palas archivo] direccionIP:puerto")
+        fmt.Println("  go run MOM fsck [-datos datos] [-reparar truncar|cuarentena] [-claves archivo]")
+        fmt.Println("  go run MOM exportar direccionIP:puerto cola archivo.jsonl")
+        fmt.Println("  go run MOM importar [-ids regenerar|conservar] direccionIP:puerto cola archivo.jsonl")
         return
     }
+	if(args[0] == "exportar" || args[0] == "importar"){
+		if !ejecutarExportacion(args) {
+			os.Exit(1)
+		}
+		return
+	}
+	if(args[0] == "fsck"){
+		if !ejecutarFsck(args[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
 	l := NuevoBroker()
-	go l.EjecutarBroker(args[1])
-	l.RescatarColasAnteriores()
+	l.latido = *latido
+	l.direccionReplicacion = *replicacion
+	l.politicaSync = politica
+	if _, err := tipoAlmacen(true, *almacen, ""); err != nil {
+		fmt.Println(err)
+		return
+	}
+	l.almacenPorDefecto = *almacen
+	if err := validarCompresion(*compresion); err != nil {
+		fmt.Println(err)
+		return
+	}
+	l.compresionPorDefecto = *compresion
+	if *claves != "" {
+		llavero, err := cargarLlavero(*claves)
+		if err != nil {
+			fmt.Println("Error al cargar las claves:", err)
+			return
+		}
+		l.llavero = llavero
+		fmt.Println("Cifrando los mensajes de las colas duraderas con la clave", llavero.activa)
+	}
+	var configPalas []ConfiguracionPala
+	if *palas != "" {
+		configPalas, err = cargarPalas(*palas)
+		if err != nil {
+			fmt.Println("Error al cargar las palas:", err)
+			return
+		}
+	}
+	if err := l.abrirDatos(*datos); err != nil {
+		fmt.Println("Error al abrir el directorio de datos:", err)
+		return
+	}
+	if *cluster != "" {
+		if *seguir != "" || *replicacion != "" || *raft == "" {
+			fmt.Println("Un nodo de un clúster necesita -raft y no puede usar -seguir ni -replicacion")
+			return
+		}
+		if err := l.unirseCluster(args[0], *raft, strings.Split(*cluster, ",")); err != nil {
+			fmt.Println("Error al unirse al clúster:", err)
+			return
+		}
+	}else if *seguir != "" {
+		// Un seguidor no carga sus colas ni acepta conexiones hasta que se promociona.
+		l.seguir(*seguir)
+	}else{
+		// Las colas duraderas se restauran antes de aceptar conexiones, de modo que ningún cliente las
+		// encuentre sin declarar.
+		l.RescatarColasAnteriores()
+		go l.EjecutarBroker(args[0])
+		if *replicacion != "" {
+			go l.ejecutarReplicacion(*replicacion)
+		}
+	}
+	// Las palas esperan a que exista su cola de origen, así que en un seguidor o un nodo que no es el
+	// líder no transfieren nada hasta que se carguen las colas.
+	l.iniciarPalas(configPalas)
+	señales := make(chan os.Signal, 1)
+	signal.Notify(señales, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-señales
+		signal.Stop(señales)
+		l.Apagar(*plazo)
+		os.Exit(0)
+	}()
 	reader := bufio.NewReader(os.Stdin)
 	for {
-        fmt.Println("Ingresa una de las operacions ( listar colas / borrar cola): ")
+        fmt.Println("Ingresa una de las operacions ( listar colas / borrar cola / exportar cola / importar cola / promocionar / apagar): ")
         // Leer una línea de entrada
         input, err := reader.ReadString('\n')
+        if err == io.EOF {
+			// Sin entrada estándar el broker sigue atendiendo hasta recibir una señal.
+			select {}
+        }
         if err != nil {
             fmt.Println("Error al leer la entrada:", err)
 			continue
         }
-		if(strings.Contains(input, "listar colas")){
+		if(strings.Contains(input, "apagar")){
+			l.Apagar(*plazo)
+			return
+		}else if(strings.Contains(input, "listar colas")){
 			l.ListarColas()
 		}else if(strings.Contains(input, "borrar cola")){
 			fmt.Println("Ingresa el nombre de la cola a borrar: ")
@@ -417,7 +1321,13 @@ func main(){
 				fmt.Println("Error al leer la entrada:", err)
 				continue
 			}
-			l.BorrarCola(input)
+			l.BorrarCola(strings.TrimSpace(input))
+		}else if(strings.Contains(input, "exportar cola") || strings.Contains(input, "importar cola")){
+			l.exportacionInteractiva(reader, strings.Contains(input, "importar"))
+		}else if(strings.Contains(input, "promocionar")){
+			if err := l.Promocionar(args[0]); err != nil {
+				fmt.Println("Error al promocionar el broker:", err)
+			}
 		}else{
 			fmt.Println("Operación no válida")
 		}
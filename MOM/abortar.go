@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Llamadas abortables.
+//
+// net/rpc no permite cancelar una llamada en curso, así que las llamadas que pueden esperar en el broker
+// (`Recibir`, y `Publicar` y `PublicarLote` cuando la cola no tiene sitio) llevan un identificador de
+// llamada elegido por el cliente, único dentro de su conexión. Si el cliente deja de esperar la respuesta
+// (porque vence su plazo o se cancela su contexto), llama a `Abortar` con ese identificador y el broker deja
+// de esperar. Como las llamadas de una conexión se atienden en paralelo, `Abortar` puede llegar antes que la
+// llamada que aborta; en ese caso se guarda hasta que la llamada empieza, o durante `esperaAbortada` si no
+// empieza nunca porque ya había terminado. Si llega cuando la llamada ya ha terminado, no tiene efecto.
+
+// esperaAbortada es el tiempo durante el que se guarda un aborto de una llamada que no ha empezado.
+const esperaAbortada = time.Minute
+
+// errLlamadaAbortada es el error con que terminan las llamadas abortadas por el cliente.
+var errLlamadaAbortada = errors.New("llamada abortada por el cliente")
+
+// ArgsAbortar representa los argumentos para abortar una llamada en curso de la sesión.
+type ArgsAbortar struct {
+	Llamada uint64
+}
+
+// Abortar es un método RPC que hace que deje de esperar la llamada de la sesión con el identificador
+// especificado.
+func (s *Sesion) Abortar(args *ArgsAbortar, reply *Reply) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if abortada, ok := s.llamadas[args.Llamada]; ok {
+		close(abortada)
+		delete(s.llamadas, args.Llamada)
+		return nil
+	}
+	ahora := time.Now()
+	for llamada, momento := range s.abortadas {
+		if ahora.Sub(momento) > esperaAbortada {
+			delete(s.abortadas, llamada)
+		}
+	}
+	s.abortadas[args.Llamada] = ahora
+	return nil
+}
+
+// llamadaAbortable registra una llamada que se puede abortar con `Abortar`.
+//
+// Parámetros:
+// - llamada: El identificador de la llamada; si es cero, la llamada no se puede abortar.
+//
+// Retorna:
+// - Un canal que se cierra al abortar la llamada (nil si no se puede abortar) y la función que hay
+// que llamar cuando la llamada termina.
+func (s *Sesion) llamadaAbortable(llamada uint64) (<-chan struct{}, func()) {
+	if llamada == 0 {
+		return nil, func() {}
+	}
+	abortada := make(chan struct{})
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.abortadas[llamada]; ok {
+		delete(s.abortadas, llamada)
+		close(abortada)
+		return abortada, func() {}
+	}
+	s.llamadas[llamada] = abortada
+	return abortada, func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		delete(s.llamadas, llamada)
+	}
+}
+
+// Publicar es el método `Broker.Publicar` de la sesión, que deja de esperar sitio en la cola si el cliente
+// aborta la llamada.
+func (s *Sesion) Publicar(args *ArgsPublicar, reply *Reply) error {
+	abortada, terminar := s.llamadaAbortable(args.Llamada)
+	defer terminar()
+	return s.publicarAbortable(args, abortada)
+}
+
+// PublicarLote es el método `Broker.PublicarLote` de la sesión, que deja de esperar sitio en las colas si
+// el cliente aborta la llamada.
+func (s *Sesion) PublicarLote(args *ArgsPublicarLote, reply *ReplyLote) error {
+	abortada, terminar := s.llamadaAbortable(args.Llamada)
+	defer terminar()
+	return s.publicarLote(args, reply, abortada)
+}
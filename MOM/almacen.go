@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Almacen es el almacenamiento de los mensajes de una cola. Toda publicación, confirmación y
+// recuperación de mensajes de una `Cola` pasa por su almacén.
+//
+// Los almacenes se abren con `abrirAlmacen`, que devuelve también los mensajes pendientes de consumir
+// que quedaron de ejecuciones anteriores. `TestConformidadAlmacen` (`go test -run Conformidad ./MOM`)
+// comprueba que cada tipo de almacén cumple lo que se espera de él.
+type Almacen interface {
+	// Anadir guarda un mensaje con un offset mayor que el de todos los anteriores: el suyo si ya lo es
+	// (así una réplica guarda los mensajes con el offset del primario) o el siguiente del almacén.
+	Anadir(m *Mensaje) error
+	// EsperarSincronizado espera a que el mensaje con el offset especificado esté en el almacenamiento
+	// según la política de sincronización del almacén.
+	EsperarSincronizado(offset uint64) error
+	// Confirmar marca como consumido el mensaje con el offset especificado, que ya no se recupera.
+	Confirmar(offset uint64) error
+	// Sincronizar fuerza la escritura de todo lo guardado en el almacenamiento.
+	Sincronizar() error
+	// Cerrar sincroniza y cierra el almacén. Las llamadas posteriores devuelven el resultado de la primera.
+	Cerrar() error
+	// Borrar cierra el almacén y elimina todos sus mensajes.
+	Borrar() error
+}
+
+// Tipos de almacén.
+//
+// - almacenMemoria: los mensajes solo están en memoria y se pierden al apagar el broker. Es el almacén de las colas no duraderas.
+// - almacenRegistro: un registro de solo adición dividido en segmentos (ver `Registro`).
+// - almacenKV: un almacén clave-valor embebido con un valor por mensaje (ver `AlmacenKV`).
+const (
+	almacenMemoria  = "memoria"
+	almacenRegistro = "registro"
+	almacenKV       = "kv"
+)
+
+// errAlmacenCerrado es el error que se devuelve al operar sobre un almacén cerrado.
+var errAlmacenCerrado = errors.New("el almacén de la cola está cerrado")
+
+// tipoAlmacen devuelve el tipo de almacén de una cola que se declara con la durabilidad y el tipo
+// especificados, o un error si no son compatibles.
+//
+// Comportamiento:
+// - Una cola no duradera usa siempre `almacenMemoria`.
+// - Una cola duradera usa el tipo indicado o, si no se indica ninguno, el del broker.
+func tipoAlmacen(duradera bool, tipo, porDefecto string) (string, error) {
+	if !duradera {
+		if tipo != "" && tipo != almacenMemoria {
+			return "", fmt.Errorf("una cola no duradera solo puede usar el almacén %s", almacenMemoria)
+		}
+		return almacenMemoria, nil
+	}
+	if tipo == "" {
+		tipo = porDefecto
+	}
+	switch tipo {
+	case almacenRegistro, almacenKV:
+		return tipo, nil
+	case almacenMemoria:
+		return "", fmt.Errorf("una cola duradera no puede usar el almacén %s", almacenMemoria)
+	}
+	return "", fmt.Errorf("tipo de almacén desconocido: %q (use %s o %s)", tipo, almacenRegistro, almacenKV)
+}
+
+// abrirAlmacen abre o crea un almacén.
+//
+// Parámetros:
+// - tipo: El tipo de almacén.
+// - dir: El directorio del almacén; no se usa en `almacenMemoria`.
+// - politica: La política de sincronización de los mensajes que se añadan; no se usa en `almacenMemoria`.
+// - cod: Cómo se cifran y comprimen los mensajes guardados; no se usa en `almacenMemoria`.
+//
+// Retorna:
+// - El almacén abierto y los mensajes pendientes de consumir, en el orden en que se publicaron.
+// - Un error si el tipo no existe o no se puede abrir el almacén.
+func abrirAlmacen(tipo, dir string, politica PoliticaSync, cod codificacion) (Almacen, []Mensaje, error) {
+	switch tipo {
+	case almacenMemoria:
+		return &AlmacenMemoria{}, nil, nil
+	case almacenRegistro:
+		return abrirRegistro(dir, politica, cod)
+	case almacenKV:
+		return abrirKV(dir, politica, cod)
+	}
+	return nil, nil, fmt.Errorf("tipo de almacén desconocido: %q", tipo)
+}
+
+// AlmacenMemoria es el almacén de las colas no duraderas: los mensajes solo están en el canal de la cola,
+// así que el almacén solo numera los mensajes.
+type AlmacenMemoria struct {
+	mux       sync.Mutex
+	siguiente uint64
+	cerrado   bool
+}
+
+func (a *AlmacenMemoria) Anadir(m *Mensaje) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.cerrado {
+		return errAlmacenCerrado
+	}
+	m.Offset = max(m.Offset, a.siguiente)
+	a.siguiente = m.Offset + 1
+	return nil
+}
+
+func (a *AlmacenMemoria) EsperarSincronizado(offset uint64) error { return nil }
+
+func (a *AlmacenMemoria) Confirmar(offset uint64) error { return nil }
+
+func (a *AlmacenMemoria) Sincronizar() error { return nil }
+
+func (a *AlmacenMemoria) Cerrar() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.cerrado = true
+	return nil
+}
+
+func (a *AlmacenMemoria) Borrar() error { return a.Cerrar() }
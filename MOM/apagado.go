@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// plazoApagadoPorDefecto es el tiempo que se espera a las entregas en curso al apagar el broker.
+const plazoApagadoPorDefecto = 10 * time.Second
+
+// errApagando es el error que se devuelve a las publicaciones recibidas durante el apagado.
+var errApagando = errors.New("el broker se está apagando")
+
+// apagandose indica si ha empezado el apagado del broker.
+func (l *Broker) apagandose() bool {
+	select {
+	case <-l.apagando:
+		return true
+	default:
+		return false
+	}
+}
+
+// Apagar detiene el broker de forma ordenada.
+//
+// Parámetros:
+// - plazo: El tiempo máximo que se espera a que terminen las entregas en curso.
+//
+// Comportamiento:
+// - Deja de aceptar conexiones de clientes y seguidores y publicaciones, y los consumidores dejan de tomar mensajes nuevos.
+// - Detiene las palas, cuyos mensajes sin confirmar vuelven a su cola.
+// - Si el broker es seguidor, deja de replicar y cierra los almacenes de las colas replicadas. Si es un nodo de un clúster, deja de participar en él después de cerrar las conexiones de los clientes.
+// - Espera hasta `plazo` a que los consumidores confirmen las entregas en curso; las que siguen sin confirmar al vencer el plazo vuelven a su cola.
+// - Cancela las suscripciones y cierra las conexiones de los clientes.
+// - Espera a que terminen las escrituras en los almacenes de las colas y los cierra, sincronizándolos con el disco.
+// - Imprime un resumen con las entregas completadas y reencoladas y los mensajes que quedan en cada cola.
+func (l *Broker) Apagar(plazo time.Duration) {
+	l.mux.Lock()
+	if l.apagandose() {
+		l.mux.Unlock()
+		return
+	}
+	close(l.apagando)
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	if l.listenerReplicacion != nil {
+		l.listenerReplicacion.Close()
+	}
+	seguidor := l.seguidor
+	l.seguidor = nil
+	l.mux.Unlock()
+	fmt.Println("Apagando el broker...")
+	if seguidor != nil {
+		seguidor.detener()
+	}
+	l.detenerPalas()
+
+	enCurso := l.enCurso.Load()
+	limite := time.Now().Add(plazo)
+	for l.enCurso.Load() > 0 && time.Now().Before(limite) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	reencoladas := l.enCurso.Load()
+
+	l.mux.Lock()
+	for _, lista := range l.consumidores {
+		for _, sus := range lista {
+			sus.terminar()
+		}
+	}
+	for sesion := range l.sesiones {
+		sesion.conn.Close()
+	}
+	l.mux.Unlock()
+
+	if l.cluster != nil {
+		l.cluster.detener()
+	}
+	l.persistencia.Lock()
+	defer l.persistencia.Unlock()
+	l.sincronizarDurables()
+
+	fmt.Println("Resumen del apagado:")
+	fmt.Println("  entregas completadas durante el apagado:", enCurso-reencoladas)
+	fmt.Println("  entregas reencoladas:", reencoladas)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for nombre, cola := range l.colas {
+		cola.mux.Lock()
+		pendientes := len(cola.pendientes)
+		cola.mux.Unlock()
+		quedan := len(cola.mensajes) + pendientes
+		select {
+		case turno := <-cola.rechazado:
+			if turno != nil {
+				quedan++
+			}
+			cola.rechazado <- turno
+		default:
+		}
+		if cola.durability {
+			fmt.Println("  cola", nombre, "(duradera):", quedan, "mensajes conservados en disco")
+		} else {
+			fmt.Println("  cola", nombre, ":", quedan, "mensajes en memoria descartados")
+		}
+	}
+	fmt.Println("Broker apagado")
+}
+
+// sincronizarDurables cierra los almacenes de las colas, lo que fuerza la escritura en disco de los de las colas duraderas.
+func (l *Broker) sincronizarDurables() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for nombre, cola := range l.colas {
+		if err := cola.almacen.Cerrar(); err != nil {
+			fmt.Println("Error al cerrar el almacén de la cola", nombre+":", err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Mediciones del coste de consumir un mensaje de una cola duradera según su profundidad:
+//
+//	go test -run '^$' -bench . ./MOM
+//
+// Para cada profundidad se llena una cola y se mide cuánto cuesta consumir un mensaje y publicar otro,
+// de modo que la profundidad se mantiene durante toda la medición. Se mide con el registro de segmentos y
+// con el antiguo archivo de texto que se reescribía al consumir, para comparar: el coste del registro no
+// depende de la profundidad y el del archivo crece con ella.
+
+// profundidadesBench son los tamaños de cola con los que se mide el consumo.
+var profundidadesBench = []int{1000, 10000, 100000}
+
+// cuerpoBench es el mensaje que se publica en las mediciones.
+const cuerpoBench = "mensaje de prueba para medir el registro\n"
+
+// BenchmarkRegistro mide consumir y publicar un mensaje en un registro con cada profundidad de `profundidadesBench`.
+func BenchmarkRegistro(b *testing.B) {
+	for _, profundidad := range profundidadesBench {
+		b.Run(fmt.Sprint("profundidad-", profundidad), func(b *testing.B) {
+			benchRegistro(b, filepath.Join(b.TempDir(), "registro"), profundidad)
+		})
+	}
+}
+
+// BenchmarkArchivo mide lo mismo que `BenchmarkRegistro` con un archivo de texto que se reescribe entero al
+// consumir cada mensaje, como hacía el broker antes de usar el registro.
+func BenchmarkArchivo(b *testing.B) {
+	for _, profundidad := range profundidadesBench {
+		b.Run(fmt.Sprint("profundidad-", profundidad), func(b *testing.B) {
+			benchArchivo(b, filepath.Join(b.TempDir(), "archivo.txt"), profundidad)
+		})
+	}
+}
+
+// benchRegistro mide consumir y publicar un mensaje en un registro con `profundidad` mensajes pendientes.
+func benchRegistro(b *testing.B, dir string, profundidad int) {
+	registro, _, err := abrirRegistro(dir, PoliticaSync{Modo: syncSO}, codificacion{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer registro.Borrar()
+	for i := 0; i < profundidad; i++ {
+		if err := registro.Anadir(&Mensaje{Publicado: time.Now(), Cuerpo: cuerpoBench}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var consumido uint64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := registro.Confirmar(consumido); err != nil {
+			b.Fatal(err)
+		}
+		consumido++
+		if err := registro.Anadir(&Mensaje{Publicado: time.Now(), Cuerpo: cuerpoBench}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchArchivo mide consumir y publicar un mensaje en un archivo de texto con `profundidad` mensajes
+// pendientes, reescribiéndolo entero en cada consumo.
+func benchArchivo(b *testing.B, ruta string, profundidad int) {
+	contenido := strings.Repeat(cuerpoBench, profundidad)
+	if err := os.WriteFile(ruta, []byte(contenido), 0644); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		file, err := os.Open(ruta)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var lineas []string
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lineas = append(lineas, scanner.Text())
+		}
+		file.Close()
+		resto := strings.Join(lineas[1:], "\n") + "\n" + cuerpoBench
+		if err := os.WriteFile(ruta, []byte(resto), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
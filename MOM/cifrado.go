@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Cifrado en reposo de las colas duraderas.
+//
+// Con un archivo de claves (opción -claves del broker), el cuerpo de cada entrada que se escribe en el
+// almacén se cifra con AES-GCM y se guarda con la versión `versionEntradaCifrada` del formato:
+//
+//	longitud del ID de la clave (1) | ID de la clave | nonce (12) | cuerpo cifrado con su etiqueta de autenticación
+//
+// El archivo de claves tiene una clave por línea con el formato `id:clave en hexadecimal` (16, 24 o 32
+// bytes); las líneas vacías y las que empiezan por `#` se ignoran. Las entradas nuevas se cifran con la
+// última clave del archivo y las existentes se descifran con la clave cuyo ID llevan, de modo que para
+// rotar la clave basta con añadir una línea al final y reiniciar el broker. Una clave antigua puede
+// quitarse del archivo cuando `MOM fsck -claves` muestra que ninguna entrada la usa.
+
+// tamNonce es el tamaño del nonce de AES-GCM.
+const tamNonce = 12
+
+// sobrecargaCifrado es lo que como mucho ocupa de más el cuerpo cifrado de una entrada: el ID de la
+// clave con su longitud, el nonce y la etiqueta de autenticación.
+const sobrecargaCifrado = 1 + 255 + tamNonce + 16
+
+// errClave es el error que se devuelve cuando no se puede descifrar una entrada. No envuelve
+// `errEntradaCorrupta`, porque la entrada está íntegra y truncarla perdería el mensaje.
+var errClave = errors.New("no se puede descifrar la entrada")
+
+// Llavero contiene las claves con que se cifran y descifran las entradas de las colas duraderas.
+type Llavero struct {
+	claves map[string]cipher.AEAD
+	// activa es el ID de la clave con que se cifran las entradas nuevas.
+	activa string
+}
+
+// cargarLlavero carga las claves del archivo especificado. Avisa si el archivo es accesible para
+// otros usuarios.
+func cargarLlavero(ruta string) (*Llavero, error) {
+	info, err := os.Stat(ruta)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		fmt.Println("Aviso: el archivo de claves", ruta, "es accesible para otros usuarios")
+	}
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		return nil, err
+	}
+	llavero, err := leerLlavero(string(datos))
+	if err != nil {
+		return nil, fmt.Errorf("archivo de claves %s: %w", ruta, err)
+	}
+	return llavero, nil
+}
+
+// leerLlavero lee las claves del contenido de un archivo de claves.
+//
+// Retorna:
+// - El llavero, cuya clave activa es la última.
+// - Un error si alguna línea no es válida, algún ID se repite o no hay ninguna clave.
+func leerLlavero(contenido string) (*Llavero, error) {
+	llavero := &Llavero{claves: make(map[string]cipher.AEAD)}
+	for i, linea := range strings.Split(contenido, "\n") {
+		linea = strings.TrimSpace(linea)
+		if linea == "" || strings.HasPrefix(linea, "#") {
+			continue
+		}
+		id, hexadecimal, ok := strings.Cut(linea, ":")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("línea %d: se esperaba id:clave", i+1)
+		}
+		if _, ok := llavero.claves[id]; ok {
+			return nil, fmt.Errorf("línea %d: la clave %q está repetida", i+1, id)
+		}
+		clave, err := hex.DecodeString(strings.TrimSpace(hexadecimal))
+		if err != nil {
+			return nil, fmt.Errorf("línea %d: clave no válida: %w", i+1, err)
+		}
+		bloque, err := aes.NewCipher(clave)
+		if err != nil {
+			return nil, fmt.Errorf("línea %d: %w", i+1, err)
+		}
+		aead, err := cipher.NewGCM(bloque)
+		if err != nil {
+			return nil, fmt.Errorf("línea %d: %w", i+1, err)
+		}
+		llavero.claves[id] = aead
+		llavero.activa = id
+	}
+	if llavero.activa == "" {
+		return nil, errors.New("no contiene ninguna clave")
+	}
+	return llavero, nil
+}
+
+// cifrar cifra el cuerpo de una entrada con la clave activa.
+func (ll *Llavero) cifrar(cuerpo []byte) []byte {
+	aead := ll.claves[ll.activa]
+	cifrado := make([]byte, 0, 1+len(ll.activa)+tamNonce+len(cuerpo)+aead.Overhead())
+	cifrado = append(cifrado, byte(len(ll.activa)))
+	cifrado = append(cifrado, ll.activa...)
+	nonce := make([]byte, tamNonce)
+	rand.Read(nonce)
+	cifrado = append(cifrado, nonce...)
+	return aead.Seal(cifrado, nonce, cuerpo, nil)
+}
+
+// descifrar descifra el cuerpo cifrado de una entrada con la clave cuyo ID lleva.
+//
+// Retorna:
+// - El cuerpo descifrado, o un error que envuelve `errClave` si el llavero es nil, no tiene la clave o la autenticación falla.
+func (ll *Llavero) descifrar(cifrado []byte) ([]byte, error) {
+	id, resto, err := claveCifrado(cifrado)
+	if err != nil {
+		return nil, err
+	}
+	if ll == nil {
+		return nil, fmt.Errorf("%w: está cifrada con la clave %q y no hay archivo de claves", errClave, id)
+	}
+	aead, ok := ll.claves[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: la clave %q no está en el archivo de claves", errClave, id)
+	}
+	if len(resto) < tamNonce {
+		return nil, fmt.Errorf("%w: cuerpo cifrado demasiado corto", errEntradaCorrupta)
+	}
+	cuerpo, err := aead.Open(nil, resto[:tamNonce], resto[tamNonce:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: la autenticación con la clave %q falla", errClave, id)
+	}
+	return cuerpo, nil
+}
+
+// claveCifrado devuelve el ID de la clave de un cuerpo cifrado y el resto del cuerpo.
+func claveCifrado(cifrado []byte) (string, []byte, error) {
+	if len(cifrado) < 1 || len(cifrado) < 1+int(cifrado[0]) {
+		return "", nil, fmt.Errorf("%w: cuerpo cifrado demasiado corto", errEntradaCorrupta)
+	}
+	n := 1 + int(cifrado[0])
+	return string(cifrado[1:n]), cifrado[n:], nil
+}
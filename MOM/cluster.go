@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clúster de brokers.
+//
+// Un broker arrancado con -cluster es un nodo de un clúster de tres o cinco brokers que acuerdan con
+// Raft (ver `NodoRaft`) las operaciones sobre las colas duraderas: declaraciones, publicaciones,
+// confirmaciones y borrados. El líder de Raft es el líder de todas las colas: solo él las carga y atiende
+// a los clientes, y empieza cada término con una entrada `opLiderazgo` que lo indica. Los demás nodos
+// guardan las operaciones confirmadas en una `replica` de las colas duraderas, como un seguidor de la
+// replicación primario/seguidor.
+//
+// - Los clientes pueden conectarse a cualquier nodo: los que no son líderes redirigen la conexión al líder.
+// - El líder responde a las publicaciones y declaraciones de colas duraderas cuando están confirmadas en
+// la mayoría de los nodos, de modo que perder una minoría de nodos no pierde mensajes. Las confirmaciones
+// de los consumidores no esperan: tras un cambio de líder se pueden volver a entregar mensajes ya confirmados.
+// - Al ganar una elección, un nodo aplica las entradas confirmadas hasta la de su término y después carga
+// las colas de su réplica, como un seguidor al promocionarse. Al perder el liderazgo descarta sus colas,
+// que pueden contener operaciones sin confirmar, y las reconstruye con el estado del clúster.
+// - Al arrancar, cada nodo reconstruye también sus colas duraderas con su instantánea y su registro.
+//
+// Todos los nodos, incluido el líder, mantienen en memoria el estado del clúster (`estadoCluster`): las
+// colas duraderas y sus mensajes sin confirmar tras aplicar las entradas confirmadas. Cada
+// `compactacionCluster` entradas aplicadas lo guardan como instantánea de Raft y compactan el registro; un
+// nodo que recibe la instantánea del líder la carga en lugar de aplicar las entradas que contiene.
+//
+// Las colas no duraderas solo existen en el líder y se pierden con un cambio de líder.
+
+// esperaConfirmacionCluster es el tiempo máximo que una operación espera a confirmarse en el clúster.
+const esperaConfirmacionCluster = 10 * time.Second
+
+// esperaLiderCluster es el tiempo máximo que una conexión de un cliente espera a que haya un líder.
+const esperaLiderCluster = 5 * time.Second
+
+// compactacionCluster es el número de entradas aplicadas desde la última instantánea tras el que el nodo
+// guarda otra y compacta su registro.
+const compactacionCluster = 10000
+
+// Cluster une el broker a un clúster Raft.
+type Cluster struct {
+	broker    *Broker
+	nodo      *NodoRaft
+	direccion string
+	// terminoActivo es el término en que el nodo es el líder y atiende a los clientes; cero si no los atiende.
+	terminoActivo atomic.Uint64
+	// mux protege `replica`, `estado` y `aplicado` y `terminoAplicado`, el índice y el término de la
+	// última entrada aplicada.
+	mux             sync.Mutex
+	replica         replica
+	estado          estadoCluster
+	aplicado        uint64
+	terminoAplicado uint64
+	fin             chan struct{}
+	terminado       chan struct{}
+}
+
+// estadoCluster es el estado de las colas duraderas del clúster tras aplicar las entradas confirmadas del
+// registro: cada cola con su entrada del manifiesto y sus mensajes sin confirmar indexados por offset.
+// Los nodos guardan los mensajes con el offset que les asignó el líder (ver `replica`), así que el offset
+// identifica el mismo mensaje en todos ellos aunque cambie el líder.
+type estadoCluster map[string]*colaCluster
+
+// colaCluster es una cola duradera del estado del clúster.
+type colaCluster struct {
+	entrada  EntradaManifiesto
+	mensajes map[uint64]Mensaje
+}
+
+// aplicar aplica una operación sobre las colas duraderas al estado.
+func (e estadoCluster) aplicar(op OperacionReplica) {
+	switch op.Tipo {
+	case opDeclarar:
+		if _, ok := e[op.Cola.Nombre]; !ok {
+			e[op.Cola.Nombre] = &colaCluster{entrada: op.Cola, mensajes: make(map[uint64]Mensaje)}
+		}
+	case opPublicar:
+		if cola, ok := e[op.Nombre]; ok {
+			cola.mensajes[op.Mensaje.Offset] = op.Mensaje
+		}
+	case opConfirmar:
+		if cola, ok := e[op.Nombre]; ok {
+			delete(cola.mensajes, op.Offset)
+		}
+	case opBorrar:
+		delete(e, op.Nombre)
+	}
+}
+
+// colas devuelve las colas del estado, ordenadas por nombre, con sus mensajes ordenados por offset.
+func (e estadoCluster) colas() []ColaReplicada {
+	colas := make([]ColaReplicada, 0, len(e))
+	for _, cola := range e {
+		replicada := ColaReplicada{Cola: cola.entrada}
+		for _, m := range cola.mensajes {
+			replicada.Mensajes = append(replicada.Mensajes, m)
+		}
+		slices.SortFunc(replicada.Mensajes, func(a, b Mensaje) int { return cmp.Compare(a.Offset, b.Offset) })
+		colas = append(colas, replicada)
+	}
+	slices.SortFunc(colas, func(a, b ColaReplicada) int { return cmp.Compare(a.Cola.Nombre, b.Cola.Nombre) })
+	return colas
+}
+
+// nuevoEstadoCluster crea el estado con las colas especificadas.
+func nuevoEstadoCluster(colas []ColaReplicada) estadoCluster {
+	e := make(estadoCluster)
+	for _, replicada := range colas {
+		cola := &colaCluster{entrada: replicada.Cola, mensajes: make(map[uint64]Mensaje)}
+		for _, m := range replicada.Mensajes {
+			cola.mensajes[m.Offset] = m
+		}
+		e[replicada.Cola.Nombre] = cola
+	}
+	return e
+}
+
+// unirseCluster convierte al broker en un nodo de un clúster. Debe llamarse después de `abrirDatos` y en
+// lugar de `RescatarColasAnteriores` y `EjecutarBroker`.
+//
+// Parámetros:
+// - direccion: La dirección en la que el broker atiende a los clientes.
+// - raft: La dirección en la que el broker atiende a los demás nodos.
+// - nodos: Las direcciones en las que atienden a los demás nodos todos los nodos del clúster, incluido este.
+//
+// Retorna:
+// - Un error si `raft` no está entre los nodos o no se puede abrir el estado de Raft o su dirección.
+func (l *Broker) unirseCluster(direccion, raft string, nodos []string) error {
+	if !slices.Contains(nodos, raft) {
+		return fmt.Errorf("la dirección %s no está entre los nodos del clúster", raft)
+	}
+	var pares []string
+	for _, nodo := range nodos {
+		if nodo != raft && !slices.Contains(pares, nodo) {
+			pares = append(pares, nodo)
+		}
+	}
+	c := &Cluster{
+		broker:    l,
+		direccion: direccion,
+		replica:   nuevaReplica(l),
+		estado:    make(estadoCluster),
+		fin:       make(chan struct{}),
+		terminado: make(chan struct{}),
+	}
+	nodo, err := abrirNodoRaft(filepath.Join(l.datos, directorioRaft), raft, pares, direccion)
+	if err != nil {
+		return err
+	}
+	c.nodo = nodo
+	// Las colas duraderas pueden tener operaciones sin confirmar; se reconstruyen con la instantánea y el registro.
+	if err := c.instalar(); err != nil {
+		nodo.detener()
+		return err
+	}
+	ln, err := net.Listen("tcp", raft)
+	if err != nil {
+		nodo.detener()
+		return err
+	}
+	l.mux.Lock()
+	l.cluster = c
+	l.mux.Unlock()
+	if err := nodo.iniciar(ln); err != nil {
+		ln.Close()
+		return err
+	}
+	fmt.Println("Nodo", raft, "del clúster de", len(pares)+1, "nodos")
+	go c.ejecutar()
+	go l.EjecutarBroker(direccion)
+	return nil
+}
+
+// ejecutar aplica las entradas confirmadas del registro, o la instantánea que ha enviado el líder si
+// contiene entradas que el nodo no ha aplicado, y promociona o degrada al nodo cuando gana o pierde el
+// liderazgo, hasta que se detiene el clúster.
+func (c *Cluster) ejecutar() {
+	defer close(c.terminado)
+	for {
+		estado, cambio := c.nodo.estado()
+		if activo := c.terminoActivo.Load(); activo != 0 && (estado.Rol != liderRaft || estado.Termino != activo) {
+			c.degradar()
+		}
+		c.mux.Lock()
+		aplicado := c.aplicado
+		c.mux.Unlock()
+		if aplicado < estado.Instantanea {
+			if err := c.instalar(); err != nil {
+				// Se vuelve a intentar en el siguiente latido.
+				fmt.Println("Error al cargar la instantánea de Raft:", err)
+				select {
+				case <-c.fin:
+					return
+				case <-time.After(latidoRaft):
+				}
+			}
+			continue
+		}
+		if aplicado < estado.Confirmado {
+			for i, entrada := range c.nodo.entradas(aplicado+1, estado.Confirmado) {
+				c.aplicar(entrada, estado)
+				c.mux.Lock()
+				c.aplicado = aplicado + 1 + uint64(i)
+				c.terminoAplicado = entrada.Termino
+				c.mux.Unlock()
+			}
+			c.compactar(estado.Instantanea)
+			continue
+		}
+		select {
+		case <-c.fin:
+			return
+		case <-cambio:
+		}
+	}
+}
+
+// instalar sustituye el estado del clúster y las colas de la réplica por los de la instantánea del nodo y
+// sigue aplicando el registro desde la entrada siguiente. Sin instantánea, deja el estado y la réplica vacíos.
+func (c *Cluster) instalar() error {
+	instantanea, err := c.nodo.instantanea()
+	if err != nil {
+		return err
+	}
+	var colas []ColaReplicada
+	if instantanea.Indice > 0 {
+		if err := gob.NewDecoder(bytes.NewReader(instantanea.Datos)).Decode(&colas); err != nil {
+			return fmt.Errorf("estado del clúster no válido: %w", err)
+		}
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if instantanea.Indice > 0 && instantanea.Indice <= c.aplicado {
+		return nil
+	}
+	c.estado = nuevoEstadoCluster(colas)
+	c.aplicado, c.terminoAplicado = instantanea.Indice, instantanea.Termino
+	if err := c.replica.cargar(colas); err != nil {
+		return err
+	}
+	if instantanea.Indice > 0 {
+		fmt.Println("Instantánea del clúster cargada:", len(colas), "colas, hasta la entrada", instantanea.Indice)
+	}
+	return nil
+}
+
+// compactar guarda el estado del clúster como instantánea de Raft y compacta el registro, si se han
+// aplicado al menos `compactacionCluster` entradas desde la instantánea con el índice especificado.
+// Un error se muestra y el registro se vuelve a compactar más adelante.
+func (c *Cluster) compactar(instantanea uint64) {
+	c.mux.Lock()
+	indice, termino := c.aplicado, c.terminoAplicado
+	if indice < instantanea+compactacionCluster {
+		c.mux.Unlock()
+		return
+	}
+	var datos bytes.Buffer
+	err := gob.NewEncoder(&datos).Encode(c.estado.colas())
+	c.mux.Unlock()
+	if err == nil {
+		err = c.nodo.compactar(indice, termino, datos.Bytes())
+	}
+	if err != nil {
+		fmt.Println("Error al compactar el registro de Raft:", err)
+	}
+}
+
+// aplicar aplica una entrada confirmada del registro al estado del clúster y, si el nodo no atiende a los
+// clientes, a la réplica.
+//
+// Comportamiento:
+// - Si el nodo atiende a los clientes, no cambia la réplica: las operaciones ya se han aplicado al proponerlas.
+// - Si la entrada es la `opLiderazgo` del término en que el nodo es líder, lo promociona.
+// - Si no, guarda la operación en la réplica. Un error se muestra y la entrada se da por aplicada.
+func (c *Cluster) aplicar(entrada EntradaRaft, estado EstadoRaft) {
+	if entrada.Op.Tipo != opLiderazgo {
+		c.mux.Lock()
+		c.estado.aplicar(entrada.Op)
+		c.mux.Unlock()
+	}
+	if c.terminoActivo.Load() != 0 {
+		return
+	}
+	if entrada.Op.Tipo == opLiderazgo {
+		if estado.Rol == liderRaft && entrada.Termino == estado.Termino && entrada.Op.Nombre == c.direccion {
+			c.promocionar(entrada.Termino)
+		}
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if err := c.replica.aplicar(entrada.Op); err != nil {
+		fmt.Println("Error al aplicar la entrada del registro de Raft:", err)
+	}
+}
+
+// promocionar carga las colas de la réplica en el broker y empieza a atender a los clientes como líder.
+func (c *Cluster) promocionar(termino uint64) {
+	fmt.Println("Líder del clúster en el término", termino, "- cargando las colas duraderas")
+	c.mux.Lock()
+	c.replica.cerrar()
+	c.mux.Unlock()
+	c.terminoActivo.Store(termino)
+	c.broker.RescatarColasAnteriores()
+}
+
+// degradar deja de atender a los clientes, descarta las colas del broker y las reconstruye con el estado del
+// clúster, que solo contiene las operaciones confirmadas.
+func (c *Cluster) degradar() {
+	fmt.Println("El nodo ya no es el líder del clúster - descartando las colas")
+	c.terminoActivo.Store(0)
+	l := c.broker
+	l.mux.Lock()
+	colas, consumidores := l.colas, l.consumidores
+	l.colas = make(map[string]*Cola)
+	l.consumidores = make(map[string][]*Suscripcion)
+	sesiones := make([]*Sesion, 0, len(l.sesiones))
+	for sesion := range l.sesiones {
+		sesiones = append(sesiones, sesion)
+	}
+	l.mux.Unlock()
+	for _, lista := range consumidores {
+		for _, sus := range lista {
+			sus.terminar()
+		}
+	}
+	for _, sesion := range sesiones {
+		sesion.conn.Close()
+	}
+	l.persistencia.Lock()
+	for nombre, cola := range colas {
+		if err := cola.almacen.Cerrar(); err != nil {
+			fmt.Println("Error al cerrar el almacén de la cola", nombre+":", err)
+		}
+	}
+	l.persistencia.Unlock()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.replica = nuevaReplica(l)
+	if err := c.replica.cargar(c.estado.colas()); err != nil {
+		fmt.Println("Error al reconstruir las colas duraderas:", err)
+	}
+}
+
+// proponer replica una operación sobre una cola duradera.
+//
+// Retorna:
+// - El índice de la operación en el registro del clúster.
+// - `errNoLider` si el nodo no atiende a los clientes, o el error con que falla la propuesta.
+func (c *Cluster) proponer(op OperacionReplica) (uint64, error) {
+	termino := c.terminoActivo.Load()
+	if termino == 0 {
+		return 0, errNoLider
+	}
+	return c.nodo.proponer(op, termino)
+}
+
+// esperar espera a que se confirme en el clúster la operación con el índice especificado.
+func (c *Cluster) esperar(indice uint64) error {
+	termino := c.terminoActivo.Load()
+	if termino == 0 {
+		return errNoLider
+	}
+	return c.nodo.esperarConfirmado(termino, indice, esperaConfirmacionCluster)
+}
+
+// esperarCluster espera, si el broker es un nodo de un clúster, a que se confirme en el clúster la
+// operación con el índice especificado; con un índice cero, que corresponde a las operaciones que no se
+// proponen en el clúster, no espera.
+func (l *Broker) esperarCluster(indice uint64) error {
+	if l.cluster == nil || indice == 0 {
+		return nil
+	}
+	return l.cluster.esperar(indice)
+}
+
+// atender atiende una conexión de un cliente: la atiende el broker si el nodo es el líder y, si no, se
+// redirige al líder. Si no hay líder en `esperaLiderCluster`, cierra la conexión.
+func (c *Cluster) atender(conn net.Conn) {
+	limite := time.NewTimer(esperaLiderCluster)
+	defer limite.Stop()
+	for {
+		if c.terminoActivo.Load() != 0 {
+			c.broker.atenderConexion(conn)
+			return
+		}
+		estado, cambio := c.nodo.estado()
+		if estado.Rol != liderRaft && estado.LiderClientes != "" && estado.LiderClientes != c.direccion {
+			c.redirigir(conn, estado.LiderClientes)
+			return
+		}
+		// La promoción no cambia el estado de Raft, así que también se comprueba periódicamente.
+		select {
+		case <-cambio:
+		case <-time.After(latidoRaft):
+		case <-limite.C:
+			fmt.Println("No hay líder en el clúster; cerrando la conexión del cliente")
+			conn.Close()
+			return
+		case <-c.fin:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// redirigir conecta la conexión de un cliente con el líder del clúster hasta que una de las dos se cierra.
+func (c *Cluster) redirigir(conn net.Conn, lider string) {
+	defer conn.Close()
+	destino, err := net.DialTimeout("tcp", lider, esperaRPCRaft)
+	if err != nil {
+		fmt.Println("Error al redirigir la conexión al líder", lider+":", err)
+		return
+	}
+	defer destino.Close()
+	fmt.Println("Redirigiendo la conexión del cliente al líder", lider)
+	terminada := make(chan struct{}, 2)
+	copiar := func(a, de net.Conn) {
+		io.Copy(a, de)
+		terminada <- struct{}{}
+	}
+	go copiar(destino, conn)
+	go copiar(conn, destino)
+	<-terminada
+}
+
+// mostrar muestra en la consola el estado del nodo y, si no es el líder, sus colas replicadas.
+func (c *Cluster) mostrar() {
+	estado, _ := c.nodo.estado()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	fmt.Println("Nodo", c.nodo.id, "del clúster:", estado.Rol, "en el término", estado.Termino, "-", estado.Ultimo, "entradas,", estado.Confirmado, "confirmadas,", c.aplicado, "aplicadas, instantánea hasta la", estado.Instantanea, "- líder:", estado.LiderClientes)
+	if c.terminoActivo.Load() == 0 {
+		fmt.Println("Colas replicadas:", len(c.replica.colas))
+		c.replica.mostrar()
+	}
+}
+
+// detener deja de participar en el clúster y cierra los almacenes de las colas replicadas.
+func (c *Cluster) detener() {
+	close(c.fin)
+	<-c.terminado
+	c.nodo.detener()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.replica.cerrar()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"slices"
+	"sync/atomic"
+)
+
+// Compresión de los mensajes.
+//
+// Los mensajes se pueden comprimir con gzip o zlib en dos sitios:
+//
+//   - En el transporte: el cliente propone en `Conectar` los algoritmos que entiende y el broker elige
+//     uno. Desde entonces el broker comprime los mensajes que entrega a esa sesión si ocupan al menos
+//     `umbralCompresion` bytes y comprimidos ocupan menos, e indica el algoritmo en el campo Compresion
+//     de la entrega. El cliente puede publicar mensajes comprimidos indicando el algoritmo en
+//     `ArgsPublicar.Compresion`; el broker los guarda y los entrega descomprimidos.
+//   - En el almacén: una cola duradera declarada con compresión (o con la del broker, opción
+//     -compresion) guarda comprimidas las entradas de sus mensajes con el mismo criterio. Cada entrada
+//     indica si está comprimida, de modo que una cola puede tener entradas de los dos tipos.
+//
+// `ListarColas` muestra los bytes que ahorra cada cola en el almacén y en el transporte.
+const (
+	compresionGzip = "gzip"
+	compresionZlib = "zlib"
+)
+
+// umbralCompresion es el tamaño a partir del cual se comprime un mensaje; los más pequeños apenas
+// ganan nada y cuestan lo mismo de comprimir.
+const umbralCompresion = 512
+
+// algoritmosCompresion son los algoritmos que entiende el broker, por orden de preferencia.
+var algoritmosCompresion = []string{compresionGzip, compresionZlib}
+
+// validarCompresion comprueba que el algoritmo especificado existe; el vacío indica sin compresión.
+func validarCompresion(algoritmo string) error {
+	switch algoritmo {
+	case "", compresionGzip, compresionZlib:
+		return nil
+	}
+	return fmt.Errorf("algoritmo de compresión desconocido: %q (use %s o %s)", algoritmo, compresionGzip, compresionZlib)
+}
+
+// negociarCompresion elige el primero de los algoritmos propuestos por el cliente que entiende el broker.
+//
+// Retorna:
+// - El algoritmo elegido, o una cadena vacía si no hay ninguno en común.
+func negociarCompresion(propuestos []string) string {
+	for _, algoritmo := range propuestos {
+		if slices.Contains(algoritmosCompresion, algoritmo) {
+			return algoritmo
+		}
+	}
+	return ""
+}
+
+// comprimir comprime datos con el algoritmo especificado.
+//
+// Retorna:
+// - Los datos comprimidos y verdadero, o los datos sin comprimir y falso si son más pequeños que
+// `umbralCompresion`, si el algoritmo está vacío o si comprimidos no ocupan menos.
+func comprimir(algoritmo string, datos []byte) ([]byte, bool) {
+	if algoritmo == "" || len(datos) < umbralCompresion {
+		return datos, false
+	}
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch algoritmo {
+	case compresionGzip:
+		w = gzip.NewWriter(&buf)
+	case compresionZlib:
+		w = zlib.NewWriter(&buf)
+	default:
+		return datos, false
+	}
+	// Las escrituras en un bytes.Buffer no fallan.
+	w.Write(datos)
+	w.Close()
+	if buf.Len() >= len(datos) {
+		return datos, false
+	}
+	return buf.Bytes(), true
+}
+
+// descomprimir descomprime datos comprimidos con el algoritmo especificado.
+//
+// Parámetros:
+// - maximo: El mayor tamaño que se acepta para los datos descomprimidos, de modo que unos datos
+// maliciosos no puedan agotar la memoria.
+//
+// Retorna:
+// - Los datos descomprimidos, o un error si el algoritmo no existe, los datos no son válidos o
+// descomprimidos ocupan más de `maximo`.
+func descomprimir(algoritmo string, datos []byte, maximo int) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch algoritmo {
+	case compresionGzip:
+		r, err = gzip.NewReader(bytes.NewReader(datos))
+	case compresionZlib:
+		r, err = zlib.NewReader(bytes.NewReader(datos))
+	default:
+		return nil, validarCompresion(algoritmo)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("datos comprimidos con %s no válidos: %w", algoritmo, err)
+	}
+	defer r.Close()
+	descomprimidos, err := io.ReadAll(io.LimitReader(r, int64(maximo)+1))
+	if err != nil {
+		return nil, fmt.Errorf("datos comprimidos con %s no válidos: %w", algoritmo, err)
+	}
+	if len(descomprimidos) > maximo {
+		return nil, fmt.Errorf("los datos descomprimidos ocupan más del máximo de %d bytes", maximo)
+	}
+	return descomprimidos, nil
+}
+
+// contadorCompresion acumula cuántos bytes ocupaban los mensajes comprimidos antes y después de comprimirlos.
+type contadorCompresion struct {
+	mensajes    atomic.Int64
+	originales  atomic.Int64
+	comprimidos atomic.Int64
+}
+
+// anotar cuenta un mensaje comprimido; si el contador es nil, no hace nada.
+func (c *contadorCompresion) anotar(original, comprimido int) {
+	if c == nil {
+		return
+	}
+	c.mensajes.Add(1)
+	c.originales.Add(int64(original))
+	c.comprimidos.Add(int64(comprimido))
+}
+
+// String describe el número de mensajes comprimidos y los bytes ahorrados.
+func (c *contadorCompresion) String() string {
+	originales, comprimidos := c.originales.Load(), c.comprimidos.Load()
+	ahorro := originales - comprimidos
+	porcentaje := 0.0
+	if originales > 0 {
+		porcentaje = 100 * float64(ahorro) / float64(originales)
+	}
+	return fmt.Sprintf("%d mensajes comprimidos, %d bytes ahorrados (%.1f%%)", c.mensajes.Load(), ahorro, porcentaje)
+}
+
+// comprimirEntrega comprime el contenido de un mensaje de la cola especificada que se entrega a la sesión,
+// si la sesión ha negociado compresión y `comprimir` lo considera útil.
+//
+// Parámetros:
+// - nombre: El nombre de la cola del mensaje, en cuyas estadísticas se anota lo que se ahorra.
+// - mensaje: El contenido del mensaje, que se sustituye por el comprimido.
+//
+// Retorna:
+// - El algoritmo con que se ha comprimido el mensaje, o una cadena vacía si no se ha comprimido.
+func (s *Sesion) comprimirEntrega(nombre string, mensaje *string) string {
+	s.mux.Lock()
+	algoritmo := s.compresion
+	s.mux.Unlock()
+	comprimido, ok := comprimir(algoritmo, []byte(*mensaje))
+	if !ok {
+		return ""
+	}
+	if cola, existe := s.cola(nombre); existe {
+		cola.compresionTransporte.anotar(len(*mensaje), len(comprimido))
+	}
+	*mensaje = string(comprimido)
+	return algoritmo
+}
+
+// Obtener es el método `Broker.Obtener` de la sesión, que puede devolver el mensaje comprimido
+// (ver `comprimirEntrega`).
+func (s *Sesion) Obtener(args *ArgsObtener, reply *ReplyObtener) error {
+	if err := s.Broker.Obtener(args, reply); err != nil || reply.Vacia {
+		return err
+	}
+	reply.Compresion = s.comprimirEntrega(args.Nombre, &reply.Mensaje)
+	return nil
+}
+
+// Recibir es el método `Broker.Recibir` de la sesión, que puede devolver los mensajes comprimidos
+// (ver `comprimirEntrega`) y deja de esperar si el cliente aborta la llamada (ver `Abortar`).
+func (s *Sesion) Recibir(args *ArgsRecibir, reply *ReplyRecibir) error {
+	abortada, terminar := s.llamadaAbortable(args.Llamada)
+	defer terminar()
+	if err := s.recibir(args, reply, abortada); err != nil {
+		return err
+	}
+	for i := range reply.Mensajes {
+		reply.Mensajes[i].Compresion = s.comprimirEntrega(args.Nombre, &reply.Mensajes[i].Mensaje)
+	}
+	return nil
+}
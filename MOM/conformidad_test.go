@@ -0,0 +1,642 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// casoConformidad es una de las comprobaciones que debe superar todo almacén.
+type casoConformidad struct {
+	nombre string
+	// persistente indica que el caso solo se aplica a los almacenes que conservan sus mensajes al reabrirse.
+	persistente bool
+	probar      func(p *pruebaAlmacen) error
+}
+
+// pruebaAlmacen es el almacén sobre el que se ejecuta un caso de conformidad.
+type pruebaAlmacen struct {
+	tipo     string
+	politica PoliticaSync
+	cod      codificacion
+	dir      string
+}
+
+// abrir abre el almacén de la prueba.
+func (p *pruebaAlmacen) abrir() (Almacen, []Mensaje, error) {
+	return abrirAlmacen(p.tipo, p.dir, p.politica, p.cod)
+}
+
+// reabrir cierra el almacén y lo vuelve a abrir, como al reiniciar el broker.
+func (p *pruebaAlmacen) reabrir(almacen Almacen) (Almacen, []Mensaje, error) {
+	if err := almacen.Cerrar(); err != nil {
+		return nil, nil, fmt.Errorf("Cerrar: %w", err)
+	}
+	return p.abrir()
+}
+
+// casosConformidad son las comprobaciones de `TestConformidadAlmacen`.
+var casosConformidad = []casoConformidad{
+	{"asigna offsets crecientes", false, conformidadOffsets},
+	{"no reutiliza offsets de mensajes confirmados", false, conformidadSinReutilizar},
+	{"conserva un offset mayor que los anteriores", false, conformidadOffsetConservado},
+	{"cerrar es idempotente y no se puede añadir tras cerrar", false, conformidadCerrar},
+	{"no deja esperando la sincronización al cerrar", false, conformidadEsperaAlCerrar},
+	{"recupera en orden los mensajes no confirmados", true, conformidadRecuperar},
+	{"no reutiliza offsets tras reabrir", true, conformidadSinReutilizarTrasReabrir},
+	{"recupera y compacta los mensajes separados por offsets saltados", true, conformidadHuecos},
+	{"trunca una escritura interrumpida", true, conformidadEscrituraInterrumpida},
+	{"no trunca las entradas que siguen a una longitud dañada", true, conformidadLongitudDanada},
+	{"borrar elimina los mensajes", true, conformidadBorrar},
+	{"lee las entradas escritas con claves anteriores", true, conformidadRotacion},
+	{"lee las entradas comprimidas sin compresión configurada", true, conformidadCompresion},
+}
+
+// Claves de las pruebas de cifrado.
+const (
+	claveConformidadAntigua = "antigua:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	claveConformidadNueva   = "nueva:202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"
+)
+
+// TestConformidadAlmacen ejecuta los casos de conformidad sobre cada tipo de almacén y política de
+// sincronización.
+//
+// Comportamiento:
+// - `almacenMemoria` se prueba una vez, solo con los casos no persistentes; `almacenRegistro` y `almacenKV` se prueban con cada política de sincronización y, con la política `syncGrupo`, también cifrando las entradas, comprimiéndolas con gzip y comprimiéndolas con zlib y cifrándolas.
+func TestConformidadAlmacen(t *testing.T) {
+	politicas := []PoliticaSync{
+		{Modo: syncSiempre},
+		{Modo: syncGrupo, Intervalo: time.Millisecond},
+		{Modo: syncSO},
+	}
+	pruebas := []pruebaAlmacen{{tipo: almacenMemoria, politica: PoliticaSync{Modo: syncSO}}}
+	llavero, err := leerLlavero(claveConformidadNueva)
+	if err != nil {
+		t.Fatal("Error al crear las claves de prueba:", err)
+	}
+	for _, tipo := range []string{almacenRegistro, almacenKV} {
+		for _, politica := range politicas {
+			pruebas = append(pruebas, pruebaAlmacen{tipo: tipo, politica: politica})
+		}
+		pruebas = append(pruebas,
+			pruebaAlmacen{tipo: tipo, politica: politicas[1], cod: codificacion{llavero: llavero}},
+			pruebaAlmacen{tipo: tipo, politica: politicas[1], cod: codificacion{compresion: compresionGzip}},
+			pruebaAlmacen{tipo: tipo, politica: politicas[1], cod: codificacion{llavero: llavero, compresion: compresionZlib}},
+		)
+	}
+	for _, prueba := range pruebas {
+		variante := prueba.politica.Modo
+		if prueba.cod.compresion != "" {
+			variante += "+" + prueba.cod.compresion
+		}
+		if prueba.cod.llavero != nil {
+			variante += "+cifrado"
+		}
+		t.Run(prueba.tipo+"/"+variante, func(t *testing.T) {
+			for _, caso := range casosConformidad {
+				if caso.persistente && prueba.tipo == almacenMemoria {
+					continue
+				}
+				t.Run(caso.nombre, func(t *testing.T) {
+					prueba := prueba
+					prueba.dir = t.TempDir()
+					if err := caso.probar(&prueba); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+		})
+	}
+}
+
+// TestAbrirAlmacenDesconocido comprueba que `abrirAlmacen` rechaza los tipos desconocidos.
+func TestAbrirAlmacenDesconocido(t *testing.T) {
+	_, _, err := abrirAlmacen("desconocido", t.TempDir(), PoliticaSync{Modo: syncSO}, codificacion{})
+	if err == nil {
+		t.Fatal("abrirAlmacen aceptó un tipo desconocido")
+	}
+}
+
+// mensajesConformidad devuelve mensajes de prueba con contenidos que el formato debe conservar:
+// saltos de línea, contenido vacío, cabeceras y TTL.
+func mensajesConformidad() []*Mensaje {
+	publicado := time.Unix(1700000000, 123456789)
+	return []*Mensaje{
+		{ID: "a", Publicado: publicado, Cuerpo: "hola"},
+		{ID: "b", Publicado: publicado, Cuerpo: "varias\nlíneas\n"},
+		{ID: "c", Publicado: publicado, Cuerpo: ""},
+		{ID: "d", Publicado: publicado, TTL: time.Hour, Cabeceras: map[string]string{"tipo": "prueba", "vacía": ""}, Cuerpo: "con cabeceras"},
+		{ID: "", Publicado: publicado, Cuerpo: "sin salto de línea final"},
+		// Un mensaje que se comprime bien y otro que no se puede comprimir, ambos por encima de `umbralCompresion`.
+		{ID: "e", Publicado: publicado, Cuerpo: strings.Repeat(`{"campo": "valor repetido"}`, 100)},
+		{ID: "f", Publicado: publicado, Cuerpo: textoAleatorio(4 * umbralCompresion)},
+	}
+}
+
+// textoAleatorio devuelve un texto pseudoaleatorio, siempre el mismo, que no se puede comprimir.
+func textoAleatorio(n int) string {
+	aleatorio := rand.New(rand.NewSource(1))
+	datos := make([]byte, n)
+	aleatorio.Read(datos)
+	return string(datos)
+}
+
+// anadirTodos añade los mensajes al almacén y espera a que estén sincronizados.
+func anadirTodos(almacen Almacen, mensajes []*Mensaje) error {
+	for _, m := range mensajes {
+		if err := almacen.Anadir(m); err != nil {
+			return fmt.Errorf("Anadir: %w", err)
+		}
+	}
+	if len(mensajes) > 0 {
+		if err := almacen.EsperarSincronizado(mensajes[len(mensajes)-1].Offset); err != nil {
+			return fmt.Errorf("EsperarSincronizado: %w", err)
+		}
+	}
+	return nil
+}
+
+// mensajesIguales indica si dos mensajes tienen los mismos campos.
+func mensajesIguales(a, b *Mensaje) bool {
+	return a.Offset == b.Offset && a.ID == b.ID && a.Publicado.Equal(b.Publicado) && a.TTL == b.TTL &&
+		a.Cuerpo == b.Cuerpo && (len(a.Cabeceras) == 0 && len(b.Cabeceras) == 0 || reflect.DeepEqual(a.Cabeceras, b.Cabeceras))
+}
+
+func conformidadOffsets(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer almacen.Borrar()
+	mensajes := mensajesConformidad()
+	if err := anadirTodos(almacen, mensajes); err != nil {
+		return err
+	}
+	for i := 1; i < len(mensajes); i++ {
+		if mensajes[i].Offset <= mensajes[i-1].Offset {
+			return fmt.Errorf("el offset %d sigue al %d", mensajes[i].Offset, mensajes[i-1].Offset)
+		}
+	}
+	return nil
+}
+
+func conformidadSinReutilizar(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer almacen.Borrar()
+	primero := &Mensaje{Cuerpo: "primero"}
+	if err := anadirTodos(almacen, []*Mensaje{primero}); err != nil {
+		return err
+	}
+	if err := almacen.Confirmar(primero.Offset); err != nil {
+		return fmt.Errorf("Confirmar: %w", err)
+	}
+	segundo := &Mensaje{Cuerpo: "segundo"}
+	if err := anadirTodos(almacen, []*Mensaje{segundo}); err != nil {
+		return err
+	}
+	if segundo.Offset <= primero.Offset {
+		return fmt.Errorf("se reutilizó el offset %d", segundo.Offset)
+	}
+	return nil
+}
+
+func conformidadOffsetConservado(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer almacen.Borrar()
+	// Un offset mayor que los anteriores se conserva; uno menor o ninguno se sustituye por el siguiente.
+	mensajes := []*Mensaje{{Offset: 10, Cuerpo: "diez"}, {Offset: 5, Cuerpo: "cinco"}, {Cuerpo: "sin offset"}}
+	if err := anadirTodos(almacen, mensajes); err != nil {
+		return err
+	}
+	for i, esperado := range []uint64{10, 11, 12} {
+		if mensajes[i].Offset != esperado {
+			return fmt.Errorf("el mensaje %q recibió el offset %d en lugar de %d", mensajes[i].Cuerpo, mensajes[i].Offset, esperado)
+		}
+	}
+	return nil
+}
+
+func conformidadCerrar(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer almacen.Borrar()
+	if err := anadirTodos(almacen, mensajesConformidad()); err != nil {
+		return err
+	}
+	if err := almacen.Cerrar(); err != nil {
+		return fmt.Errorf("Cerrar: %w", err)
+	}
+	if err := almacen.Cerrar(); err != nil {
+		return fmt.Errorf("segundo Cerrar: %w", err)
+	}
+	if err := almacen.Anadir(&Mensaje{Cuerpo: "tarde"}); err == nil {
+		return errors.New("Anadir tras Cerrar no devolvió ningún error")
+	}
+	return nil
+}
+
+func conformidadEsperaAlCerrar(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer almacen.Borrar()
+	m := &Mensaje{Cuerpo: "esperando"}
+	if err := almacen.Anadir(m); err != nil {
+		return fmt.Errorf("Anadir: %w", err)
+	}
+	esperado := make(chan error, 1)
+	go func() { esperado <- almacen.EsperarSincronizado(m.Offset) }()
+	if err := almacen.Cerrar(); err != nil {
+		return fmt.Errorf("Cerrar: %w", err)
+	}
+	select {
+	case <-esperado:
+		return nil
+	case <-time.After(5 * time.Second):
+		return errors.New("EsperarSincronizado sigue esperando tras Cerrar")
+	}
+}
+
+func conformidadRecuperar(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer func() { almacen.Borrar() }()
+	mensajes := mensajesConformidad()
+	if err := anadirTodos(almacen, mensajes); err != nil {
+		return err
+	}
+	// Se confirman el primero y el tercero; los demás deben recuperarse en orden.
+	var esperados []*Mensaje
+	for i, m := range mensajes {
+		if i == 0 || i == 2 {
+			if err := almacen.Confirmar(m.Offset); err != nil {
+				return fmt.Errorf("Confirmar: %w", err)
+			}
+			continue
+		}
+		esperados = append(esperados, m)
+	}
+	almacen, recuperados, err := p.reabrir(almacen)
+	if err != nil {
+		return err
+	}
+	if len(recuperados) != len(esperados) {
+		return fmt.Errorf("se recuperaron %d mensajes en lugar de %d", len(recuperados), len(esperados))
+	}
+	for i := range esperados {
+		if !mensajesIguales(&recuperados[i], esperados[i]) {
+			return fmt.Errorf("se recuperó %+v en lugar de %+v", recuperados[i], *esperados[i])
+		}
+	}
+	return nil
+}
+
+func conformidadSinReutilizarTrasReabrir(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer func() { almacen.Borrar() }()
+	// Se confirman suficientes mensajes como para que los almacenes compacten sus datos.
+	var ultimo uint64
+	for i := 0; i < 3000; i++ {
+		m := &Mensaje{Cuerpo: "confirmado"}
+		if err := almacen.Anadir(m); err != nil {
+			return fmt.Errorf("Anadir: %w", err)
+		}
+		if err := almacen.Confirmar(m.Offset); err != nil {
+			return fmt.Errorf("Confirmar: %w", err)
+		}
+		ultimo = m.Offset
+	}
+	almacen, recuperados, err := p.reabrir(almacen)
+	if err != nil {
+		return err
+	}
+	if len(recuperados) != 0 {
+		return fmt.Errorf("se recuperaron %d mensajes confirmados", len(recuperados))
+	}
+	m := &Mensaje{Cuerpo: "nuevo"}
+	if err := almacen.Anadir(m); err != nil {
+		return fmt.Errorf("Anadir: %w", err)
+	}
+	if m.Offset <= ultimo {
+		return fmt.Errorf("tras reabrir se asignó el offset %d, que no es mayor que %d", m.Offset, ultimo)
+	}
+	return nil
+}
+
+func conformidadHuecos(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer func() { almacen.Borrar() }()
+	publicado := time.Unix(1700000000, 0)
+	primero := &Mensaje{Offset: 5, Publicado: publicado, Cuerpo: "cinco"}
+	segundo := &Mensaje{Offset: 20, Publicado: publicado, Cuerpo: "veinte"}
+	if err := anadirTodos(almacen, []*Mensaje{primero, segundo}); err != nil {
+		return err
+	}
+	if err := almacen.Confirmar(primero.Offset); err != nil {
+		return fmt.Errorf("Confirmar: %w", err)
+	}
+	almacen, recuperados, err := p.reabrir(almacen)
+	if err != nil {
+		return err
+	}
+	if len(recuperados) != 1 || !mensajesIguales(&recuperados[0], segundo) {
+		return fmt.Errorf("se recuperó %+v en lugar del mensaje con el offset 20", recuperados)
+	}
+	if err := almacen.Confirmar(segundo.Offset); err != nil {
+		return fmt.Errorf("Confirmar: %w", err)
+	}
+	// El registro debe avanzar el offset consumido sobre los offsets que no tienen mensaje.
+	if registro, ok := almacen.(*Registro); ok {
+		if err := registro.compactar(); err != nil {
+			return fmt.Errorf("compactar: %w", err)
+		}
+		if registro.consumido != segundo.Offset+1 {
+			return fmt.Errorf("el offset consumido es %d en lugar de %d", registro.consumido, segundo.Offset+1)
+		}
+	}
+	almacen, recuperados, err = p.reabrir(almacen)
+	if err != nil {
+		return err
+	}
+	if len(recuperados) != 0 {
+		return fmt.Errorf("se recuperaron %d mensajes confirmados", len(recuperados))
+	}
+	m := &Mensaje{Cuerpo: "nuevo"}
+	if err := almacen.Anadir(m); err != nil {
+		return fmt.Errorf("Anadir: %w", err)
+	}
+	if m.Offset <= segundo.Offset {
+		return fmt.Errorf("tras reabrir se asignó el offset %d, que no es mayor que %d", m.Offset, segundo.Offset)
+	}
+	return nil
+}
+
+func conformidadEscrituraInterrumpida(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer func() { almacen.Borrar() }()
+	mensajes := mensajesConformidad()
+	if err := anadirTodos(almacen, mensajes); err != nil {
+		return err
+	}
+	if err := almacen.Cerrar(); err != nil {
+		return fmt.Errorf("Cerrar: %w", err)
+	}
+	// Se añade la mitad de una escritura al archivo en que se escribió el último mensaje.
+	ruta, fragmento, err := escrituraAMedias(p.tipo, p.dir)
+	if err != nil {
+		return err
+	}
+	archivo, err := os.OpenFile(ruta, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = archivo.Write(fragmento)
+	archivo.Close()
+	if err != nil {
+		return err
+	}
+	almacen, recuperados, err := p.abrir()
+	if err != nil {
+		return fmt.Errorf("no se pudo reabrir: %w", err)
+	}
+	if len(recuperados) != len(mensajes) {
+		return fmt.Errorf("se recuperaron %d mensajes en lugar de %d", len(recuperados), len(mensajes))
+	}
+	m := &Mensaje{Publicado: time.Now(), Cuerpo: "tras truncar"}
+	if err := anadirTodos(almacen, []*Mensaje{m}); err != nil {
+		return err
+	}
+	almacen, recuperados, err = p.reabrir(almacen)
+	if err != nil {
+		return err
+	}
+	if len(recuperados) != len(mensajes)+1 || !mensajesIguales(&recuperados[len(mensajes)], m) {
+		return errors.New("el mensaje añadido tras truncar no se recuperó")
+	}
+	return nil
+}
+
+// escrituraAMedias devuelve el archivo en que escribe un almacén y la primera mitad de una escritura
+// en su formato, para simular una escritura interrumpida.
+func escrituraAMedias(tipo, dir string) (string, []byte, error) {
+	m := &Mensaje{Offset: 1 << 40, Cuerpo: "interrumpido"}
+	switch tipo {
+	case almacenRegistro:
+		segmentos, err := filepath.Glob(filepath.Join(dir, "*"+extensionSegmento))
+		if err != nil || len(segmentos) == 0 {
+			return "", nil, fmt.Errorf("no se encontraron segmentos en %s", dir)
+		}
+		sort.Strings(segmentos)
+		entrada := codificarEntrada(m, codificacion{})
+		return segmentos[len(segmentos)-1], entrada[:len(entrada)/2], nil
+	case almacenKV:
+		op := codificarOperacionKV(kvPoner, []byte("clave"), codificarEntrada(m, codificacion{}))
+		return filepath.Join(dir, archivoKV), op[:len(op)/2], nil
+	}
+	return "", nil, fmt.Errorf("el almacén %s no tiene archivos", tipo)
+}
+
+func conformidadLongitudDanada(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer func() { almacen.Borrar() }()
+	if err := anadirTodos(almacen, mensajesConformidad()); err != nil {
+		return err
+	}
+	if err := almacen.Cerrar(); err != nil {
+		return fmt.Errorf("Cerrar: %w", err)
+	}
+	// La longitud del primer registro del archivo pasa a llegar más allá de su final.
+	ruta, posLongitud, err := primeraLongitud(p.tipo, p.dir)
+	if err != nil {
+		return err
+	}
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(datos[posLongitud:], uint32(len(datos)))
+	if err := os.WriteFile(ruta, datos, 0644); err != nil {
+		return err
+	}
+	if danado, _, err := p.abrir(); err == nil {
+		danado.Cerrar()
+		return errors.New("se abrió el almacén con un registro dañado en mitad del archivo")
+	}
+	tras, err := os.ReadFile(ruta)
+	if err != nil {
+		return err
+	}
+	if len(tras) != len(datos) {
+		return fmt.Errorf("el archivo pasó de %d a %d bytes al abrirlo", len(datos), len(tras))
+	}
+	return nil
+}
+
+// primeraLongitud devuelve el archivo en que un almacén escribió sus primeros mensajes y la posición
+// en él del campo de longitud de su primer registro.
+func primeraLongitud(tipo, dir string) (string, int, error) {
+	switch tipo {
+	case almacenRegistro:
+		segmentos, err := filepath.Glob(filepath.Join(dir, "*"+extensionSegmento))
+		if err != nil || len(segmentos) == 0 {
+			return "", 0, fmt.Errorf("no se encontraron segmentos en %s", dir)
+		}
+		sort.Strings(segmentos)
+		return segmentos[0], 2, nil
+	case almacenKV:
+		return filepath.Join(dir, archivoKV), 5, nil
+	}
+	return "", 0, fmt.Errorf("el almacén %s no tiene archivos", tipo)
+}
+
+func conformidadBorrar(p *pruebaAlmacen) error {
+	almacen, _, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	if err := anadirTodos(almacen, mensajesConformidad()); err != nil {
+		almacen.Borrar()
+		return err
+	}
+	if err := almacen.Borrar(); err != nil {
+		return fmt.Errorf("Borrar: %w", err)
+	}
+	almacen, recuperados, err := p.abrir()
+	if err != nil {
+		return err
+	}
+	defer almacen.Borrar()
+	if len(recuperados) != 0 {
+		return fmt.Errorf("se recuperaron %d mensajes de un almacén borrado", len(recuperados))
+	}
+	return nil
+}
+
+func conformidadRotacion(p *pruebaAlmacen) error {
+	antigua, err := leerLlavero(claveConformidadAntigua)
+	if err != nil {
+		return err
+	}
+	rotada, err := leerLlavero(claveConformidadAntigua + "\n" + claveConformidadNueva)
+	if err != nil {
+		return err
+	}
+	prueba := *p
+	var almacen Almacen
+	defer func() {
+		if almacen != nil {
+			almacen.Borrar()
+		}
+	}()
+	// Se escribe un mensaje sin cifrar, otro con la clave antigua y otro con la nueva; tras cada cambio
+	// de claves deben recuperarse todos los anteriores.
+	var esperados []*Mensaje
+	for i, llavero := range []*Llavero{nil, antigua, rotada} {
+		prueba.cod.llavero = llavero
+		var recuperados []Mensaje
+		almacen, recuperados, err = prueba.abrir()
+		if err != nil {
+			return fmt.Errorf("no se pudo abrir con las claves %d: %w", i, err)
+		}
+		if len(recuperados) != len(esperados) {
+			return fmt.Errorf("con las claves %d se recuperaron %d mensajes en lugar de %d", i, len(recuperados), len(esperados))
+		}
+		for j := range esperados {
+			if !mensajesIguales(&recuperados[j], esperados[j]) {
+				return fmt.Errorf("con las claves %d se recuperó %+v en lugar de %+v", i, recuperados[j], *esperados[j])
+			}
+		}
+		m := &Mensaje{ID: fmt.Sprint(i), Publicado: time.Unix(1700000000, 0), Cuerpo: fmt.Sprint("escrito con las claves ", i)}
+		if err := anadirTodos(almacen, []*Mensaje{m}); err != nil {
+			return err
+		}
+		esperados = append(esperados, m)
+		if err := almacen.Cerrar(); err != nil {
+			return fmt.Errorf("Cerrar: %w", err)
+		}
+	}
+	// Sin la clave nueva el almacén no debe abrirse, ni perder la entrada que no puede descifrar.
+	prueba.cod.llavero = antigua
+	if sinClave, _, err := prueba.abrir(); err == nil {
+		sinClave.Cerrar()
+		return errors.New("se abrió sin la clave con que está cifrado el último mensaje")
+	} else if !errors.Is(err, errClave) {
+		return fmt.Errorf("error inesperado al abrir sin la clave nueva: %w", err)
+	}
+	prueba.cod.llavero = rotada
+	almacen, recuperados, err := prueba.abrir()
+	if err != nil {
+		return err
+	}
+	if len(recuperados) != len(esperados) {
+		return fmt.Errorf("tras abrir sin la clave nueva se recuperaron %d mensajes en lugar de %d", len(recuperados), len(esperados))
+	}
+	return nil
+}
+
+func conformidadCompresion(p *pruebaAlmacen) error {
+	prueba := *p
+	prueba.cod.contador = &contadorCompresion{}
+	almacen, _, err := prueba.abrir()
+	if err != nil {
+		return err
+	}
+	defer func() { almacen.Borrar() }()
+	mensajes := mensajesConformidad()
+	if err := anadirTodos(almacen, mensajes); err != nil {
+		return err
+	}
+	// Solo el mensaje que se comprime bien debe guardarse comprimido.
+	comprimidos := prueba.cod.contador.mensajes.Load()
+	if prueba.cod.compresion == "" && comprimidos != 0 || prueba.cod.compresion != "" && comprimidos != 1 {
+		return fmt.Errorf("se comprimieron %d mensajes con la compresión %q", comprimidos, prueba.cod.compresion)
+	}
+	if err := almacen.Cerrar(); err != nil {
+		return fmt.Errorf("Cerrar: %w", err)
+	}
+	prueba.cod.compresion = ""
+	almacen, recuperados, err := prueba.abrir()
+	if err != nil {
+		return err
+	}
+	if len(recuperados) != len(mensajes) {
+		return fmt.Errorf("se recuperaron %d mensajes en lugar de %d", len(recuperados), len(mensajes))
+	}
+	for i := range mensajes {
+		if !mensajesIguales(&recuperados[i], mensajes[i]) {
+			return fmt.Errorf("se recuperó el mensaje %q en lugar del %q", recuperados[i].ID, mensajes[i].ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formato de los archivos de exportación: JSON Lines, con un `Mensaje` por línea en el orden en que
+// se publicaron los mensajes. Por ejemplo:
+//
+//	{"Offset":3,"ID":"9f…","Publicado":"2024-05-01T10:00:00.5+02:00","TTL":0,"Cabeceras":{"tipo":"alta"},"Cuerpo":"hola"}
+//
+// TTL se expresa en nanosegundos. Al importar, el offset se ignora y los campos vacíos toman los valores
+// de una publicación normal: un ID nuevo, la hora actual y el TTL de la cola.
+
+// loteImportacion es el número de mensajes que `MOM importar` envía en cada llamada a `Importar`.
+const loteImportacion = 1000
+
+// ArgsExportar representa los argumentos para exportar los mensajes de una cola.
+type ArgsExportar struct {
+	Nombre string
+}
+
+// ReplyExportar contiene los mensajes exportados de una cola, en el orden en que se publicaron.
+type ReplyExportar struct {
+	Mensajes []Mensaje
+}
+
+// ArgsImportar representa los argumentos para importar mensajes en una cola.
+// Si ConservarIDs es verdadero, los mensajes conservan su ID; si no, o si no lo tienen, reciben uno nuevo.
+// Un mensaje cuyo ID conservado ya está en una cola duradera se rechaza, para no duplicar el mensaje.
+type ArgsImportar struct {
+	Nombre       string
+	Mensajes     []Mensaje
+	ConservarIDs bool
+}
+
+// Exportar es un método RPC que devuelve una copia de los mensajes de una cola sin consumirlos.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsExportar` con el nombre de la cola.
+// - reply: Un puntero a una estructura `ReplyExportar` donde se devuelven los mensajes.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la cola no existe.
+//
+// Comportamiento:
+// - Exporta los mensajes que esperan en la cola, incluido el rechazado que espera volver a entregarse, con sus cabeceras y metadatos. Los mensajes entregados que esperan confirmación no se exportan.
+// - Mientras dura la exportación las publicaciones en la cola esperan, de modo que los mensajes vuelven a la cola en el mismo orden.
+func (l *Broker) Exportar(args *ArgsExportar, reply *ReplyExportar) error {
+	cola, ok := l.cola(args.Nombre)
+	if !ok {
+		return fmt.Errorf("la cola %s no existe", args.Nombre)
+	}
+	cola.encolando.Lock()
+	defer cola.encolando.Unlock()
+	// Si ningún consumidor tiene el turno, se toma para que no lean de la cola mientras se vacía.
+	var turno *Mensaje
+	tomado := false
+	select {
+	case turno = <-cola.rechazado:
+		tomado = true
+	default:
+	}
+	var mensajes []*Mensaje
+	for n := len(cola.mensajes); n > 0; n-- {
+		select {
+		case m := <-cola.mensajes:
+			mensajes = append(mensajes, m)
+		default:
+			// Un consumidor se ha llevado el mensaje.
+		}
+	}
+	for _, m := range mensajes {
+		select {
+		case cola.mensajes <- m:
+		default:
+			// Los mensajes reencolados sin `encolando` han ocupado el hueco.
+			go func() { cola.mensajes <- m }()
+		}
+	}
+	if tomado {
+		cola.rechazado <- turno
+	}
+	if turno != nil {
+		mensajes = append([]*Mensaje{turno}, mensajes...)
+	}
+	reply.Mensajes = make([]Mensaje, 0, len(mensajes))
+	for _, m := range mensajes {
+		reply.Mensajes = append(reply.Mensajes, *m)
+	}
+	sort.SliceStable(reply.Mensajes, func(i, j int) bool { return reply.Mensajes[i].Offset < reply.Mensajes[j].Offset })
+	return nil
+}
+
+// Importar es un método RPC que publica en una cola mensajes exportados con `Exportar`.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsImportar` con el nombre de la cola, los mensajes y si se conservan sus IDs.
+// - reply: Un puntero a una estructura `ReplyLote` donde se devuelve el resultado de cada mensaje.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la llamada se ha procesado, o un error si la cola no existe; los fallos de cada mensaje se informan en `reply.Errores`.
+//
+// Comportamiento:
+// - Publica los mensajes en el orden recibido conservando sus cabeceras, su hora de publicación y su TTL. Los mensajes que ya han caducado no se importan.
+// - Si se conservan los IDs y la cola es duradera, rechaza los mensajes cuyo ID ya tiene algún mensaje sin confirmar de la cola, incluidos los importados antes en la misma llamada.
+// - Como `PublicarLote`, responde cuando todos los mensajes están sincronizados con el disco según la política de la cola.
+func (l *Broker) Importar(args *ArgsImportar, reply *ReplyLote) error {
+	if l.apagandose() {
+		return errApagando
+	}
+	cola, ok := l.cola(args.Nombre)
+	if !ok {
+		return fmt.Errorf("la cola %s no existe", args.Nombre)
+	}
+	reply.Errores = make([]string, len(args.Mensajes))
+	var indices []int
+	// ultimo es el offset del último mensaje importado y cluster el índice de su publicación en el clúster.
+	var ultimo, cluster uint64
+	// existentes contiene los IDs de la cola duradera con los que no se puede importar un mensaje.
+	existentes := make(map[string]struct{})
+	if args.ConservarIDs && cola.durability {
+		cola.mux.Lock()
+		for _, m := range cola.sinConfirmar {
+			existentes[m.ID] = struct{}{}
+		}
+		cola.mux.Unlock()
+	}
+	ahora := time.Now()
+	for i := range args.Mensajes {
+		mensaje := args.Mensajes[i]
+		mensaje.Offset = 0
+		if !args.ConservarIDs || mensaje.ID == "" {
+			mensaje.ID = nuevoIDMensaje()
+		}
+		if mensaje.Publicado.IsZero() {
+			mensaje.Publicado = ahora
+		}
+		switch {
+		case mensaje.TTL < 0:
+			reply.Errores[i] = fmt.Sprintf("TTL negativo: %v", mensaje.TTL)
+			continue
+		case mensaje.caducado(ahora):
+			reply.Errores[i] = "el mensaje ha caducado"
+			continue
+		}
+		if _, ok := existentes[mensaje.ID]; ok {
+			reply.Errores[i] = fmt.Sprintf("la cola ya tiene un mensaje con el ID %s", mensaje.ID)
+			continue
+		}
+		indice, err := l.anadirMensaje(cola, &mensaje, nil)
+		if err != nil {
+			reply.Errores[i] = err.Error()
+			continue
+		}
+		indices = append(indices, i)
+		ultimo, cluster = mensaje.Offset, indice
+		if args.ConservarIDs && cola.durability {
+			existentes[mensaje.ID] = struct{}{}
+		}
+	}
+	fmt.Println("Importados", len(indices), "mensajes en", args.Nombre)
+	if len(indices) > 0 {
+		if err := l.esperarSincronizado(cola, ultimo, cluster); err != nil {
+			for _, i := range indices {
+				reply.Errores[i] = err.Error()
+			}
+		}
+	}
+	return nil
+}
+
+// exportarCola exporta una cola a un archivo JSON Lines.
+//
+// Parámetros:
+// - exportar: La función con la que se llama a `Exportar`, en el propio broker o por RPC.
+// - nombre: El nombre de la cola.
+// - ruta: La ruta del archivo, que se sobrescribe si existe.
+//
+// Retorna:
+// - El número de mensajes exportados y un error si la exportación falla.
+func exportarCola(exportar func(*ArgsExportar, *ReplyExportar) error, nombre, ruta string) (int, error) {
+	var reply ReplyExportar
+	if err := exportar(&ArgsExportar{Nombre: nombre}, &reply); err != nil {
+		return 0, err
+	}
+	archivo, err := os.Create(ruta)
+	if err != nil {
+		return 0, err
+	}
+	salida := bufio.NewWriter(archivo)
+	codificador := json.NewEncoder(salida)
+	codificador.SetEscapeHTML(false)
+	for i := range reply.Mensajes {
+		if err := codificador.Encode(&reply.Mensajes[i]); err != nil {
+			archivo.Close()
+			return 0, err
+		}
+	}
+	if err := salida.Flush(); err != nil {
+		archivo.Close()
+		return 0, err
+	}
+	return len(reply.Mensajes), archivo.Close()
+}
+
+// importarCola importa en una cola los mensajes de un archivo JSON Lines, en lotes de `loteImportacion` mensajes.
+//
+// Parámetros:
+// - importar: La función con la que se llama a `Importar`, en el propio broker o por RPC.
+// - nombre: El nombre de la cola, que debe existir.
+// - ruta: La ruta del archivo.
+// - conservarIDs: Si los mensajes conservan el ID que tienen en el archivo.
+//
+// Retorna:
+// - El número de mensajes importados y de mensajes rechazados, y un error si el archivo no es válido o la importación no puede continuar.
+//
+// Comportamiento:
+// - Muestra el motivo de cada mensaje rechazado junto a su línea del archivo.
+func importarCola(importar func(*ArgsImportar, *ReplyLote) error, nombre, ruta string, conservarIDs bool) (int, int, error) {
+	archivo, err := os.Open(ruta)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer archivo.Close()
+	decodificador := json.NewDecoder(bufio.NewReader(archivo))
+	importados, rechazados, linea := 0, 0, 0
+	for {
+		lote := make([]Mensaje, 0, loteImportacion)
+		for len(lote) < loteImportacion {
+			var m Mensaje
+			err := decodificador.Decode(&m)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return importados, rechazados, fmt.Errorf("mensaje %d del archivo no válido: %w", linea+len(lote)+1, err)
+			}
+			lote = append(lote, m)
+		}
+		if len(lote) == 0 {
+			return importados, rechazados, nil
+		}
+		var reply ReplyLote
+		if err := importar(&ArgsImportar{Nombre: nombre, Mensajes: lote, ConservarIDs: conservarIDs}, &reply); err != nil {
+			return importados, rechazados, err
+		}
+		for i, fallo := range reply.Errores {
+			if fallo != "" {
+				fmt.Println("Mensaje", linea+i+1, "no importado:", fallo)
+				rechazados++
+			} else {
+				importados++
+			}
+		}
+		linea += len(lote)
+	}
+}
+
+// ejecutarExportacion ejecuta los subcomandos `exportar` e `importar`, que exportan o importan los
+// mensajes de una cola de un broker en ejecución.
+//
+// Parámetros:
+// - args: Los argumentos del subcomando, empezando por su nombre.
+//
+// Retorna:
+// - true si la operación se completó sin errores.
+func ejecutarExportacion(args []string) bool {
+	opciones := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	ids := opciones.String("ids", "regenerar", "al importar, regenerar o conservar los IDs de los mensajes")
+	if err := opciones.Parse(args[1:]); err != nil {
+		return false
+	}
+	if opciones.NArg() != 3 || (*ids != "conservar" && *ids != "regenerar") {
+		fmt.Println("Uso:")
+		fmt.Println("  go run MOM exportar direccionIP:puerto cola archivo.jsonl")
+		fmt.Println("  go run MOM importar [-ids regenerar|conservar] direccionIP:puerto cola archivo.jsonl")
+		return false
+	}
+	direccion, nombre, ruta := opciones.Arg(0), opciones.Arg(1), opciones.Arg(2)
+	broker, err := rpc.Dial("tcp", direccion)
+	if err != nil {
+		fmt.Println("Error al conectar con el broker:", err)
+		return false
+	}
+	defer broker.Close()
+	if args[0] == "exportar" {
+		n, err := exportarCola(func(a *ArgsExportar, r *ReplyExportar) error {
+			return broker.Call("Broker.Exportar", a, r)
+		}, nombre, ruta)
+		if err != nil {
+			fmt.Println("Error al exportar la cola:", err)
+			return false
+		}
+		fmt.Println("Exportados", n, "mensajes de", nombre, "a", ruta)
+		return true
+	}
+	importados, rechazados, err := importarCola(func(a *ArgsImportar, r *ReplyLote) error {
+		return broker.Call("Broker.Importar", a, r)
+	}, nombre, ruta, *ids == "conservar")
+	fmt.Println("Importados", importados, "mensajes en", nombre+";", rechazados, "rechazados")
+	if err != nil {
+		fmt.Println("Error al importar la cola:", err)
+		return false
+	}
+	return rechazados == 0
+}
+
+// exportacionInteractiva pide por la entrada estándar la cola y el archivo de una exportación o una
+// importación y la realiza en el propio broker.
+//
+// Parámetros:
+// - reader: La entrada estándar.
+// - importar: Si se importa en lugar de exportar; en ese caso también se pregunta si se conservan los IDs.
+func (l *Broker) exportacionInteractiva(reader *bufio.Reader, importar bool) {
+	preguntas := []string{"Ingresa el nombre de la cola: ", "Ingresa la ruta del archivo: "}
+	if importar {
+		preguntas = append(preguntas, "¿Conservar los IDs de los mensajes? (s/n): ")
+	}
+	respuestas := make([]string, len(preguntas))
+	for i, pregunta := range preguntas {
+		fmt.Println(pregunta)
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Println("Error al leer la entrada:", err)
+			return
+		}
+		respuestas[i] = strings.TrimSpace(input)
+	}
+	nombre, ruta := respuestas[0], respuestas[1]
+	if !importar {
+		n, err := exportarCola(l.Exportar, nombre, ruta)
+		if err != nil {
+			fmt.Println("Error al exportar la cola:", err)
+			return
+		}
+		fmt.Println("Exportados", n, "mensajes de", nombre, "a", ruta)
+		return
+	}
+	importados, rechazados, err := importarCola(l.Importar, nombre, ruta, strings.HasPrefix(strings.ToLower(respuestas[2]), "s"))
+	fmt.Println("Importados", importados, "mensajes en", nombre+";", rechazados, "rechazados")
+	if err != nil {
+		fmt.Println("Error al importar la cola:", err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// Formato de las entradas de los segmentos del registro.
+//
+// Cada entrada tiene una cabecera de `cabeceraEntrada` bytes seguida del cuerpo:
+//
+//	magia (1 byte) | versión (1 byte) | longitud del cuerpo (4 bytes) | CRC-32C del cuerpo (4 bytes)
+//
+// El cuerpo contiene, en este orden y con enteros big-endian:
+//
+//	offset (8) | longitud del ID (2) | ID | publicación en ns Unix (8) | TTL en ns (8) |
+//	número de cabeceras (2) | por cada cabecera: longitud de la clave (2) | clave | longitud del valor (4) | valor |
+//	contenido del mensaje (el resto del cuerpo)
+//
+// La longitud permite leer mensajes con cualquier contenido, incluidos saltos de línea, y el CRC
+// detecta las entradas que quedaron a medias por una escritura interrumpida.
+//
+// En las entradas de la versión `versionEntradaCifrada` el cuerpo está cifrado (ver `Llavero`) y el
+// CRC se calcula sobre el cuerpo cifrado, de modo que la integridad se comprueba sin las claves.
+//
+// En las de la versión `versionEntradaComprimida` el cuerpo es un byte de indicadores seguido del cuerpo
+// comprimido con el algoritmo de `codigosCompresion` que indican sus 7 bits bajos y, si está activo
+// `indicadorCifrado`, cifrado después como el de las entradas cifradas.
+const (
+	magiaEntrada             = 0xB7
+	versionEntrada           = 1
+	versionEntradaCifrada    = 2
+	versionEntradaComprimida = 3
+	indicadorCifrado         = 0x80
+	cabeceraEntrada          = 10
+	// maxCuerpoEntrada es la mayor longitud de cuerpo que se acepta al leer; una longitud mayor
+	// solo puede deberse a una cabecera dañada.
+	maxCuerpoEntrada = 1 << 28
+)
+
+// tablaCRC es la tabla del polinomio de Castagnoli con la que se calcula el CRC de las entradas.
+var tablaCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// Errores al decodificar una entrada. errEntradaIncompleta indica que los datos terminan antes que la
+// entrada; errEntradaCorrupta, que la entrada está completa pero su contenido no es válido.
+var (
+	errEntradaIncompleta = io.ErrUnexpectedEOF
+	errEntradaCorrupta   = errors.New("entrada corrupta")
+)
+
+// codigosCompresion son los códigos con que se indica en las entradas comprimidas el algoritmo de compresión.
+var codigosCompresion = map[string]byte{compresionGzip: 1, compresionZlib: 2}
+
+// codificacion indica cómo se guardan las entradas de un almacén.
+type codificacion struct {
+	// llavero contiene las claves con que se cifran las entradas nuevas y se descifran las existentes;
+	// es nil si no se cifran.
+	llavero *Llavero
+	// compresion es el algoritmo con que se comprimen las entradas nuevas; vacío si no se comprimen.
+	compresion string
+	// contador acumula lo que ahorra la compresión; puede ser nil.
+	contador *contadorCompresion
+}
+
+// codificarEntrada devuelve la representación de un mensaje dentro de un segmento.
+//
+// Comportamiento:
+// - Si la codificación tiene compresión, comprime el cuerpo de la entrada cuando `comprimir` lo considera útil.
+// - Si tiene llavero, cifra el cuerpo, comprimido o no, con su clave activa.
+func codificarEntrada(m *Mensaje, cod codificacion) []byte {
+	cuerpo := codificarCuerpo(m)
+	version := byte(versionEntrada)
+	if comprimido, ok := comprimir(cod.compresion, cuerpo); ok {
+		cod.contador.anotar(len(cuerpo), len(comprimido))
+		indicadores := codigosCompresion[cod.compresion]
+		if cod.llavero != nil {
+			comprimido = cod.llavero.cifrar(comprimido)
+			indicadores |= indicadorCifrado
+		}
+		cuerpo = append([]byte{indicadores}, comprimido...)
+		version = versionEntradaComprimida
+	} else if cod.llavero != nil {
+		cuerpo = cod.llavero.cifrar(cuerpo)
+		version = versionEntradaCifrada
+	}
+	entrada := make([]byte, cabeceraEntrada, cabeceraEntrada+len(cuerpo))
+	entrada[0] = magiaEntrada
+	entrada[1] = version
+	binary.BigEndian.PutUint32(entrada[2:], uint32(len(cuerpo)))
+	binary.BigEndian.PutUint32(entrada[6:], crc32.Checksum(cuerpo, tablaCRC))
+	return append(entrada, cuerpo...)
+}
+
+// codificarCuerpo devuelve los campos de un mensaje en el formato del cuerpo de las entradas.
+func codificarCuerpo(m *Mensaje) []byte {
+	claves := make([]string, 0, len(m.Cabeceras))
+	for clave := range m.Cabeceras {
+		claves = append(claves, clave)
+	}
+	sort.Strings(claves)
+	entrada := make([]byte, 0, 28+len(m.ID)+len(m.Cuerpo))
+	entrada = binary.BigEndian.AppendUint64(entrada, m.Offset)
+	entrada = binary.BigEndian.AppendUint16(entrada, uint16(len(m.ID)))
+	entrada = append(entrada, m.ID...)
+	entrada = binary.BigEndian.AppendUint64(entrada, uint64(m.Publicado.UnixNano()))
+	entrada = binary.BigEndian.AppendUint64(entrada, uint64(m.TTL))
+	entrada = binary.BigEndian.AppendUint16(entrada, uint16(len(claves)))
+	for _, clave := range claves {
+		entrada = binary.BigEndian.AppendUint16(entrada, uint16(len(clave)))
+		entrada = append(entrada, clave...)
+		entrada = binary.BigEndian.AppendUint32(entrada, uint32(len(m.Cabeceras[clave])))
+		entrada = append(entrada, m.Cabeceras[clave]...)
+	}
+	return append(entrada, m.Cuerpo...)
+}
+
+// validarMensaje comprueba que un mensaje cabe en el formato de las entradas.
+func validarMensaje(m *Mensaje) error {
+	if len(m.ID) > math.MaxUint16 {
+		return fmt.Errorf("el ID del mensaje es demasiado largo")
+	}
+	if len(m.Cabeceras) > math.MaxUint16 {
+		return fmt.Errorf("el mensaje tiene demasiadas cabeceras")
+	}
+	tam := 28 + len(m.ID) + len(m.Cuerpo)
+	for clave, valor := range m.Cabeceras {
+		if len(clave) > math.MaxUint16 {
+			return fmt.Errorf("la clave de cabecera %.20q... es demasiado larga", clave)
+		}
+		tam += 6 + len(clave) + len(valor)
+	}
+	// Se reserva sitio para el cifrado, de modo que el mensaje quepa también en una entrada cifrada; una
+	// entrada comprimida solo se usa si ocupa menos.
+	if tam > maxCuerpoEntrada-sobrecargaCifrado {
+		return fmt.Errorf("el mensaje ocupa %d bytes, más que el máximo de %d", tam, maxCuerpoEntrada-sobrecargaCifrado)
+	}
+	return nil
+}
+
+// decodificarEntrada lee la entrada que empieza al principio de datos.
+//
+// Parámetros:
+// - datos: Los datos que contienen la entrada.
+// - llavero: Las claves con que se descifran las entradas cifradas; puede ser nil si no hay ninguna.
+//
+// Retorna:
+// - El mensaje leído y el número de bytes que ocupa la entrada.
+// - `errEntradaIncompleta` si los datos terminan antes que la entrada, un error que envuelve `errEntradaCorrupta` si la entrada no es válida o uno que envuelve `errClave` si no se puede descifrar.
+func decodificarEntrada(datos []byte, llavero *Llavero) (Mensaje, int, error) {
+	version, cuerpo, n, err := leerMarco(datos)
+	if err != nil {
+		return Mensaje{}, 0, err
+	}
+	if cuerpo, err = abrirCuerpo(version, cuerpo, llavero); err != nil {
+		return Mensaje{}, 0, err
+	}
+	m, err := decodificarCuerpo(cuerpo)
+	if err != nil {
+		return Mensaje{}, 0, err
+	}
+	return m, n, nil
+}
+
+// leerMarco comprueba la cabecera y el CRC de la entrada que empieza al principio de datos, sin
+// descifrar ni interpretar su cuerpo.
+//
+// Retorna:
+// - La versión de la entrada, su cuerpo y el número de bytes que ocupa.
+// - Los mismos errores que `decodificarEntrada` para una entrada incompleta o no válida.
+func leerMarco(datos []byte) (byte, []byte, int, error) {
+	if len(datos) < cabeceraEntrada {
+		return 0, nil, 0, errEntradaIncompleta
+	}
+	if datos[0] != magiaEntrada {
+		return 0, nil, 0, fmt.Errorf("%w: marca de entrada no válida", errEntradaCorrupta)
+	}
+	if !versionConocida(datos[1]) {
+		return 0, nil, 0, fmt.Errorf("%w: versión de formato %d no soportada", errEntradaCorrupta, datos[1])
+	}
+	longitud := int(binary.BigEndian.Uint32(datos[2:]))
+	if longitud > maxCuerpoEntrada {
+		return 0, nil, 0, fmt.Errorf("%w: longitud %d no válida", errEntradaCorrupta, longitud)
+	}
+	if len(datos)-cabeceraEntrada < longitud {
+		return 0, nil, 0, errEntradaIncompleta
+	}
+	cuerpo := datos[cabeceraEntrada : cabeceraEntrada+longitud]
+	if crc32.Checksum(cuerpo, tablaCRC) != binary.BigEndian.Uint32(datos[6:]) {
+		return 0, nil, 0, fmt.Errorf("%w: el CRC no coincide", errEntradaCorrupta)
+	}
+	return datos[1], cuerpo, cabeceraEntrada + longitud, nil
+}
+
+// versionConocida indica si la versión especificada es una de las del formato de las entradas.
+func versionConocida(version byte) bool {
+	return version == versionEntrada || version == versionEntradaCifrada || version == versionEntradaComprimida
+}
+
+// parteCifrada devuelve la parte cifrada del cuerpo de una entrada.
+//
+// Retorna:
+// - La parte cifrada y verdadero, o falso si la entrada no está cifrada.
+func parteCifrada(version byte, cuerpo []byte) ([]byte, bool) {
+	switch {
+	case version == versionEntradaCifrada:
+		return cuerpo, true
+	case version == versionEntradaComprimida && len(cuerpo) > 0 && cuerpo[0]&indicadorCifrado != 0:
+		return cuerpo[1:], true
+	}
+	return nil, false
+}
+
+// abrirCuerpo descifra y descomprime el cuerpo de una entrada de la versión especificada.
+//
+// Retorna:
+// - El cuerpo con el formato de la versión `versionEntrada`, o los mismos errores que `decodificarEntrada`.
+func abrirCuerpo(version byte, cuerpo []byte, llavero *Llavero) ([]byte, error) {
+	switch version {
+	case versionEntradaCifrada:
+		return llavero.descifrar(cuerpo)
+	case versionEntradaComprimida:
+		if len(cuerpo) == 0 {
+			return nil, fmt.Errorf("%w: faltan los indicadores de la entrada", errEntradaCorrupta)
+		}
+		algoritmo := ""
+		for nombre, codigo := range codigosCompresion {
+			if codigo == cuerpo[0]&^indicadorCifrado {
+				algoritmo = nombre
+			}
+		}
+		if algoritmo == "" {
+			return nil, fmt.Errorf("%w: código de compresión %d desconocido", errEntradaCorrupta, cuerpo[0]&^indicadorCifrado)
+		}
+		comprimido := cuerpo[1:]
+		if cifrado, ok := parteCifrada(version, cuerpo); ok {
+			var err error
+			if comprimido, err = llavero.descifrar(cifrado); err != nil {
+				return nil, err
+			}
+		}
+		descomprimido, err := descomprimir(algoritmo, comprimido, maxCuerpoEntrada)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errEntradaCorrupta, err)
+		}
+		return descomprimido, nil
+	}
+	return cuerpo, nil
+}
+
+// decodificarCuerpo lee los campos del cuerpo de una entrada cuyo CRC ya se ha comprobado.
+func decodificarCuerpo(cuerpo []byte) (Mensaje, error) {
+	l := lector{datos: cuerpo}
+	var m Mensaje
+	m.Offset = l.uint64()
+	m.ID = string(l.bytes(int(l.uint16())))
+	m.Publicado = time.Unix(0, int64(l.uint64()))
+	m.TTL = time.Duration(l.uint64())
+	if n := int(l.uint16()); n > 0 {
+		m.Cabeceras = make(map[string]string, n)
+		for i := 0; i < n && l.err == nil; i++ {
+			clave := string(l.bytes(int(l.uint16())))
+			m.Cabeceras[clave] = string(l.bytes(int(l.uint32())))
+		}
+	}
+	if l.err != nil {
+		return Mensaje{}, fmt.Errorf("%w: cuerpo mal formado", errEntradaCorrupta)
+	}
+	m.Cuerpo = string(l.datos)
+	return m, nil
+}
+
+// lector lee campos sucesivos de un cuerpo de entrada. Si los datos se acaban, guarda el error en
+// `err` y las lecturas siguientes devuelven valores vacíos.
+type lector struct {
+	datos []byte
+	err   error
+}
+
+func (l *lector) bytes(n int) []byte {
+	if l.err != nil || n > len(l.datos) {
+		l.err = errEntradaIncompleta
+		return nil
+	}
+	b := l.datos[:n]
+	l.datos = l.datos[n:]
+	return b
+}
+
+func (l *lector) uint16() uint16 {
+	if b := l.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (l *lector) uint32() uint32 {
+	if b := l.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (l *lector) uint64() uint64 {
+	if b := l.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Modos de reparación de `MOM fsck`.
+//
+// - repararTruncar: trunca cada archivo dañado tras su último registro válido anterior al primer problema. Si detrás del problema hay registros válidos, no trunca el archivo, para no perderlos.
+// - repararCuarentena: saca los registros no válidos a `<archivo>.cuarentena` y conserva todos los válidos.
+const (
+	repararTruncar    = "truncar"
+	repararCuarentena = "cuarentena"
+)
+
+// extensionCuarentena es la extensión del archivo al que se mueven los registros no válidos de un archivo.
+const extensionCuarentena = ".cuarentena"
+
+// problemaArchivo es una zona no válida de un archivo del almacenamiento duradero.
+type problemaArchivo struct {
+	pos      int
+	longitud int
+	err      error
+	// interrumpida indica que es el final de una escritura interrumpida, que el broker trunca al abrir el archivo.
+	interrumpida bool
+}
+
+// revisarRegistros recorre los registros de un archivo y devuelve el número de registros válidos y
+// las zonas no válidas.
+//
+// Parámetros:
+// - datos: El contenido del archivo.
+// - magia: El primer byte de todo registro, con el que se busca el siguiente registro válido tras uno dañado.
+// - decodificar: Devuelve la longitud del registro que empieza al principio de los datos, o un error si no es válido.
+// - interrumpida: Indica si un error se debe a una escritura interrumpida al final del archivo; si es nil, ningún error se considera así.
+// - anotar: Si no es nil, se llama con cada registro válido.
+//
+// Comportamiento:
+// - Tras un registro no válido, busca el siguiente byte `magia` a partir del cual se decodifica un registro válido y sigue desde él; todo lo anterior forma parte de la zona no válida.
+func revisarRegistros(datos []byte, magia byte, decodificar func([]byte) (int, error), interrumpida func([]byte, error) bool, anotar func([]byte)) (int, []problemaArchivo) {
+	validos := 0
+	var problemas []problemaArchivo
+	pos := 0
+	for pos < len(datos) {
+		n, err := decodificar(datos[pos:])
+		if err == nil {
+			if anotar != nil {
+				anotar(datos[pos : pos+n])
+			}
+			validos++
+			pos += n
+			continue
+		}
+		if interrumpida != nil && interrumpida(datos[pos:], err) {
+			problemas = append(problemas, problemaArchivo{pos: pos, longitud: len(datos) - pos, err: err, interrumpida: true})
+			break
+		}
+		siguiente := len(datos)
+		for p := pos + 1; p < len(datos); p++ {
+			if datos[p] != magia {
+				continue
+			}
+			if _, err := decodificar(datos[p:]); err == nil {
+				siguiente = p
+				break
+			}
+		}
+		problemas = append(problemas, problemaArchivo{pos: pos, longitud: siguiente - pos, err: err})
+		pos = siguiente
+	}
+	return validos, problemas
+}
+
+// repararArchivo repara un archivo con los problemas especificados según el modo de reparación.
+//
+// Retorna:
+// - Un error si no se pudo escribir el archivo reparado o su cuarentena.
+//
+// Comportamiento:
+// - Con `repararTruncar`, trunca el archivo en el primer problema si llega hasta el final del archivo; si no, no lo repara.
+// - Con `repararCuarentena`, añade las zonas no válidas a `<ruta>.cuarentena` y reescribe el archivo de forma atómica sin ellas.
+func repararArchivo(ruta string, datos []byte, problemas []problemaArchivo, modo string) error {
+	if modo == repararTruncar {
+		if problemas[0].pos+problemas[0].longitud < len(datos) {
+			return fmt.Errorf("hay registros válidos tras la posición %d; use -reparar %s para conservarlos", problemas[0].pos, repararCuarentena)
+		}
+		if err := os.Truncate(ruta, int64(problemas[0].pos)); err != nil {
+			return err
+		}
+		fmt.Println("  reparado: truncado en la posición", problemas[0].pos)
+		return nil
+	}
+	cuarentena, err := os.OpenFile(ruta+extensionCuarentena, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	validos := make([]byte, 0, len(datos))
+	pos := 0
+	for _, problema := range problemas {
+		validos = append(validos, datos[pos:problema.pos]...)
+		if _, err := cuarentena.Write(datos[problema.pos : problema.pos+problema.longitud]); err != nil {
+			cuarentena.Close()
+			return err
+		}
+		pos = problema.pos + problema.longitud
+	}
+	validos = append(validos, datos[pos:]...)
+	// La cuarentena debe estar en el disco antes de quitar los registros del archivo.
+	if err := cuarentena.Sync(); err != nil {
+		cuarentena.Close()
+		return err
+	}
+	if err := cuarentena.Close(); err != nil {
+		return err
+	}
+	if err := escribirAtomico(ruta, validos); err != nil {
+		return err
+	}
+	fmt.Println("  reparado:", len(datos)-len(validos), "bytes movidos a", ruta+extensionCuarentena)
+	return nil
+}
+
+// revisarArchivo revisa un archivo de registros con `revisarRegistros`, muestra sus problemas y, si se
+// indica un modo de reparación, lo repara.
+//
+// Retorna:
+// - El número de problemas que quedan sin reparar en el archivo.
+func revisarArchivo(ruta string, magia byte, decodificar func([]byte) (int, error), interrumpida func([]byte, error) bool, anotar func([]byte), reparar string) int {
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		fmt.Println(ruta+":", err)
+		return 1
+	}
+	validos, problemas := revisarRegistros(datos, magia, decodificar, interrumpida, anotar)
+	if len(problemas) == 0 {
+		fmt.Println(ruta+":", validos, "registros, correcto")
+		return 0
+	}
+	fmt.Println(ruta+":", validos, "registros válidos,", len(problemas), "problemas")
+	for _, problema := range problemas {
+		tipo := "registro corrupto"
+		if problema.interrumpida {
+			tipo = "escritura interrumpida, se trunca al abrir la cola"
+		}
+		fmt.Printf("  posición %d (%d bytes): %s: %v\n", problema.pos, problema.longitud, tipo, problema.err)
+	}
+	if reparar == "" {
+		return len(problemas)
+	}
+	if err := repararArchivo(ruta, datos, problemas, reparar); err != nil {
+		fmt.Println("  error al reparar:", err)
+		return len(problemas)
+	}
+	return 0
+}
+
+// comprobarEntrada comprueba sin descifrarla la entrada que empieza al principio de datos: su cabecera,
+// su CRC y, si no está cifrada, los campos de su cuerpo, descomprimiéndolo si está comprimida.
+//
+// Retorna:
+// - El número de bytes que ocupa la entrada, o un error si no es válida.
+func comprobarEntrada(datos []byte) (int, error) {
+	version, cuerpo, n, err := leerMarco(datos)
+	if err != nil {
+		return 0, err
+	}
+	if _, cifrada := parteCifrada(version, cuerpo); !cifrada {
+		if cuerpo, err = abrirCuerpo(version, cuerpo, nil); err != nil {
+			return 0, err
+		}
+		if _, err := decodificarCuerpo(cuerpo); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// usoClaves cuenta con qué clave está cifrada cada entrada válida de un archivo y, si se dispone de
+// las claves, cuántas están cifradas con una clave que no está en el archivo de claves y cuántas no se
+// pueden descifrar con la suya. Las entradas que no se pueden descifrar no se consideran dañadas, porque
+// pueden deberse a un archivo de claves equivocado, y nunca se reparan.
+type usoClaves struct {
+	llavero   *Llavero
+	sinCifrar int
+	porClave  map[string]int
+	// sinClave cuenta las entradas de cada clave que no está en el archivo de claves.
+	sinClave map[string]int
+	fallos   int
+	error    error
+}
+
+// anotar cuenta una entrada válida.
+func (u *usoClaves) anotar(entrada []byte) {
+	version, cuerpo, _, err := leerMarco(entrada)
+	if err != nil {
+		return
+	}
+	cifrado, ok := parteCifrada(version, cuerpo)
+	if !ok {
+		u.sinCifrar++
+		return
+	}
+	id, _, err := claveCifrado(cifrado)
+	if err != nil {
+		return
+	}
+	if u.porClave == nil {
+		u.porClave = make(map[string]int)
+	}
+	u.porClave[id]++
+	if u.llavero == nil {
+		return
+	}
+	if _, ok := u.llavero.claves[id]; !ok {
+		if u.sinClave == nil {
+			u.sinClave = make(map[string]int)
+		}
+		u.sinClave[id]++
+		return
+	}
+	if _, _, err := decodificarEntrada(entrada, u.llavero); err != nil {
+		u.fallos++
+		u.error = err
+	}
+}
+
+// mostrar muestra el uso de las claves si hay entradas cifradas.
+//
+// Retorna:
+// - 1 si alguna entrada no se puede descifrar con su clave, o 0 si no.
+// - El número de entradas cifradas con claves que no están en el archivo de claves.
+func (u *usoClaves) mostrar() (int, int) {
+	if len(u.porClave) == 0 {
+		return 0, 0
+	}
+	ids := make([]string, 0, len(u.porClave))
+	for id := range u.porClave {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	uso := fmt.Sprint(u.sinCifrar, " sin cifrar")
+	for _, id := range ids {
+		uso += fmt.Sprintf(", %d con la clave %q", u.porClave[id], id)
+	}
+	fmt.Println("  entradas:", uso)
+	sinClave := 0
+	for _, id := range ids {
+		if n := u.sinClave[id]; n > 0 {
+			fmt.Printf("  %d entradas cifradas con la clave %q, que no está en el archivo de claves\n", n, id)
+			sinClave += n
+		}
+	}
+	if u.fallos > 0 {
+		fmt.Println(" ", u.fallos, "entradas no se pueden descifrar:", u.error)
+		return 1, sinClave
+	}
+	return 0, sinClave
+}
+
+// revisarRegistro revisa los archivos del registro de segmentos de una cola.
+//
+// Retorna:
+// - El número de problemas que quedan sin reparar.
+// - El número de entradas cifradas con claves que no están en el archivo de claves (ver `usoClaves`).
+//
+// Comportamiento:
+// - Revisa cada segmento; solo en el último se considera que una entrada incompleta es una escritura interrumpida, como hace `abrirRegistro`. Las entradas cifradas se descifran si se indica el llavero (ver `usoClaves`).
+// - Revisa que el archivo `acks` esté formado por confirmaciones completas de 8 bytes y que `consumido` tenga 8 bytes. Un `consumido` dañado se aparta al reparar, de modo que los mensajes confirmados antes de la última compactación pueden volver a entregarse.
+func revisarRegistro(dir, reparar string, llavero *Llavero) (int, int) {
+	problemas, sinClave := 0, 0
+	segmentos, err := filepath.Glob(filepath.Join(dir, "*"+extensionSegmento))
+	if err != nil {
+		fmt.Println(dir+":", err)
+		return 1, 0
+	}
+	sort.Strings(segmentos)
+	for i, segmento := range segmentos {
+		var interrumpida func([]byte, error) bool
+		if i == len(segmentos)-1 {
+			interrumpida = escrituraInterrumpida
+		}
+		uso := &usoClaves{llavero: llavero}
+		problemas += revisarArchivo(segmento, magiaEntrada, comprobarEntrada, interrumpida, uso.anotar, reparar)
+		fallos, n := uso.mostrar()
+		problemas += fallos
+		sinClave += n
+	}
+	if ruta := filepath.Join(dir, archivoAcks); existe(ruta) {
+		// Las confirmaciones no tienen marca, así que solo puede faltar el final de la última.
+		ack := func(datos []byte) (int, error) {
+			if len(datos) < 8 {
+				return 0, errEntradaIncompleta
+			}
+			return 8, nil
+		}
+		interrumpida := func([]byte, error) bool { return true }
+		problemas += revisarArchivo(ruta, 0, ack, interrumpida, nil, reparar)
+	}
+	ruta := filepath.Join(dir, archivoConsumido)
+	if datos, err := os.ReadFile(ruta); err == nil && len(datos) != 8 {
+		fmt.Println(ruta+":", len(datos), "bytes en lugar de 8")
+		if reparar == "" {
+			return problemas + 1, sinClave
+		}
+		if err := os.Rename(ruta, ruta+extensionCuarentena); err != nil {
+			fmt.Println("  error al reparar:", err)
+			return problemas + 1, sinClave
+		}
+		fmt.Println("  reparado: movido a", ruta+extensionCuarentena)
+	} else if err != nil && !os.IsNotExist(err) {
+		fmt.Println(ruta+":", err)
+		problemas++
+	}
+	return problemas, sinClave
+}
+
+// revisarKV revisa el archivo de un almacén clave-valor.
+//
+// Retorna:
+// - El número de problemas que quedan sin reparar y el de entradas cifradas con claves que no están en el archivo de claves, como `revisarRegistro`.
+//
+// Comportamiento:
+// - Además del formato y el CRC de cada operación, comprueba que las claves son offsets o `claveSiguiente` y que los valores son entradas de mensaje válidas, descifrándolas como en `revisarRegistro`. Al reparar en cuarentena una operación de borrado, el mensaje borrado puede volver a entregarse.
+func revisarKV(dir, reparar string, llavero *Llavero) (int, int) {
+	ruta := filepath.Join(dir, archivoKV)
+	if !existe(ruta) {
+		fmt.Println(ruta + ": no existe, la cola está vacía")
+		return 0, 0
+	}
+	decodificar := func(datos []byte) (int, error) {
+		tipo, clave, valor, n, err := decodificarOperacionKV(datos)
+		if err != nil || string(clave) == claveSiguiente {
+			return n, err
+		}
+		if len(clave) != 8 {
+			return 0, fmt.Errorf("%w: clave de %d bytes", errEntradaCorrupta, len(clave))
+		}
+		if tipo == kvPoner {
+			if _, err := comprobarEntrada(valor); err != nil {
+				return 0, fmt.Errorf("mensaje no válido: %w", err)
+			}
+		}
+		return n, nil
+	}
+	uso := &usoClaves{llavero: llavero}
+	anotar := func(datos []byte) {
+		if tipo, clave, valor, _, err := decodificarOperacionKV(datos); err == nil && tipo == kvPoner && string(clave) != claveSiguiente {
+			uso.anotar(valor)
+		}
+	}
+	problemas := revisarArchivo(ruta, magiaKV, decodificar, operacionKVInterrumpida, anotar, reparar)
+	fallos, sinClave := uso.mostrar()
+	return problemas + fallos, sinClave
+}
+
+// existe indica si existe el archivo de la ruta especificada.
+func existe(ruta string) bool {
+	_, err := os.Stat(ruta)
+	return err == nil
+}
+
+// ejecutarFsck ejecuta el subcomando `fsck`, que comprueba sin arrancar el broker el almacenamiento
+// duradero de su directorio de datos. Debe ejecutarse con el broker parado.
+//
+// Parámetros:
+// - args: Los argumentos del subcomando, sin su nombre.
+//
+// Retorna:
+// - true si no quedan problemas (no se encontró ninguno o se repararon todos) ni entradas cifradas con claves que faltan en el archivo de claves.
+//
+// Comportamiento:
+// - Revisa el manifiesto y el almacén de cada cola que aparece en él según su tipo, y avisa de los directorios de `colas` que no están en el manifiesto.
+// - Con -reparar, repara los archivos dañados truncándolos o poniendo en cuarentena sus registros no válidos.
+// - Muestra con qué clave están cifradas las entradas y, con -claves, comprueba que se pueden descifrar. Las entradas cifradas con una clave que no está en el archivo se cuentan aparte de los problemas: no están dañadas y no se reparan, pero el broker no puede cargar sus colas sin la clave.
+func ejecutarFsck(args []string) bool {
+	opciones := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	datos := opciones.String("datos", datosPorDefecto, "directorio de datos del broker")
+	reparar := opciones.String("reparar", "", "reparar los archivos dañados: truncar o cuarentena")
+	claves := opciones.String("claves", "", "archivo de claves con que se comprueba que las entradas cifradas se pueden descifrar")
+	if err := opciones.Parse(args); err != nil {
+		return false
+	}
+	if opciones.NArg() != 0 || (*reparar != "" && *reparar != repararTruncar && *reparar != repararCuarentena) {
+		fmt.Println("Uso: go run MOM fsck [-datos datos] [-reparar truncar|cuarentena] [-claves archivo]")
+		return false
+	}
+	var llavero *Llavero
+	if *claves != "" {
+		var err error
+		if llavero, err = cargarLlavero(*claves); err != nil {
+			fmt.Println("Error al cargar las claves:", err)
+			return false
+		}
+	}
+	manifiesto, err := leerManifiesto(filepath.Join(*datos, archivoManifiesto))
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	problemas, sinClave := 0, 0
+	conocidos := make(map[string]bool)
+	for _, entrada := range manifiesto.Colas {
+		dir := filepath.Join(*datos, entrada.Directorio)
+		conocidos[filepath.Clean(dir)] = true
+		fmt.Println("Cola", entrada.Nombre, "("+dir+")")
+		if !existe(dir) {
+			fmt.Println("  el directorio no existe, la cola se creará vacía")
+			continue
+		}
+		var p, n int
+		switch entrada.Almacen {
+		case almacenRegistro, "":
+			p, n = revisarRegistro(dir, *reparar, llavero)
+		case almacenKV:
+			p, n = revisarKV(dir, *reparar, llavero)
+		default:
+			fmt.Println("  tipo de almacén desconocido:", entrada.Almacen)
+			p = 1
+		}
+		problemas += p
+		sinClave += n
+	}
+	colas := filepath.Join(*datos, directorioColas)
+	archivos, err := os.ReadDir(colas)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println(err)
+		problemas++
+	}
+	for _, archivo := range archivos {
+		if ruta := filepath.Join(colas, archivo.Name()); !conocidos[ruta] {
+			fmt.Println("Aviso:", ruta, "no está en el manifiesto; el broker lo ignora")
+		}
+	}
+	if sinClave > 0 {
+		fmt.Println(sinClave, "entradas cifradas con claves que no están en el archivo de claves")
+	}
+	if problemas > 0 {
+		fmt.Println(problemas, "problemas sin reparar")
+	}
+	if problemas > 0 || sinClave > 0 {
+		return false
+	}
+	fmt.Println("Sin problemas")
+	return true
+}
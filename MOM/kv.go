@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Formato del archivo de un almacén clave-valor: una sucesión de operaciones, cada una con el formato
+//
+//	magia (1 byte) | versión (1 byte) | tipo (1 byte) | longitud de la clave (2 bytes) |
+//	longitud del valor (4 bytes) | clave | valor | CRC-32C de todo lo anterior (4 bytes)
+//
+// El tipo es `kvPoner`, que asocia el valor a la clave, o `kvBorrar`, que elimina la clave. El valor de
+// una clave es el de la última operación `kvPoner` que no va seguida de un `kvBorrar` de esa clave.
+const (
+	magiaKV        = 0xB8
+	versionKV      = 1
+	cabeceraKV     = 9
+	kvPoner        = 'P'
+	kvBorrar       = 'B'
+	archivoKV      = "kv.dat"
+	claveSiguiente = "siguiente"
+)
+
+// codificarOperacionKV devuelve la representación de una operación del almacén clave-valor.
+func codificarOperacionKV(tipo byte, clave, valor []byte) []byte {
+	op := make([]byte, 0, cabeceraKV+len(clave)+len(valor)+4)
+	op = append(op, magiaKV, versionKV, tipo)
+	op = binary.BigEndian.AppendUint16(op, uint16(len(clave)))
+	op = binary.BigEndian.AppendUint32(op, uint32(len(valor)))
+	op = append(op, clave...)
+	op = append(op, valor...)
+	return binary.BigEndian.AppendUint32(op, crc32.Checksum(op, tablaCRC))
+}
+
+// decodificarOperacionKV lee la operación que empieza al principio de datos.
+//
+// Retorna:
+// - El tipo, la clave y el valor de la operación y el número de bytes que ocupa.
+// - `errEntradaIncompleta` si los datos terminan antes que la operación, o un error que envuelve `errEntradaCorrupta` si la operación no es válida.
+func decodificarOperacionKV(datos []byte) (byte, []byte, []byte, int, error) {
+	n, err := longitudOperacionKV(datos)
+	if err != nil {
+		return 0, nil, nil, 0, err
+	}
+	if len(datos) < n {
+		return 0, nil, nil, 0, errEntradaIncompleta
+	}
+	if crc32.Checksum(datos[:n-4], tablaCRC) != binary.BigEndian.Uint32(datos[n-4:]) {
+		return 0, nil, nil, 0, fmt.Errorf("%w: el CRC no coincide", errEntradaCorrupta)
+	}
+	tipo := datos[2]
+	if tipo != kvPoner && tipo != kvBorrar {
+		return 0, nil, nil, 0, fmt.Errorf("%w: tipo de operación %q desconocido", errEntradaCorrupta, tipo)
+	}
+	longClave := int(binary.BigEndian.Uint16(datos[3:]))
+	clave := datos[cabeceraKV : cabeceraKV+longClave]
+	valor := datos[cabeceraKV+longClave : n-4]
+	return tipo, clave, valor, n, nil
+}
+
+// longitudOperacionKV devuelve la longitud total de la operación que empieza al principio de datos
+// según su cabecera.
+func longitudOperacionKV(datos []byte) (int, error) {
+	if len(datos) < cabeceraKV {
+		return 0, errEntradaIncompleta
+	}
+	if datos[0] != magiaKV {
+		return 0, fmt.Errorf("%w: marca de operación no válida", errEntradaCorrupta)
+	}
+	if datos[1] != versionKV {
+		return 0, fmt.Errorf("%w: versión de formato %d no soportada", errEntradaCorrupta, datos[1])
+	}
+	longValor := int(binary.BigEndian.Uint32(datos[5:]))
+	if longValor > maxCuerpoEntrada {
+		return 0, fmt.Errorf("%w: longitud %d no válida", errEntradaCorrupta, longValor)
+	}
+	return cabeceraKV + int(binary.BigEndian.Uint16(datos[3:])) + longValor + 4, nil
+}
+
+// operacionKVInterrumpida indica si el error al decodificar la operación que empieza al principio de
+// datos se debe a que la última escritura del archivo no terminó (ver `escrituraInterrumpida`): la
+// operación llega al final del archivo y detrás no empieza ninguna operación válida.
+func operacionKVInterrumpida(datos []byte, err error) bool {
+	if !errors.Is(err, errEntradaIncompleta) {
+		if n, err := longitudOperacionKV(datos); err != nil || n != len(datos) {
+			return false
+		}
+	}
+	return !registroValidoPosterior(datos, magiaKV, func(datos []byte) (int, error) {
+		_, _, _, n, err := decodificarOperacionKV(datos)
+		return n, err
+	})
+}
+
+// AlmacenKV es un almacén clave-valor embebido en un único archivo de operaciones, usado como almacén
+// de una cola: la clave de cada mensaje es su offset y su valor, la entrada del mensaje en el formato
+// de los segmentos del registro. Consumir un mensaje añade una operación que borra su clave.
+//
+// Cuando las operaciones que ya no afectan al contenido superan a las vigentes, el archivo se reescribe
+// solo con las vigentes. La clave `claveSiguiente` guarda el siguiente offset al reescribirlo, para que
+// los offsets de los mensajes borrados no se reutilicen.
+type AlmacenKV struct {
+	dir       string
+	mux       sync.Mutex
+	archivo   *os.File
+	siguiente uint64
+	// vivos contiene los offsets de los mensajes no consumidos; muertos cuenta las operaciones del
+	// archivo que ya no afectan a su contenido.
+	vivos   map[uint64]struct{}
+	muertos int
+	// codificacion indica cómo se cifran y comprimen los mensajes, como en `Registro`.
+	codificacion codificacion
+	sinc         *sincronizador
+	fin          chan struct{}
+	tareas       sync.WaitGroup
+	cerrar       sync.Once
+	errCerrar    error
+}
+
+// abrirKV abre o crea el almacén clave-valor de una cola en el directorio especificado.
+//
+// Retorna:
+// - El almacén abierto y los mensajes pendientes de consumir, en el orden en que se publicaron.
+// - Un error si no se puede leer o crear el almacén.
+//
+// Comportamiento:
+// - Si el archivo acaba en una operación interrumpida, lo trunca tras la última operación completa; cualquier otra operación no válida es un error.
+func abrirKV(dir string, politica PoliticaSync, cod codificacion) (*AlmacenKV, []Mensaje, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	a := &AlmacenKV{dir: dir, vivos: make(map[uint64]struct{}), codificacion: cod, fin: make(chan struct{})}
+	ruta := filepath.Join(dir, archivoKV)
+	datos, err := os.ReadFile(ruta)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	valores := make(map[uint64][]byte)
+	pos := 0
+	for pos < len(datos) {
+		tipo, clave, valor, n, err := decodificarOperacionKV(datos[pos:])
+		if err != nil {
+			if !operacionKVInterrumpida(datos[pos:], err) {
+				return nil, nil, fmt.Errorf("almacén %s corrupto en la posición %d: %w", ruta, pos, err)
+			}
+			fmt.Println("Truncando escritura interrumpida en", ruta, "posición", pos)
+			if err := os.Truncate(ruta, int64(pos)); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+		pos += n
+		if string(clave) == claveSiguiente {
+			if len(valor) == 8 {
+				a.siguiente = max(a.siguiente, binary.BigEndian.Uint64(valor))
+			}
+			a.muertos++
+			continue
+		}
+		if len(clave) != 8 {
+			return nil, nil, fmt.Errorf("almacén %s: clave no válida en la posición %d", ruta, pos-n)
+		}
+		offset := binary.BigEndian.Uint64(clave)
+		a.siguiente = max(a.siguiente, offset+1)
+		if tipo == kvBorrar {
+			delete(valores, offset)
+			a.muertos += 2
+			continue
+		}
+		valores[offset] = valor
+	}
+	pendientes := make([]Mensaje, 0, len(valores))
+	for offset, valor := range valores {
+		m, _, err := decodificarEntrada(valor, cod.llavero)
+		if err != nil {
+			return nil, nil, fmt.Errorf("almacén %s: mensaje %d no válido: %w", ruta, offset, err)
+		}
+		pendientes = append(pendientes, m)
+		a.vivos[offset] = struct{}{}
+	}
+	sort.Slice(pendientes, func(i, j int) bool { return pendientes[i].Offset < pendientes[j].Offset })
+	a.archivo, err = os.OpenFile(ruta, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.sinc = nuevoSincronizador(politica, &a.mux, a.siguiente)
+	if politica.Modo == syncGrupo {
+		a.tareas.Add(1)
+		go func() {
+			defer a.tareas.Done()
+			a.sinc.periodicamente(&a.mux, a.fin, func() error { return a.sinc.sincronizar(a.archivo, a.siguiente) })
+		}()
+	}
+	return a, pendientes, nil
+}
+
+// escribir añade una operación al archivo. Debe llamarse con `a.mux` bloqueado.
+func (a *AlmacenKV) escribir(tipo byte, clave, valor []byte) error {
+	if a.archivo == nil {
+		return errAlmacenCerrado
+	}
+	if a.sinc.err != nil {
+		return a.sinc.err
+	}
+	if _, err := a.archivo.Write(codificarOperacionKV(tipo, clave, valor)); err != nil {
+		// Como en el registro, tras una operación escrita a medias no se escribe nada más.
+		return a.sinc.fallo(fmt.Errorf("error al escribir en el almacén %s: %w", a.dir, err))
+	}
+	return nil
+}
+
+func (a *AlmacenKV) Anadir(m *Mensaje) error {
+	if err := validarMensaje(m); err != nil {
+		return err
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	m.Offset = max(m.Offset, a.siguiente)
+	if err := a.escribir(kvPoner, binary.BigEndian.AppendUint64(nil, m.Offset), codificarEntrada(m, a.codificacion)); err != nil {
+		return err
+	}
+	a.siguiente = m.Offset + 1
+	a.vivos[m.Offset] = struct{}{}
+	if a.sinc.politica.Modo == syncSiempre {
+		return a.sinc.sincronizar(a.archivo, a.siguiente)
+	}
+	return nil
+}
+
+func (a *AlmacenKV) EsperarSincronizado(offset uint64) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.sinc.esperar(offset)
+}
+
+// Confirmar borra la clave del mensaje. Si las operaciones que ya no afectan al contenido superan
+// a las vigentes, reescribe el archivo.
+func (a *AlmacenKV) Confirmar(offset uint64) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if _, ok := a.vivos[offset]; !ok {
+		if a.archivo == nil {
+			return errAlmacenCerrado
+		}
+		return nil
+	}
+	if err := a.escribir(kvBorrar, binary.BigEndian.AppendUint64(nil, offset), nil); err != nil {
+		return err
+	}
+	delete(a.vivos, offset)
+	a.muertos += 2
+	if a.muertos > 2*len(a.vivos)+1024 {
+		return a.reescribir()
+	}
+	return nil
+}
+
+// reescribir sustituye el archivo por otro que solo contiene los mensajes no consumidos y el siguiente
+// offset. Debe llamarse con `a.mux` bloqueado.
+func (a *AlmacenKV) reescribir() error {
+	ruta := filepath.Join(a.dir, archivoKV)
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		return err
+	}
+	nuevo := codificarOperacionKV(kvPoner, []byte(claveSiguiente), binary.BigEndian.AppendUint64(nil, a.siguiente))
+	for pos := 0; pos < len(datos); {
+		tipo, clave, _, n, err := decodificarOperacionKV(datos[pos:])
+		if err != nil {
+			return err
+		}
+		if tipo == kvPoner && len(clave) == 8 {
+			if _, ok := a.vivos[binary.BigEndian.Uint64(clave)]; ok {
+				nuevo = append(nuevo, datos[pos:pos+n]...)
+			}
+		}
+		pos += n
+	}
+	if err := escribirAtomico(ruta, nuevo); err != nil {
+		return err
+	}
+	archivo, err := os.OpenFile(ruta, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		a.archivo.Close()
+		a.archivo = nil
+		return a.sinc.fallo(err)
+	}
+	a.archivo.Close()
+	a.archivo = archivo
+	a.muertos = 1
+	// escribirAtomico ya sincronizó el archivo nuevo con el disco.
+	a.sinc.sincronizado = a.siguiente
+	a.sinc.cambio.Broadcast()
+	return nil
+}
+
+func (a *AlmacenKV) Sincronizar() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.archivo == nil {
+		return errAlmacenCerrado
+	}
+	if err := a.sinc.sincronizar(a.archivo, a.siguiente); err != nil {
+		return err
+	}
+	// Sincroniza también los borrados, que no cuentan como mensajes por sincronizar.
+	return a.archivo.Sync()
+}
+
+func (a *AlmacenKV) Cerrar() error {
+	a.cerrar.Do(func() {
+		close(a.fin)
+		a.tareas.Wait()
+		a.mux.Lock()
+		defer a.mux.Unlock()
+		if a.archivo != nil {
+			a.errCerrar = errors.Join(a.sinc.sincronizar(a.archivo, a.siguiente), a.archivo.Sync(), a.archivo.Close())
+			a.archivo = nil
+		}
+		a.sinc.cerrar()
+	})
+	return a.errCerrar
+}
+
+func (a *AlmacenKV) Borrar() error {
+	if err := a.Cerrar(); err != nil {
+		fmt.Println("Error al cerrar el almacén", a.dir+":", err)
+	}
+	return os.RemoveAll(a.dir)
+}
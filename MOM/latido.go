@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latidoPorDefecto es el intervalo máximo de latidos que el broker negocia si no se indica otro.
+const latidoPorDefecto = 10 * time.Second
+
+// latidosPerdidos es el número de intervalos sin actividad tras los que se da por muerto a un cliente.
+const latidosPerdidos = 2
+
+// ArgsConectar representa los argumentos con los que un cliente negocia su sesión con el broker.
+// Latido es el intervalo de latidos que propone el cliente; cero si acepta el del broker.
+// Compresion son los algoritmos de compresión que entiende el cliente, por orden de preferencia.
+type ArgsConectar struct {
+	Latido     time.Duration
+	Compresion []string
+}
+
+// ReplyConectar representa la respuesta de `Conectar` con el intervalo de latidos negociado.
+// Si Latido es cero, la sesión no usa latidos. Compresion es el algoritmo con que el broker comprime
+// los mensajes que entrega a la sesión, o vacío si no los comprime.
+type ReplyConectar struct {
+	Latido     time.Duration
+	Compresion string
+}
+
+// ArgsLatido representa los argumentos de un latido.
+// Secuencia es el número de latido enviado por el cliente.
+type ArgsLatido struct {
+	Secuencia uint64
+}
+
+// conexionVigilada envuelve la conexión de un cliente y guarda el momento en que se recibió
+// actividad por última vez. El canal `cerrada` se cierra en cuanto falla una lectura o se
+// cierra la conexión, sin esperar a que terminen las llamadas en curso.
+type conexionVigilada struct {
+	net.Conn
+	ultimaActividad atomic.Int64
+	cerrada         chan struct{}
+	cerrar          sync.Once
+}
+
+// Read lee de la conexión y registra la actividad si se ha recibido algún dato.
+// Si la lectura falla, marca la conexión como cerrada.
+func (c *conexionVigilada) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.actividad()
+	}
+	if err != nil {
+		c.cerrar.Do(func() { close(c.cerrada) })
+	}
+	return n, err
+}
+
+// Close cierra la conexión y la marca como cerrada.
+func (c *conexionVigilada) Close() error {
+	c.cerrar.Do(func() { close(c.cerrada) })
+	return c.Conn.Close()
+}
+
+// actividad registra el instante actual como el de la última actividad de la conexión.
+func (c *conexionVigilada) actividad() {
+	c.ultimaActividad.Store(time.Now().UnixNano())
+}
+
+// inactiva devuelve el tiempo transcurrido desde la última actividad de la conexión.
+func (c *conexionVigilada) inactiva() time.Duration {
+	return time.Since(time.Unix(0, c.ultimaActividad.Load()))
+}
+
+// negociarLatido calcula el intervalo de latidos de una sesión a partir del propuesto por el cliente
+// y el máximo del broker: si uno de los dos es cero se usa el otro, y si no, el menor.
+func negociarLatido(cliente, broker time.Duration) time.Duration {
+	if cliente <= 0 {
+		return broker
+	}
+	if broker <= 0 || cliente < broker {
+		return cliente
+	}
+	return broker
+}
+
+// Conectar es un método RPC con el que el cliente negocia el intervalo de latidos y la compresión de su sesión.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsConectar` con el intervalo y los algoritmos de compresión que propone el cliente.
+// - reply: Un puntero a una estructura `ReplyConectar` donde se devuelven el intervalo y el algoritmo negociados.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la sesión ya se negoció.
+//
+// Comportamiento:
+// - El broker elige el primero de los algoritmos propuestos que entiende (ver `negociarCompresion`) y desde entonces puede entregar comprimidos los mensajes a la sesión.
+// - A partir de la negociación el cliente debe llamar a `Latido` (o a cualquier otro método) al menos una vez por intervalo; si pasan `latidosPerdidos` intervalos sin actividad, el broker cierra la conexión, cancela sus suscripciones y devuelve a las colas los mensajes sin confirmar.
+func (s *Sesion) Conectar(args *ArgsConectar, reply *ReplyConectar) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.latido != 0 {
+		return fmt.Errorf("la sesión ya tiene latidos negociados")
+	}
+	s.latido = negociarLatido(args.Latido, s.Broker.latido)
+	s.compresion = negociarCompresion(args.Compresion)
+	reply.Latido = s.latido
+	reply.Compresion = s.compresion
+	if s.latido > 0 {
+		go s.vigilar(s.latido)
+	}
+	return nil
+}
+
+// Latido es un método RPC que el cliente llama periódicamente para indicar que sigue vivo.
+// La respuesta sirve al cliente como latido del broker.
+func (s *Sesion) Latido(args *ArgsLatido, reply *Reply) error {
+	return nil
+}
+
+// vigilar comprueba cada intervalo la actividad de la conexión y la cierra si el cliente lleva
+// `latidosPerdidos` intervalos sin dar señales de vida.
+//
+// Parámetros:
+// - intervalo: El intervalo de latidos negociado.
+func (s *Sesion) vigilar(intervalo time.Duration) {
+	ticker := time.NewTicker(intervalo)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.fin:
+			return
+		case <-ticker.C:
+			if s.conn.inactiva() > latidosPerdidos*intervalo {
+				fmt.Println("Cliente sin latidos, cerrando conexión", s.conn.RemoteAddr())
+				s.conn.Close()
+				return
+			}
+		}
+	}
+}
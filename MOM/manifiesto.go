@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// datosPorDefecto es el directorio de datos del broker si no se indica otro.
+const datosPorDefecto = "datos"
+
+// Nombres dentro del directorio de datos del broker.
+const (
+	archivoManifiesto = "manifiesto.json"
+	directorioColas   = "colas"
+	versionManifiesto = 1
+)
+
+// Manifiesto es el contenido de `manifiesto.json`: la lista de colas duraderas declaradas en el broker.
+// Al arrancar, el broker solo recupera las colas del manifiesto; cualquier otro archivo del directorio
+// de datos se ignora.
+type Manifiesto struct {
+	Version int
+	Colas   []EntradaManifiesto
+}
+
+// EntradaManifiesto describe una cola duradera: su nombre, el directorio de su almacén, relativo al
+// directorio de datos, el tipo de almacén y la política de sincronización, la compresión y los parámetros con que se declaró.
+// Se guarda aparte de los mensajes, de modo que una cola vacía se restaura igual que una con mensajes.
+type EntradaManifiesto struct {
+	Nombre         string
+	Directorio     string
+	Almacen        string
+	Sincronizacion PoliticaSync
+	Compresion     string
+	Configuracion  ConfiguracionCola
+}
+
+// abrirDatos prepara el directorio de datos del broker y carga su manifiesto.
+//
+// Parámetros:
+// - datos: El directorio de datos. Se crea si no existe.
+//
+// Retorna:
+// - Un error si no se puede crear el directorio o el manifiesto no es válido.
+func (l *Broker) abrirDatos(datos string) error {
+	if err := os.MkdirAll(filepath.Join(datos, directorioColas), 0755); err != nil {
+		return err
+	}
+	manifiesto, err := leerManifiesto(filepath.Join(datos, archivoManifiesto))
+	if err != nil {
+		return err
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.datos = datos
+	l.manifiesto = make(map[string]EntradaManifiesto)
+	for _, entrada := range manifiesto.Colas {
+		if entrada.Almacen == "" {
+			entrada.Almacen = almacenRegistro
+		}
+		l.manifiesto[entrada.Nombre] = entrada
+	}
+	return nil
+}
+
+// leerManifiesto lee el manifiesto de la ruta especificada. Si no existe, devuelve uno vacío.
+func leerManifiesto(ruta string) (Manifiesto, error) {
+	manifiesto := Manifiesto{Version: versionManifiesto}
+	datos, err := os.ReadFile(ruta)
+	if os.IsNotExist(err) {
+		return manifiesto, nil
+	}
+	if err != nil {
+		return manifiesto, err
+	}
+	if err := json.Unmarshal(datos, &manifiesto); err != nil {
+		return manifiesto, fmt.Errorf("manifiesto %s no válido: %w", ruta, err)
+	}
+	if manifiesto.Version != versionManifiesto {
+		return manifiesto, fmt.Errorf("versión %d del manifiesto %s no soportada", manifiesto.Version, ruta)
+	}
+	return manifiesto, nil
+}
+
+// guardarManifiesto escribe de forma atómica el manifiesto con las colas duraderas de `l.manifiesto`.
+// Debe llamarse con `l.mux` bloqueado.
+func (l *Broker) guardarManifiesto() error {
+	manifiesto := Manifiesto{Version: versionManifiesto, Colas: make([]EntradaManifiesto, 0, len(l.manifiesto))}
+	for _, entrada := range l.manifiesto {
+		manifiesto.Colas = append(manifiesto.Colas, entrada)
+	}
+	sort.Slice(manifiesto.Colas, func(i, j int) bool { return manifiesto.Colas[i].Nombre < manifiesto.Colas[j].Nombre })
+	datos, err := json.MarshalIndent(manifiesto, "", "  ")
+	if err != nil {
+		return err
+	}
+	return escribirAtomico(filepath.Join(l.datos, archivoManifiesto), append(datos, '\n'))
+}
+
+// registrarDuradera añade una cola duradera al manifiesto y lo guarda. Debe llamarse con `l.mux` bloqueado.
+//
+// Parámetros:
+// - entrada: La cola tal como se declara; su `Directorio` se ignora.
+//
+// Retorna:
+// - La entrada de la cola en el manifiesto.
+// - Un error si no se pudo guardar el manifiesto.
+//
+// Comportamiento:
+// - Si la cola ya está en el manifiesto, no lo modifica y devuelve la entrada que tenía.
+// - Si no lo está, borra cualquier directorio que haya quedado con su nombre, que solo puede ser el resto de una cola borrada cuyo borrado se interrumpió, y la añade al manifiesto antes de crear su almacén.
+func (l *Broker) registrarDuradera(entrada EntradaManifiesto) (EntradaManifiesto, error) {
+	if anterior, ok := l.manifiesto[entrada.Nombre]; ok {
+		return anterior, nil
+	}
+	entrada.Directorio = filepath.Join(directorioColas, entrada.Nombre+extensionDirectorioCola)
+	if err := os.RemoveAll(filepath.Join(l.datos, entrada.Directorio)); err != nil {
+		return entrada, err
+	}
+	l.manifiesto[entrada.Nombre] = entrada
+	if err := l.guardarManifiesto(); err != nil {
+		delete(l.manifiesto, entrada.Nombre)
+		return entrada, err
+	}
+	return entrada, nil
+}
+
+// olvidarDuradera quita una cola duradera del manifiesto y lo guarda. Debe llamarse con `l.mux` bloqueado.
+func (l *Broker) olvidarDuradera(nombre string) error {
+	entrada, ok := l.manifiesto[nombre]
+	if !ok {
+		return nil
+	}
+	delete(l.manifiesto, nombre)
+	if err := l.guardarManifiesto(); err != nil {
+		l.manifiesto[nombre] = entrada
+		return err
+	}
+	return nil
+}
+
+// RescatarColasAnteriores recupera las colas duraderas del manifiesto del directorio de datos.
+//
+// Comportamiento:
+// - Declara cada cola del manifiesto con el almacén, la política de sincronización, la compresión y los parámetros con que se declaró; cada cola se carga con los mensajes de su almacén que quedaron sin consumir.
+// - Avisa de los directorios de `colas` que no están en el manifiesto y no los carga.
+func (l *Broker) RescatarColasAnteriores() {
+	l.mux.Lock()
+	entradas := make([]EntradaManifiesto, 0, len(l.manifiesto))
+	for _, entrada := range l.manifiesto {
+		entradas = append(entradas, entrada)
+	}
+	conocidos := make(map[string]bool)
+	for _, entrada := range entradas {
+		conocidos[filepath.Join(l.datos, entrada.Directorio)] = true
+	}
+	l.mux.Unlock()
+	for _, entrada := range entradas {
+		fmt.Println("Rescatando cola", entrada.Nombre)
+		args := &ArgsDeclararCola{
+			Nombre:                  entrada.Nombre,
+			Durability:              true,
+			Almacen:                 entrada.Almacen,
+			Compresion:              entrada.Compresion,
+			Sincronizacion:          entrada.Sincronizacion.Modo,
+			IntervaloSincronizacion: entrada.Sincronizacion.Intervalo,
+			TTLMensajes:             entrada.Configuracion.TTLMensajes,
+			MaxMensajes:             entrada.Configuracion.MaxMensajes,
+			MaxBytes:                entrada.Configuracion.MaxBytes,
+		}
+		if err := l.Declarar_cola(args, &Reply{}); err != nil {
+			fmt.Println("Error al rescatar la cola", entrada.Nombre+":", err)
+		}
+	}
+	directorio := filepath.Join(l.datos, directorioColas)
+	archivos, err := os.ReadDir(directorio)
+	if err != nil {
+		fmt.Println("Error al leer el directorio de colas:", err)
+		return
+	}
+	for _, archivo := range archivos {
+		if ruta := filepath.Join(directorio, archivo.Name()); !conocidos[ruta] {
+			fmt.Println("Ignorando", ruta+": no está en el manifiesto")
+		}
+	}
+}
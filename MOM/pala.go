@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Palas: reenvío de mensajes de una cola local a otro broker.
+//
+// Una pala consume los mensajes de una cola del broker y los publica en una cola de otro broker MOM.
+// La pala guarda los mensajes que saca de la cola local en su propio conjunto de mensajes en vuelo, sin
+// plazo, y solo los confirma en el almacén local cuando el broker remoto ha aceptado la publicación, es
+// decir, cuando el mensaje está sincronizado con su disco según la política de la cola remota. Al detenerse,
+// devuelve a la cola local los que no se habían confirmado. Si la conexión falla, la pala vuelve a conectar con una
+// espera que se duplica tras cada fallo, entre `esperaMinPala` y `esperaMaxPala`, y publica de nuevo los
+// mensajes que no se habían confirmado: un mensaje puede llegar dos veces al broker remoto, pero no se pierde.
+//
+// Las palas se configuran con un archivo JSON (opción -palas del broker) con una lista de objetos
+// `ConfiguracionPala`, por ejemplo:
+//
+//	[{"Nombre": "a-b", "Origen": "pedidos", "Destino": "10.0.0.2:9000", "ColaDestino": "pedidos-a", "Durable": true}]
+//
+// El broker de MOM no tiene intercambios, así que el destino es siempre una cola.
+
+// Esperas entre reconexiones de una pala.
+const (
+	esperaMinPala = 100 * time.Millisecond
+	esperaMaxPala = 30 * time.Second
+)
+
+// esperaMensajesPala es el tiempo que una pala espera mensajes en la cola local antes de comprobar si debe parar,
+// y esperaRemotaPala el que espera la respuesta del broker remoto.
+const (
+	esperaMensajesPala = time.Second
+	esperaRemotaPala   = 30 * time.Second
+)
+
+// lotePorDefectoPala es el número máximo de mensajes que una pala publica en cada llamada si no se indica otro.
+const lotePorDefectoPala = 100
+
+// ConfiguracionPala describe una pala.
+//
+// - Nombre: el nombre de la pala en la consola.
+// - Origen: la cola local de la que se consumen los mensajes.
+// - Destino: la dirección (ip:puerto) del broker remoto.
+// - ColaDestino: la cola remota en la que se publican; si está vacía, la que se llama como el origen.
+// - Durable: si la cola remota se declara duradera.
+// - Lote: el número máximo de mensajes por publicación; si es cero, `lotePorDefectoPala`.
+type ConfiguracionPala struct {
+	Nombre      string
+	Origen      string
+	Destino     string
+	ColaDestino string
+	Durable     bool
+	Lote        int
+}
+
+// Pala reenvía los mensajes de una cola local a otro broker.
+type Pala struct {
+	broker *Broker
+	config ConfiguracionPala
+	// transferidos cuenta los mensajes confirmados por el broker remoto y reconexiones los fallos.
+	transferidos atomic.Int64
+	reconexiones atomic.Int64
+	// mux protege `estado` y `ultimoError`.
+	mux         sync.Mutex
+	estado      string
+	ultimoError error
+	fin         chan struct{}
+	terminado   chan struct{}
+}
+
+// pendientePala es un mensaje que la pala ha sacado de la cola local y aún no ha confirmado.
+type pendientePala struct {
+	cola    *Cola
+	mensaje *Mensaje
+}
+
+// cargarPalas lee la configuración de las palas del archivo especificado.
+//
+// Retorna:
+// - Las palas configuradas, o un error si el archivo no es válido, falta algún campo o algún nombre se repite.
+func cargarPalas(ruta string) ([]ConfiguracionPala, error) {
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		return nil, err
+	}
+	var configs []ConfiguracionPala
+	if err := json.Unmarshal(datos, &configs); err != nil {
+		return nil, fmt.Errorf("archivo de palas %s no válido: %w", ruta, err)
+	}
+	nombres := make(map[string]bool)
+	for i := range configs {
+		c := &configs[i]
+		if c.Nombre == "" || c.Origen == "" || c.Destino == "" {
+			return nil, fmt.Errorf("archivo de palas %s: la pala %d necesita Nombre, Origen y Destino", ruta, i+1)
+		}
+		if nombres[c.Nombre] {
+			return nil, fmt.Errorf("archivo de palas %s: la pala %s está repetida", ruta, c.Nombre)
+		}
+		nombres[c.Nombre] = true
+		if c.Lote < 0 {
+			return nil, fmt.Errorf("archivo de palas %s: lote de la pala %s no válido: %d", ruta, c.Nombre, c.Lote)
+		}
+		if c.Lote == 0 {
+			c.Lote = lotePorDefectoPala
+		}
+		if c.ColaDestino == "" {
+			c.ColaDestino = c.Origen
+		}
+	}
+	return configs, nil
+}
+
+// iniciarPalas pone en marcha las palas especificadas.
+func (l *Broker) iniciarPalas(configs []ConfiguracionPala) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, config := range configs {
+		p := &Pala{
+			broker:    l,
+			config:    config,
+			estado:    "conectando",
+			fin:       make(chan struct{}),
+			terminado: make(chan struct{}),
+		}
+		l.palas = append(l.palas, p)
+		fmt.Println("Pala", config.Nombre+":", config.Origen, "->", config.Destino+"/"+config.ColaDestino)
+		go p.ejecutar()
+	}
+}
+
+// detenerPalas detiene las palas; los mensajes que tenían sin confirmar vuelven a su cola.
+func (l *Broker) detenerPalas() {
+	l.mux.Lock()
+	palas := l.palas
+	l.palas = nil
+	l.mux.Unlock()
+	for _, p := range palas {
+		close(p.fin)
+	}
+	for _, p := range palas {
+		<-p.terminado
+	}
+}
+
+// mostrarPalas muestra en la consola el estado de cada pala.
+func (l *Broker) mostrarPalas() {
+	l.mux.Lock()
+	palas := append([]*Pala(nil), l.palas...)
+	l.mux.Unlock()
+	if len(palas) == 0 {
+		return
+	}
+	sort.Slice(palas, func(i, j int) bool { return palas[i].config.Nombre < palas[j].config.Nombre })
+	fmt.Println("Palas:")
+	for _, p := range palas {
+		p.mux.Lock()
+		estado, ultimoError := p.estado, p.ultimoError
+		p.mux.Unlock()
+		c := p.config
+		fmt.Println(c.Nombre, "-", c.Origen, "->", c.Destino+"/"+c.ColaDestino, "-", estado+",", p.transferidos.Load(), "mensajes transferidos,", p.reconexiones.Load(), "reconexiones")
+		if ultimoError != nil {
+			fmt.Println("   último error:", ultimoError)
+		}
+	}
+}
+
+// cambiarEstado cambia el estado que muestra la pala en la consola y, si hay un error, lo guarda.
+func (p *Pala) cambiarEstado(estado string, err error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.estado = estado
+	if err != nil {
+		p.ultimoError = err
+	}
+}
+
+// detenida indica si se ha pedido que la pala se detenga.
+func (p *Pala) detenida() bool {
+	select {
+	case <-p.fin:
+		return true
+	default:
+		return false
+	}
+}
+
+// ejecutar reenvía mensajes hasta que se detiene la pala, volviendo a conectar tras cada error con una
+// espera aleatoria entre la mitad y el total de la espera actual, que se duplica tras cada fallo.
+func (p *Pala) ejecutar() {
+	defer close(p.terminado)
+	var pendientes []pendientePala
+	espera := esperaMinPala
+	for {
+		conectada, err := p.transferir(&pendientes)
+		if p.detenida() {
+			p.devolver(pendientes)
+			return
+		}
+		if conectada {
+			espera = esperaMinPala
+		}
+		p.reconexiones.Add(1)
+		p.cambiarEstado(fmt.Sprintf("reconectando en menos de %v", espera), err)
+		fmt.Println("Error en la pala", p.config.Nombre+":", err)
+		jitter := time.Duration(rand.Int63n(int64(espera)/2 + 1))
+		select {
+		case <-p.fin:
+			p.devolver(pendientes)
+			return
+		case <-time.After(espera/2 + jitter):
+		}
+		espera = min(2*espera, esperaMaxPala)
+	}
+}
+
+// transferir conecta con el broker remoto, declara la cola de destino y le reenvía los mensajes de la cola
+// local hasta que hay un error o se detiene la pala.
+//
+// Parámetros:
+// - pendientes: Los mensajes sacados de la cola local sin confirmar, que se publican antes que los demás y
+// se actualizan a medida que se confirman.
+//
+// Retorna:
+// - Si se llegó a conectar y declarar la cola de destino, y el error que detuvo la transferencia.
+func (p *Pala) transferir(pendientes *[]pendientePala) (bool, error) {
+	c := p.config
+	conn, err := net.DialTimeout("tcp", c.Destino, esperaRemotaPala)
+	if err != nil {
+		return false, err
+	}
+	cliente := rpc.NewClient(conn)
+	defer cliente.Close()
+	declarar := &ArgsDeclararCola{Nombre: c.ColaDestino, Durability: c.Durable}
+	if err := llamarConPlazo(cliente, "Broker.Declarar_cola", declarar, &Reply{}, esperaRemotaPala, p.fin); err != nil {
+		return false, fmt.Errorf("al declarar la cola remota %s: %w", c.ColaDestino, err)
+	}
+	p.cambiarEstado("conectada", nil)
+	for !p.detenida() {
+		if len(*pendientes) == 0 {
+			*pendientes = p.sacar()
+			continue
+		}
+		if err := p.publicar(cliente, pendientes); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// sacar saca de la cola local hasta `Lote` mensajes, esperando como mucho `esperaMensajesPala` al primero.
+// Los mensajes caducados se descartan.
+func (p *Pala) sacar() []pendientePala {
+	cola, ok := p.broker.cola(p.config.Origen)
+	if !ok {
+		// La cola local puede declararse más tarde.
+		select {
+		case <-p.fin:
+		case <-time.After(esperaMensajesPala):
+		}
+		return nil
+	}
+	var pendientes []pendientePala
+	espera := esperaMensajesPala
+	for len(pendientes) < p.config.Lote {
+		mensaje, ok := p.broker.extraer(cola, espera, nil)
+		if !ok {
+			break
+		}
+		espera = 0
+		pendientes = append(pendientes, pendientePala{cola: cola, mensaje: mensaje})
+	}
+	return pendientes
+}
+
+// publicar publica en el broker remoto los mensajes pendientes y confirma en la cola local los que acepta.
+//
+// Retorna:
+// - Un error si falla la llamada o el broker remoto rechaza algún mensaje; los rechazados siguen pendientes.
+func (p *Pala) publicar(cliente *rpc.Client, pendientes *[]pendientePala) error {
+	c := p.config
+	ahora := time.Now()
+	args := &ArgsPublicarLote{Durability: c.Durable}
+	var enviados []pendientePala
+	for _, pendiente := range *pendientes {
+		m := pendiente.mensaje
+		// El TTL se reduce en lo que el mensaje ya ha esperado en este broker.
+		ttl := m.TTL
+		if ttl > 0 {
+			ttl -= ahora.Sub(m.Publicado)
+			if ttl <= 0 {
+				p.confirmar(pendiente)
+				continue
+			}
+		}
+		args.Mensajes = append(args.Mensajes, ArgsPublicar{Nombre: c.ColaDestino, Mensaje: m.Cuerpo, TTL: ttl, Cabeceras: m.Cabeceras})
+		enviados = append(enviados, pendiente)
+	}
+	*pendientes = nil
+	if len(enviados) == 0 {
+		return nil
+	}
+	var reply ReplyLote
+	if err := llamarConPlazo(cliente, "Broker.PublicarLote", args, &reply, esperaRemotaPala, p.fin); err != nil {
+		*pendientes = enviados
+		return err
+	}
+	var rechazo string
+	for i, pendiente := range enviados {
+		if i < len(reply.Errores) && reply.Errores[i] != "" {
+			*pendientes = append(*pendientes, pendiente)
+			rechazo = reply.Errores[i]
+			continue
+		}
+		p.confirmar(pendiente)
+		p.transferidos.Add(1)
+	}
+	if rechazo != "" {
+		return fmt.Errorf("el broker remoto ha rechazado %d mensajes: %s", len(*pendientes), rechazo)
+	}
+	return nil
+}
+
+// confirmar da por consumido en la cola local un mensaje pendiente.
+func (p *Pala) confirmar(pendiente pendientePala) {
+	p.broker.mensajeProcesado(pendiente.cola, pendiente.mensaje)
+}
+
+// devolver devuelve a la cola local los mensajes pendientes.
+func (p *Pala) devolver(pendientes []pendientePala) {
+	for _, pendiente := range pendientes {
+		cola, mensaje := pendiente.cola, pendiente.mensaje
+		select {
+		case cola.mensajes <- mensaje:
+		default:
+			go func() { cola.mensajes <- mensaje }()
+		}
+	}
+}
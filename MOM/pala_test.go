@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// esperaPruebaPala es el tiempo máximo que las pruebas de las palas esperan a que se cumpla una condición.
+const esperaPruebaPala = 10 * time.Second
+
+// arrancarBrokerPrueba crea un broker con un directorio de datos temporal que atiende a los clientes en un
+// puerto libre de 127.0.0.1 y se apaga al terminar la prueba.
+//
+// Retorna:
+// - El broker y la dirección en la que atiende.
+func arrancarBrokerPrueba(t *testing.T) (*Broker, string) {
+	t.Helper()
+	l := NuevoBroker()
+	if err := l.abrirDatos(t.TempDir()); err != nil {
+		t.Fatal("Error al abrir el directorio de datos:", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	direccion := ln.Addr().String()
+	ln.Close()
+	go l.EjecutarBroker(direccion)
+	t.Cleanup(func() { l.Apagar(0) })
+	esperarCondicion(t, "el broker atiende en "+direccion, func() bool {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+		return l.listener != nil
+	})
+	return l, direccion
+}
+
+// esperarCondicion espera hasta `esperaPruebaPala` a que se cumpla la condición descrita.
+func esperarCondicion(t *testing.T, descripcion string, condicion func() bool) {
+	t.Helper()
+	limite := time.Now().Add(esperaPruebaPala)
+	for !condicion() {
+		if time.Now().After(limite) {
+			t.Fatal("No se ha cumplido en", esperaPruebaPala, "la condición:", descripcion)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// declararPrueba declara una cola en el broker o termina la prueba.
+func declararPrueba(t *testing.T, l *Broker, args ArgsDeclararCola) *Cola {
+	t.Helper()
+	if err := l.Declarar_cola(&args, &Reply{}); err != nil {
+		t.Fatal("Error al declarar la cola", args.Nombre+":", err)
+	}
+	cola, _ := l.cola(args.Nombre)
+	return cola
+}
+
+// publicarPrueba publica los mensaje0, mensaje1... en una cola del broker.
+func publicarPrueba(t *testing.T, l *Broker, nombre string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := l.Publicar(&ArgsPublicar{Nombre: nombre, Mensaje: fmt.Sprint("mensaje", i)}, &Reply{}); err != nil {
+			t.Fatal("Error al publicar:", err)
+		}
+	}
+}
+
+// vaciarPrueba consume con confirmación automática los mensajes de una cola del broker y devuelve sus contenidos.
+func vaciarPrueba(t *testing.T, l *Broker, nombre string) []string {
+	t.Helper()
+	var cuerpos []string
+	for {
+		var reply ReplyObtener
+		if err := l.Obtener(&ArgsObtener{Nombre: nombre, AutoAck: true}, &reply); err != nil {
+			t.Fatal("Error al obtener un mensaje de", nombre+":", err)
+		}
+		if reply.Vacia {
+			return cuerpos
+		}
+		cuerpos = append(cuerpos, reply.Mensaje)
+	}
+}
+
+// sinConfirmarPrueba devuelve el número de mensajes de una cola duradera que no se han confirmado en su almacén.
+func sinConfirmarPrueba(cola *Cola) int {
+	cola.mux.Lock()
+	defer cola.mux.Unlock()
+	return len(cola.sinConfirmar)
+}
+
+// palaPrueba devuelve la única pala del broker.
+func palaPrueba(l *Broker) *Pala {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.palas[0]
+}
+
+// TestPalaConfirmaTrasPublicar comprueba que una pala reenvía en orden los mensajes de una cola duradera a
+// otro broker y que los confirma en la cola local después de que el broker remoto los acepte.
+func TestPalaConfirmaTrasPublicar(t *testing.T) {
+	local, _ := arrancarBrokerPrueba(t)
+	remoto, direccion := arrancarBrokerPrueba(t)
+	origen := declararPrueba(t, local, ArgsDeclararCola{Nombre: "origen", Durability: true})
+	publicarPrueba(t, local, "origen", 5)
+	local.iniciarPalas([]ConfiguracionPala{{Nombre: "prueba", Origen: "origen", Destino: direccion, ColaDestino: "destino", Lote: 2}})
+	p := palaPrueba(local)
+	esperarCondicion(t, "la pala transfiere los 5 mensajes", func() bool { return p.transferidos.Load() == 5 })
+	if n := sinConfirmarPrueba(origen); n != 0 {
+		t.Fatal("Quedan", n, "mensajes sin confirmar en la cola local")
+	}
+	recibidos := vaciarPrueba(t, remoto, "destino")
+	esperados := []string{"mensaje0", "mensaje1", "mensaje2", "mensaje3", "mensaje4"}
+	if !slices.Equal(recibidos, esperados) {
+		t.Fatalf("El broker remoto ha recibido %q en lugar de %q", recibidos, esperados)
+	}
+}
+
+// TestPalaConservaRechazados comprueba que los mensajes que el broker remoto rechaza siguen sin confirmar
+// en la cola local tras las reconexiones de la pala, que vuelven a la cola local al detenerla y que se
+// transfieren cuando el broker remoto los acepta.
+func TestPalaConservaRechazados(t *testing.T) {
+	local, _ := arrancarBrokerPrueba(t)
+	remoto, direccion := arrancarBrokerPrueba(t)
+	origen := declararPrueba(t, local, ArgsDeclararCola{Nombre: "origen", Durability: true})
+	declararPrueba(t, remoto, ArgsDeclararCola{Nombre: "destino", MaxMensajes: 2})
+	publicarPrueba(t, local, "origen", 5)
+	config := []ConfiguracionPala{{Nombre: "prueba", Origen: "origen", Destino: direccion, ColaDestino: "destino", Lote: 10}}
+	local.iniciarPalas(config)
+	p := palaPrueba(local)
+
+	// La cola remota solo admite dos mensajes: la pala confirma esos dos y reintenta los demás.
+	esperarCondicion(t, "la pala reconecta tras los rechazos", func() bool { return p.reconexiones.Load() >= 2 })
+	if n := p.transferidos.Load(); n != 2 {
+		t.Fatal("La pala ha transferido", n, "mensajes en lugar de 2")
+	}
+	if n := sinConfirmarPrueba(origen); n != 3 {
+		t.Fatal("Quedan", n, "mensajes sin confirmar en la cola local en lugar de 3")
+	}
+
+	// Al detener la pala, los rechazados vuelven a la cola local sin confirmar.
+	local.detenerPalas()
+	if n := len(origen.mensajes); n != 3 {
+		t.Fatal("La cola local tiene", n, "mensajes tras detener la pala en lugar de 3")
+	}
+	if n := sinConfirmarPrueba(origen); n != 3 {
+		t.Fatal("Quedan", n, "mensajes sin confirmar en la cola local en lugar de 3")
+	}
+
+	// Con sitio en la cola remota, una pala nueva transfiere los devueltos.
+	recibidos := vaciarPrueba(t, remoto, "destino")
+	local.iniciarPalas(config)
+	p = palaPrueba(local)
+	esperarCondicion(t, "la pala transfiere dos de los mensajes devueltos", func() bool { return p.transferidos.Load() == 2 })
+	recibidos = append(recibidos, vaciarPrueba(t, remoto, "destino")...)
+	esperarCondicion(t, "la pala transfiere el último mensaje", func() bool { return p.transferidos.Load() == 3 })
+	recibidos = append(recibidos, vaciarPrueba(t, remoto, "destino")...)
+	if n := sinConfirmarPrueba(origen); n != 0 {
+		t.Fatal("Quedan", n, "mensajes sin confirmar en la cola local")
+	}
+	slices.Sort(recibidos)
+	esperados := []string{"mensaje0", "mensaje1", "mensaje2", "mensaje3", "mensaje4"}
+	if !slices.Equal(recibidos, esperados) {
+		t.Fatalf("El broker remoto ha recibido %q en lugar de %q", recibidos, esperados)
+	}
+}
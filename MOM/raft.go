@@ -0,0 +1,1196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Consenso Raft entre los nodos de un clúster de brokers (ver `Cluster`).
+//
+// Cada nodo guarda un registro de entradas, cada una con una `OperacionReplica`, que el líder del
+// clúster replica en los demás nodos. Una entrada está confirmada cuando la tiene en el disco la mayoría
+// de los nodos; a partir de entonces ningún líder posterior la pierde, aunque falle una minoría de nodos.
+//
+// El algoritmo es el de Raft (Ongaro y Ousterhout, 2014) sin cambios de configuración: los nodos del
+// clúster son fijos. Para que el registro no crezca sin límite, el nodo lo compacta con `compactar`: guarda
+// una instantánea del estado tras aplicar una entrada confirmada, que para Raft son datos opacos, y descarta
+// esa entrada y las anteriores. Los nodos se comunican por RPC en una dirección distinta de la de los clientes:
+//
+//   - PedirVoto: lo llama un candidato para pedir el voto de los demás nodos en una elección.
+//   - AnadirEntradas: lo llama el líder para replicar su registro y, sin entradas, como latido.
+//   - InstalarInstantanea: lo llama el líder para enviar su instantánea a un nodo que necesita entradas
+//     que ya ha descartado.
+//
+// El término y el voto del nodo se guardan en `raft/estado.json`, la instantánea en `raft/instantanea` y
+// el registro en `raft/registro`, todos dentro del directorio de datos. Cada entrada del registro es un
+// registro con su tamaño, su CRC32C y la entrada codificada con gob; al abrirlo se descarta una última
+// entrada escrita a medias. La instantánea se escribe antes de descartar las entradas que contiene, así que
+// al abrir el nodo también se descartan las que quedaron en el registro si se detuvo entre ambos pasos.
+
+// Nombres dentro del directorio de datos del broker.
+const (
+	directorioRaft      = "raft"
+	archivoEstadoRaft   = "estado.json"
+	archivoRegistroRaft = "registro"
+	archivoInstantanea  = "instantanea"
+)
+
+// latidoRaft es el intervalo con que el líder envía latidos a los demás nodos, y el plazo de elección
+// de un nodo que no tiene noticias del líder está entre eleccionMinRaft y eleccionMaxRaft.
+const (
+	latidoRaft      = 100 * time.Millisecond
+	eleccionMinRaft = 500 * time.Millisecond
+	eleccionMaxRaft = 1000 * time.Millisecond
+)
+
+// esperaRPCRaft es el tiempo máximo que se espera la respuesta de otro nodo, y esperaInstantaneaRaft
+// el que se espera la de `InstalarInstantanea`, que envía todo el estado.
+const (
+	esperaRPCRaft         = time.Second
+	esperaInstantaneaRaft = 30 * time.Second
+)
+
+// maxEntradasRaft es el número máximo de entradas que el líder envía en una llamada a `AnadirEntradas`.
+const maxEntradasRaft = 256
+
+// opLiderazgo es la operación con que un líder empieza su término: indica en `Nombre` la dirección de
+// clientes del nodo que lidera las colas del clúster. No modifica las colas.
+const opLiderazgo = "liderazgo"
+
+// errNoLider es el error que se devuelve al proponer una operación en un nodo que no es el líder.
+var errNoLider = errors.New("este nodo no es el líder del clúster")
+
+// errLiderazgoPerdido es el error que se devuelve si el nodo deja de ser el líder antes de confirmar una operación.
+var errLiderazgoPerdido = errors.New("el nodo dejó de ser el líder del clúster antes de confirmar la operación")
+
+// rolRaft es el papel de un nodo en el término actual.
+type rolRaft int
+
+const (
+	seguidorRaft rolRaft = iota
+	candidatoRaft
+	liderRaft
+)
+
+func (r rolRaft) String() string {
+	switch r {
+	case candidatoRaft:
+		return "candidato"
+	case liderRaft:
+		return "líder"
+	}
+	return "seguidor"
+}
+
+// EntradaRaft es una entrada del registro de Raft: una operación y el término en que se añadió.
+// Indice es el índice de la entrada, que se guarda para saber desde qué índice empieza el archivo del
+// registro después de compactarlo; es cero en los registros escritos antes de la compactación, que
+// empiezan siempre en el índice uno.
+type EntradaRaft struct {
+	Termino uint64
+	Op      OperacionReplica
+	Indice  uint64
+}
+
+// instantaneaRaft es el contenido de `raft/instantanea`: el índice y el término de la última entrada
+// que contiene y el estado tras aplicarla. El archivo empieza con el CRC32C de la instantánea codificada con gob.
+type instantaneaRaft struct {
+	Indice  uint64
+	Termino uint64
+	Datos   []byte
+}
+
+// estadoPersistenteRaft es el contenido de `raft/estado.json`: el término actual y el nodo al que se ha votado en él.
+type estadoPersistenteRaft struct {
+	Termino uint64
+	Voto    string
+}
+
+// ArgsPedirVoto representa los argumentos de `PedirVoto`: el término del candidato, su dirección y
+// el índice y el término de la última entrada de su registro.
+type ArgsPedirVoto struct {
+	Termino       uint64
+	Candidato     string
+	UltimoIndice  uint64
+	UltimoTermino uint64
+}
+
+// ReplyPedirVoto representa la respuesta de `PedirVoto`.
+type ReplyPedirVoto struct {
+	Termino   uint64
+	Concedido bool
+}
+
+// ArgsAnadirEntradas representa los argumentos de `AnadirEntradas`.
+//
+// - Termino, Lider: el término y la dirección del líder.
+// - LiderClientes: la dirección en la que el líder atiende a los clientes.
+// - IndiceAnterior, TerminoAnterior: el índice y el término de la entrada anterior a `Entradas`.
+// - Entradas: las entradas a añadir; vacío en los latidos.
+// - Confirmado: el índice de la última entrada confirmada en el líder.
+type ArgsAnadirEntradas struct {
+	Termino         uint64
+	Lider           string
+	LiderClientes   string
+	IndiceAnterior  uint64
+	TerminoAnterior uint64
+	Entradas        []EntradaRaft
+	Confirmado      uint64
+}
+
+// ReplyAnadirEntradas representa la respuesta de `AnadirEntradas`.
+// Si el registro del nodo no coincide con el del líder en la entrada anterior, Exito es falso y
+// Siguiente es el índice desde el que el líder debe volver a enviar entradas.
+type ReplyAnadirEntradas struct {
+	Termino   uint64
+	Exito     bool
+	Siguiente uint64
+}
+
+// ArgsInstalarInstantanea representa los argumentos de `InstalarInstantanea`: el término y las direcciones
+// del líder, como en `ArgsAnadirEntradas`, y su instantánea.
+type ArgsInstalarInstantanea struct {
+	Termino       uint64
+	Lider         string
+	LiderClientes string
+	Instantanea   instantaneaRaft
+}
+
+// ReplyInstalarInstantanea representa la respuesta de `InstalarInstantanea`.
+type ReplyInstalarInstantanea struct {
+	Termino uint64
+}
+
+// EstadoRaft resume el estado de un nodo.
+// Instantanea es el índice de la última entrada de la instantánea del nodo, que ya no está en su registro.
+type EstadoRaft struct {
+	Rol           rolRaft
+	Termino       uint64
+	Ultimo        uint64
+	Confirmado    uint64
+	Instantanea   uint64
+	Lider         string
+	LiderClientes string
+}
+
+// NodoRaft es un nodo de un clúster Raft. Los índices de las entradas empiezan en uno.
+type NodoRaft struct {
+	// mux protege todos los campos salvo `clientes`, que protege `muxClientes`.
+	mux      sync.Mutex
+	id       string
+	pares    []string
+	clientes string
+	dir      string
+
+	// Estado persistente: el término, el voto, el registro y su archivo, con la posición de cada entrada.
+	// base y terminoBase son el índice y el término de la última entrada de la instantánea; el registro
+	// empieza en la entrada siguiente.
+	termino     uint64
+	voto        string
+	registro    []EntradaRaft
+	archivo     *os.File
+	posiciones  []int64
+	tamano      int64
+	base        uint64
+	terminoBase uint64
+	// muxInstantanea se bloquea, antes que `mux`, mientras se guarda una instantánea, para que `base` no
+	// cambie entre tanto.
+	muxInstantanea sync.Mutex
+
+	rol           rolRaft
+	confirmado    uint64
+	lider         string
+	liderClientes string
+	// limiteEleccion es el momento en que el nodo empieza una elección si no tiene noticias del líder.
+	limiteEleccion time.Time
+	// siguiente y coincide son, en el líder, el índice de la siguiente entrada a enviar a cada nodo
+	// y el de la última que se sabe que tiene; persistido es la última que el líder tiene en el disco.
+	siguiente  map[string]uint64
+	coincide   map[string]uint64
+	persistido uint64
+	// cambio se cierra, y se sustituye por otro canal, cuando cambia el término, el rol, el líder o
+	// el índice confirmado, o se añaden entradas.
+	cambio chan struct{}
+	// sincronizar pide al líder que sincronice su registro con el disco.
+	sincronizar chan struct{}
+
+	// muxConexiones protege `conexiones`, las conexiones con los demás nodos, y `entrantes`, las que
+	// los demás nodos han abierto con este.
+	muxConexiones sync.Mutex
+	conexiones    map[string]*rpc.Client
+	entrantes     map[net.Conn]struct{}
+	listener      net.Listener
+	fin           chan struct{}
+}
+
+// ServicioRaft es el servicio RPC "Raft" que un nodo ofrece a los demás.
+type ServicioRaft struct {
+	nodo *NodoRaft
+}
+
+// abrirNodoRaft abre o crea el estado de un nodo Raft.
+//
+// Parámetros:
+// - dir: El directorio del estado del nodo. Se crea si no existe.
+// - id: La dirección en la que el nodo atiende a los demás nodos, que lo identifica en el clúster.
+// - pares: Las direcciones de los demás nodos.
+// - clientes: La dirección en la que el nodo atiende a los clientes cuando es líder.
+//
+// Retorna:
+// - El nodo, que no participa en el clúster hasta que se llama a `iniciar`.
+// - Un error si el estado no se puede leer o no es válido.
+func abrirNodoRaft(dir, id string, pares []string, clientes string) (*NodoRaft, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	n := &NodoRaft{
+		id:          id,
+		pares:       pares,
+		clientes:    clientes,
+		dir:         dir,
+		siguiente:   make(map[string]uint64),
+		coincide:    make(map[string]uint64),
+		cambio:      make(chan struct{}),
+		sincronizar: make(chan struct{}, 1),
+		conexiones:  make(map[string]*rpc.Client),
+		entrantes:   make(map[net.Conn]struct{}),
+		fin:         make(chan struct{}),
+	}
+	datos, err := os.ReadFile(filepath.Join(dir, archivoEstadoRaft))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var estado estadoPersistenteRaft
+		if err := json.Unmarshal(datos, &estado); err != nil {
+			return nil, fmt.Errorf("estado de Raft no válido: %w", err)
+		}
+		n.termino, n.voto = estado.Termino, estado.Voto
+	}
+	n.archivo, err = os.OpenFile(filepath.Join(dir, archivoRegistroRaft), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.leerRegistro(); err != nil {
+		n.archivo.Close()
+		return nil, err
+	}
+	if err := n.abrirInstantanea(); err != nil {
+		n.archivo.Close()
+		return nil, err
+	}
+	n.confirmado = n.base
+	n.reiniciarEleccion()
+	return n, nil
+}
+
+// leerRegistro carga las entradas del archivo del registro y descarta una última entrada incompleta o dañada.
+func (n *NodoRaft) leerRegistro() error {
+	info, err := n.archivo.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := n.archivo.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	lector := bufio.NewReader(n.archivo)
+	cabecera := make([]byte, 8)
+	var pos int64
+	for info.Size()-pos >= 8 {
+		if _, err := io.ReadFull(lector, cabecera); err != nil {
+			return err
+		}
+		tam := int64(binary.BigEndian.Uint32(cabecera))
+		if info.Size()-pos-8 < tam {
+			break
+		}
+		cuerpo := make([]byte, tam)
+		if _, err := io.ReadFull(lector, cuerpo); err != nil {
+			return err
+		}
+		if crc32.Checksum(cuerpo, tablaCRC) != binary.BigEndian.Uint32(cabecera[4:]) {
+			break
+		}
+		var entrada EntradaRaft
+		if err := gob.NewDecoder(bytes.NewReader(cuerpo)).Decode(&entrada); err != nil {
+			return fmt.Errorf("entrada %d del registro de Raft no válida: %w", n.base+uint64(len(n.registro))+1, err)
+		}
+		// La primera entrada indica desde qué índice empieza el archivo.
+		if len(n.registro) == 0 && entrada.Indice > 0 {
+			n.base = entrada.Indice - 1
+		}
+		if indice := n.base + uint64(len(n.registro)) + 1; entrada.Indice != 0 && entrada.Indice != indice {
+			return fmt.Errorf("la entrada %d del registro de Raft tiene el índice %d", indice, entrada.Indice)
+		}
+		n.registro = append(n.registro, entrada)
+		n.posiciones = append(n.posiciones, pos)
+		pos += 8 + tam
+	}
+	if pos < info.Size() {
+		fmt.Println("Descartando", info.Size()-pos, "bytes incompletos al final del registro de Raft")
+		if err := n.archivo.Truncate(pos); err != nil {
+			return err
+		}
+	}
+	n.tamano = pos
+	return nil
+}
+
+// abrirInstantanea lee el índice y el término de la instantánea, si la hay, y descarta del registro las
+// entradas que contiene. Debe llamarse después de `leerRegistro`.
+func (n *NodoRaft) abrirInstantanea() error {
+	instantanea, err := n.instantanea()
+	if err != nil {
+		return err
+	}
+	if instantanea.Indice < n.base {
+		return fmt.Errorf("el registro de Raft empieza en la entrada %d pero la instantánea termina en la %d", n.base+1, instantanea.Indice)
+	}
+	if instantanea.Indice == n.base {
+		n.terminoBase = instantanea.Termino
+		return nil
+	}
+	return n.descartarHasta(instantanea.Indice, instantanea.Termino)
+}
+
+// instantanea lee la instantánea del nodo; si no tiene, devuelve una instantánea vacía con índice cero.
+// Se puede llamar sin bloquear `n.mux`: el archivo se sustituye de forma atómica.
+func (n *NodoRaft) instantanea() (instantaneaRaft, error) {
+	var instantanea instantaneaRaft
+	datos, err := os.ReadFile(filepath.Join(n.dir, archivoInstantanea))
+	if os.IsNotExist(err) {
+		return instantanea, nil
+	}
+	if err != nil {
+		return instantanea, err
+	}
+	if len(datos) < 4 || crc32.Checksum(datos[4:], tablaCRC) != binary.BigEndian.Uint32(datos) {
+		return instantanea, errors.New("la instantánea de Raft está dañada")
+	}
+	if err := gob.NewDecoder(bytes.NewReader(datos[4:])).Decode(&instantanea); err != nil {
+		return instantanea, fmt.Errorf("instantánea de Raft no válida: %w", err)
+	}
+	return instantanea, nil
+}
+
+// guardarInstantanea sustituye la instantánea del nodo. Debe llamarse con `n.muxInstantanea` bloqueado
+// y sin bloquear `n.mux`, porque escribe todo el estado en el disco.
+func (n *NodoRaft) guardarInstantanea(instantanea instantaneaRaft) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&buf).Encode(instantanea); err != nil {
+		return err
+	}
+	datos := buf.Bytes()
+	binary.BigEndian.PutUint32(datos, crc32.Checksum(datos[4:], tablaCRC))
+	return escribirAtomico(filepath.Join(n.dir, archivoInstantanea), datos)
+}
+
+// descartarHasta descarta del registro las entradas hasta el índice especificado, que ya están en la
+// instantánea, y reescribe el archivo del registro con las siguientes. Si el registro no tiene la entrada
+// con ese índice y término, la instantánea no es un prefijo del registro y se descartan todas.
+// Debe llamarse con `n.mux` bloqueado y con un índice mayor que `n.base`.
+func (n *NodoRaft) descartarHasta(indice, termino uint64) error {
+	ultimo, _ := n.ultimo()
+	conservar := len(n.registro)
+	if indice <= ultimo && n.terminoEn(indice) == termino {
+		conservar = int(indice - n.base)
+	}
+	inicio := n.tamano
+	if conservar < len(n.registro) {
+		inicio = n.posiciones[conservar]
+	}
+	resto := make([]byte, n.tamano-inicio)
+	if _, err := n.archivo.ReadAt(resto, inicio); err != nil {
+		return err
+	}
+	ruta := filepath.Join(n.dir, archivoRegistroRaft)
+	if err := escribirAtomico(ruta, resto); err != nil {
+		return err
+	}
+	archivo, err := os.OpenFile(ruta, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	n.archivo.Close()
+	n.archivo = archivo
+	n.registro = append([]EntradaRaft(nil), n.registro[conservar:]...)
+	posiciones := make([]int64, 0, len(n.registro))
+	for _, pos := range n.posiciones[conservar:] {
+		posiciones = append(posiciones, pos-inicio)
+	}
+	n.posiciones = posiciones
+	n.tamano -= inicio
+	n.base, n.terminoBase = indice, termino
+	// El archivo nuevo ya está sincronizado con el disco.
+	if n.rol == liderRaft {
+		n.persistido, _ = n.ultimo()
+		n.avanzarConfirmado()
+	}
+	return nil
+}
+
+// compactar guarda una instantánea del estado tras aplicar la entrada confirmada con el índice especificado
+// y descarta esa entrada y las anteriores del registro. No hace nada si la instantánea del nodo ya la contiene.
+//
+// Parámetros:
+// - indice: El índice de la última entrada aplicada al estado, que debe estar confirmada.
+// - termino: El término de esa entrada.
+// - datos: El estado codificado.
+//
+// Retorna:
+// - Un error si no se puede guardar la instantánea o reescribir el registro.
+func (n *NodoRaft) compactar(indice, termino uint64, datos []byte) error {
+	n.muxInstantanea.Lock()
+	defer n.muxInstantanea.Unlock()
+	n.mux.Lock()
+	base, confirmado := n.base, n.confirmado
+	n.mux.Unlock()
+	if indice <= base || indice > confirmado {
+		return nil
+	}
+	if err := n.guardarInstantanea(instantaneaRaft{Indice: indice, Termino: termino, Datos: datos}); err != nil {
+		return err
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if err := n.descartarHasta(indice, termino); err != nil {
+		return err
+	}
+	fmt.Println("Registro de Raft compactado hasta la entrada", indice)
+	return nil
+}
+
+// escribir añade entradas al final del registro, sin sincronizarlo con el disco. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) escribir(entradas []EntradaRaft) error {
+	var buf bytes.Buffer
+	ultimo, _ := n.ultimo()
+	entradas = append([]EntradaRaft(nil), entradas...)
+	posiciones := make([]int64, 0, len(entradas))
+	for i := range entradas {
+		entradas[i].Indice = ultimo + 1 + uint64(i)
+		entrada := entradas[i]
+		var cuerpo bytes.Buffer
+		if err := gob.NewEncoder(&cuerpo).Encode(entrada); err != nil {
+			return err
+		}
+		posiciones = append(posiciones, n.tamano+int64(buf.Len()))
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(cuerpo.Len())))
+		buf.Write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(cuerpo.Bytes(), tablaCRC)))
+		buf.Write(cuerpo.Bytes())
+	}
+	if _, err := n.archivo.Write(buf.Bytes()); err != nil {
+		// Una escritura a medias se descarta para que el archivo siga coincidiendo con el registro.
+		n.archivo.Truncate(n.tamano)
+		return err
+	}
+	n.tamano += int64(buf.Len())
+	n.registro = append(n.registro, entradas...)
+	n.posiciones = append(n.posiciones, posiciones...)
+	return nil
+}
+
+// truncar descarta las entradas desde el índice especificado. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) truncar(indice uint64) error {
+	i := indice - n.base - 1
+	pos := n.posiciones[i]
+	if err := n.archivo.Truncate(pos); err != nil {
+		return err
+	}
+	n.tamano = pos
+	n.registro = n.registro[:i]
+	n.posiciones = n.posiciones[:i]
+	return nil
+}
+
+// guardarEstado guarda el término y el voto. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) guardarEstado() error {
+	datos, err := json.Marshal(estadoPersistenteRaft{Termino: n.termino, Voto: n.voto})
+	if err != nil {
+		return err
+	}
+	return escribirAtomico(filepath.Join(n.dir, archivoEstadoRaft), append(datos, '\n'))
+}
+
+// ultimo devuelve el índice y el término de la última entrada del registro, o de la instantánea si el
+// registro está vacío. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) ultimo() (uint64, uint64) {
+	if len(n.registro) == 0 {
+		return n.base, n.terminoBase
+	}
+	return n.base + uint64(len(n.registro)), n.registro[len(n.registro)-1].Termino
+}
+
+// terminoEn devuelve el término de la entrada con el índice especificado, que no puede ser anterior a la
+// última de la instantánea, o cero si el índice es cero. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) terminoEn(indice uint64) uint64 {
+	if indice == n.base {
+		return n.terminoBase
+	}
+	return n.registro[indice-n.base-1].Termino
+}
+
+// avisar despierta a quienes esperan un cambio en el nodo. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) avisar() {
+	close(n.cambio)
+	n.cambio = make(chan struct{})
+}
+
+// reiniciarEleccion aplaza la siguiente elección un tiempo aleatorio. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) reiniciarEleccion() {
+	n.limiteEleccion = time.Now().Add(eleccionMinRaft + time.Duration(rand.Int63n(int64(eleccionMaxRaft-eleccionMinRaft))))
+}
+
+// mayoria indica si el número de nodos especificado es mayoría en el clúster.
+func (n *NodoRaft) mayoria(nodos int) bool {
+	return nodos > (len(n.pares)+1)/2
+}
+
+// pasarASeguidor convierte al nodo en seguidor en el término especificado, si es mayor que el actual,
+// o en el actual. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) pasarASeguidor(termino uint64) {
+	if termino > n.termino {
+		n.termino = termino
+		n.voto = ""
+		n.lider, n.liderClientes = "", ""
+		if err := n.guardarEstado(); err != nil {
+			fmt.Println("Error al guardar el estado de Raft:", err)
+		}
+	}
+	if n.rol != seguidorRaft {
+		fmt.Println("Nodo", n.id, "seguidor en el término", n.termino)
+	}
+	n.rol = seguidorRaft
+	n.avisar()
+}
+
+// iniciar empieza a atender a los demás nodos en el listener especificado y a participar en las elecciones.
+func (n *NodoRaft) iniciar(ln net.Listener) error {
+	servidor := rpc.NewServer()
+	if err := servidor.RegisterName("Raft", &ServicioRaft{nodo: n}); err != nil {
+		return err
+	}
+	n.mux.Lock()
+	n.listener = ln
+	n.mux.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-n.fin:
+					return
+				default:
+				}
+				fmt.Println("Error al aceptar la conexión de Raft:", err)
+				continue
+			}
+			n.muxConexiones.Lock()
+			select {
+			case <-n.fin:
+				n.muxConexiones.Unlock()
+				conn.Close()
+				return
+			default:
+			}
+			n.entrantes[conn] = struct{}{}
+			n.muxConexiones.Unlock()
+			go func() {
+				servidor.ServeConn(conn)
+				n.muxConexiones.Lock()
+				delete(n.entrantes, conn)
+				n.muxConexiones.Unlock()
+			}()
+		}
+	}()
+	go n.temporizar()
+	go n.persistir()
+	return nil
+}
+
+// detener deja de participar en el clúster, cierra sus conexiones con los demás nodos, incluidas las que
+// ellos abrieron, y cierra el registro.
+func (n *NodoRaft) detener() {
+	n.mux.Lock()
+	close(n.fin)
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	n.rol = seguidorRaft
+	n.avisar()
+	n.archivo.Close()
+	n.mux.Unlock()
+	n.muxConexiones.Lock()
+	defer n.muxConexiones.Unlock()
+	for par, cliente := range n.conexiones {
+		cliente.Close()
+		delete(n.conexiones, par)
+	}
+	for conn := range n.entrantes {
+		conn.Close()
+		delete(n.entrantes, conn)
+	}
+}
+
+// temporizar empieza una elección cada vez que vence el plazo de elección sin noticias del líder.
+func (n *NodoRaft) temporizar() {
+	ticker := time.NewTicker(latidoRaft / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.fin:
+			return
+		case <-ticker.C:
+		}
+		n.mux.Lock()
+		if n.rol != liderRaft && time.Now().After(n.limiteEleccion) {
+			n.empezarEleccion()
+		}
+		n.mux.Unlock()
+	}
+}
+
+// empezarEleccion presenta al nodo como candidato en un nuevo término. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) empezarEleccion() {
+	n.termino++
+	n.rol = candidatoRaft
+	n.voto = n.id
+	n.lider, n.liderClientes = "", ""
+	n.reiniciarEleccion()
+	n.avisar()
+	if err := n.guardarEstado(); err != nil {
+		fmt.Println("Error al guardar el estado de Raft:", err)
+		return
+	}
+	termino := n.termino
+	ultimoIndice, ultimoTermino := n.ultimo()
+	args := ArgsPedirVoto{Termino: termino, Candidato: n.id, UltimoIndice: ultimoIndice, UltimoTermino: ultimoTermino}
+	votos := 1
+	if n.mayoria(votos) {
+		n.convertirEnLider()
+		return
+	}
+	for _, par := range n.pares {
+		go func(par string) {
+			var reply ReplyPedirVoto
+			if err := n.llamar(par, "Raft.PedirVoto", &args, &reply); err != nil {
+				return
+			}
+			n.mux.Lock()
+			defer n.mux.Unlock()
+			if reply.Termino > n.termino {
+				n.pasarASeguidor(reply.Termino)
+				return
+			}
+			if !reply.Concedido || n.rol != candidatoRaft || n.termino != termino {
+				return
+			}
+			votos++
+			if n.mayoria(votos) {
+				n.convertirEnLider()
+			}
+		}(par)
+	}
+}
+
+// convertirEnLider convierte al candidato en líder: añade al registro la entrada `opLiderazgo` del término
+// y empieza a replicarlo en los demás nodos. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) convertirEnLider() {
+	n.rol = liderRaft
+	n.lider, n.liderClientes = n.id, n.clientes
+	ultimo, _ := n.ultimo()
+	for _, par := range n.pares {
+		n.siguiente[par] = ultimo + 1
+		n.coincide[par] = 0
+	}
+	n.persistido = 0
+	fmt.Println("Nodo", n.id, "líder en el término", n.termino)
+	if err := n.escribir([]EntradaRaft{{Termino: n.termino, Op: OperacionReplica{Tipo: opLiderazgo, Nombre: n.clientes}}}); err != nil {
+		fmt.Println("Error al escribir en el registro de Raft:", err)
+	}
+	n.pedirSincronizacion()
+	n.avisar()
+	for _, par := range n.pares {
+		go n.replicar(par, n.termino)
+	}
+}
+
+// pedirSincronizacion pide que el registro del líder se sincronice con el disco. Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) pedirSincronizacion() {
+	select {
+	case n.sincronizar <- struct{}{}:
+	default:
+	}
+}
+
+// persistir sincroniza con el disco el registro del líder cada vez que se pide, agrupando las entradas
+// añadidas mientras tanto, y cuenta las sincronizadas para confirmarlas.
+func (n *NodoRaft) persistir() {
+	for {
+		select {
+		case <-n.fin:
+			return
+		case <-n.sincronizar:
+		}
+		n.mux.Lock()
+		hasta, _ := n.ultimo()
+		termino := n.termino
+		archivo := n.archivo
+		n.mux.Unlock()
+		err := archivo.Sync()
+		n.mux.Lock()
+		switch {
+		case archivo != n.archivo:
+			// El registro se ha compactado mientras tanto y el archivo nuevo ya está sincronizado.
+		case err != nil:
+			fmt.Println("Error al sincronizar el registro de Raft:", err)
+		case n.rol == liderRaft && n.termino == termino && hasta > n.persistido:
+			n.persistido = hasta
+			n.avanzarConfirmado()
+		}
+		n.mux.Unlock()
+	}
+}
+
+// avanzarConfirmado confirma las entradas del término actual que tiene la mayoría de los nodos y las anteriores.
+// Debe llamarse con `n.mux` bloqueado.
+func (n *NodoRaft) avanzarConfirmado() {
+	ultimo, _ := n.ultimo()
+	for indice := ultimo; indice > n.confirmado; indice-- {
+		// Las entradas de términos anteriores solo se confirman junto con una del término actual.
+		if n.terminoEn(indice) != n.termino {
+			return
+		}
+		nodos := 0
+		if n.persistido >= indice {
+			nodos++
+		}
+		for _, par := range n.pares {
+			if n.coincide[par] >= indice {
+				nodos++
+			}
+		}
+		if n.mayoria(nodos) {
+			n.confirmado = indice
+			n.avisar()
+			return
+		}
+	}
+}
+
+// replicar envía al nodo especificado las entradas que le faltan, o latidos si no le falta ninguna,
+// mientras el nodo sea líder en el término especificado. Si le faltan entradas que ya se han descartado
+// al compactar el registro, le envía la instantánea.
+func (n *NodoRaft) replicar(par string, termino uint64) {
+	for {
+		n.mux.Lock()
+		if n.rol != liderRaft || n.termino != termino {
+			n.mux.Unlock()
+			return
+		}
+		cambio := n.cambio
+		if n.siguiente[par] <= n.base {
+			n.mux.Unlock()
+			pendiente, err := n.enviarInstantanea(par, termino)
+			if pendiente {
+				continue
+			}
+			if err != nil {
+				cambio = nil
+			}
+			select {
+			case <-n.fin:
+				return
+			case <-cambio:
+			case <-time.After(latidoRaft):
+			}
+			continue
+		}
+		siguiente := n.siguiente[par]
+		ultimo, _ := n.ultimo()
+		hasta := min(ultimo, siguiente-1+maxEntradasRaft)
+		args := ArgsAnadirEntradas{
+			Termino:         termino,
+			Lider:           n.id,
+			LiderClientes:   n.clientes,
+			IndiceAnterior:  siguiente - 1,
+			TerminoAnterior: n.terminoEn(siguiente - 1),
+			Entradas:        append([]EntradaRaft(nil), n.registro[siguiente-n.base-1:hasta-n.base]...),
+			Confirmado:      n.confirmado,
+		}
+		n.mux.Unlock()
+
+		var reply ReplyAnadirEntradas
+		err := n.llamar(par, "Raft.AnadirEntradas", &args, &reply)
+		pendiente := false
+		if err == nil {
+			n.mux.Lock()
+			if reply.Termino > n.termino {
+				n.pasarASeguidor(reply.Termino)
+			} else if n.rol == liderRaft && n.termino == termino {
+				if reply.Exito {
+					n.coincide[par] = max(n.coincide[par], args.IndiceAnterior+uint64(len(args.Entradas)))
+					n.siguiente[par] = n.coincide[par] + 1
+					n.avanzarConfirmado()
+				} else {
+					n.siguiente[par] = max(1, min(reply.Siguiente, siguiente-1))
+				}
+				ultimo, _ := n.ultimo()
+				pendiente = n.siguiente[par] <= ultimo
+			}
+			n.mux.Unlock()
+		}
+		if pendiente {
+			continue
+		}
+		// Un nodo que no responde no se vuelve a intentar hasta el siguiente latido.
+		if err != nil {
+			cambio = nil
+		}
+		select {
+		case <-n.fin:
+			return
+		case <-cambio:
+		case <-time.After(latidoRaft):
+		}
+	}
+}
+
+// enviarInstantanea envía la instantánea del líder al nodo especificado, si el nodo sigue siendo líder
+// en el término especificado.
+//
+// Retorna:
+// - Verdadero si al nodo todavía le faltan entradas del registro después de la instantánea.
+// - Un error si no se puede leer la instantánea, que también se muestra, o el nodo no responde.
+func (n *NodoRaft) enviarInstantanea(par string, termino uint64) (bool, error) {
+	instantanea, err := n.instantanea()
+	if err != nil {
+		fmt.Println("Error al leer la instantánea de Raft:", err)
+		return false, err
+	}
+	args := ArgsInstalarInstantanea{Termino: termino, Lider: n.id, LiderClientes: n.clientes, Instantanea: instantanea}
+	var reply ReplyInstalarInstantanea
+	if err := n.llamarDurante(par, "Raft.InstalarInstantanea", &args, &reply, esperaInstantaneaRaft); err != nil {
+		return false, err
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if reply.Termino > n.termino {
+		n.pasarASeguidor(reply.Termino)
+		return false, nil
+	}
+	if n.rol != liderRaft || n.termino != termino {
+		return false, nil
+	}
+	n.coincide[par] = max(n.coincide[par], instantanea.Indice)
+	n.siguiente[par] = n.coincide[par] + 1
+	n.avanzarConfirmado()
+	ultimo, _ := n.ultimo()
+	return n.siguiente[par] <= ultimo, nil
+}
+
+// llamar hace una llamada RPC a otro nodo, con un plazo de `esperaRPCRaft`.
+func (n *NodoRaft) llamar(par, metodo string, args, reply any) error {
+	return n.llamarDurante(par, metodo, args, reply, esperaRPCRaft)
+}
+
+// llamarDurante hace una llamada RPC a otro nodo con el plazo especificado.
+func (n *NodoRaft) llamarDurante(par, metodo string, args, reply any, plazo time.Duration) error {
+	n.muxConexiones.Lock()
+	cliente, ok := n.conexiones[par]
+	n.muxConexiones.Unlock()
+	if !ok {
+		conn, err := net.DialTimeout("tcp", par, esperaRPCRaft)
+		if err != nil {
+			return err
+		}
+		cliente = rpc.NewClient(conn)
+		n.muxConexiones.Lock()
+		if anterior, ok := n.conexiones[par]; ok {
+			cliente.Close()
+			cliente = anterior
+		} else {
+			n.conexiones[par] = cliente
+		}
+		n.muxConexiones.Unlock()
+	}
+	llamada := cliente.Go(metodo, args, reply, nil)
+	timer := time.NewTimer(plazo)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-llamada.Done:
+		err = llamada.Error
+	case <-timer.C:
+		err = fmt.Errorf("el nodo %s no responde a %s", par, metodo)
+	case <-n.fin:
+		err = errors.New("nodo detenido")
+	}
+	// Tras un error de la conexión se abre otra en la siguiente llamada.
+	var errServidor rpc.ServerError
+	if err != nil && !errors.As(err, &errServidor) {
+		n.muxConexiones.Lock()
+		if n.conexiones[par] == cliente {
+			delete(n.conexiones, par)
+		}
+		n.muxConexiones.Unlock()
+		cliente.Close()
+	}
+	return err
+}
+
+// PedirVoto es un método RPC con el que un candidato pide el voto del nodo.
+//
+// Comportamiento:
+// - Concede el voto si el nodo no ha votado a otro candidato en el término y el registro del candidato está al menos tan actualizado como el suyo.
+func (s *ServicioRaft) PedirVoto(args *ArgsPedirVoto, reply *ReplyPedirVoto) error {
+	n := s.nodo
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if args.Termino > n.termino {
+		n.pasarASeguidor(args.Termino)
+	}
+	reply.Termino = n.termino
+	if args.Termino < n.termino || (n.voto != "" && n.voto != args.Candidato) {
+		return nil
+	}
+	ultimoIndice, ultimoTermino := n.ultimo()
+	if args.UltimoTermino < ultimoTermino || (args.UltimoTermino == ultimoTermino && args.UltimoIndice < ultimoIndice) {
+		return nil
+	}
+	n.voto = args.Candidato
+	if err := n.guardarEstado(); err != nil {
+		return err
+	}
+	n.reiniciarEleccion()
+	reply.Concedido = true
+	return nil
+}
+
+// AnadirEntradas es un método RPC con el que el líder replica su registro en el nodo.
+//
+// Comportamiento:
+// - Rechaza las llamadas de un término anterior al del nodo.
+// - Ignora las entradas recibidas que están en la instantánea del nodo, que ya están confirmadas.
+// - Si el registro del nodo no tiene la entrada anterior a las recibidas, devuelve `reply.Exito` a falso.
+// - Descarta las entradas que no coinciden con las recibidas y las siguientes, añade las que faltan y las sincroniza con el disco antes de responder.
+// - Confirma las entradas que el líder ha confirmado.
+func (s *ServicioRaft) AnadirEntradas(args *ArgsAnadirEntradas, reply *ReplyAnadirEntradas) error {
+	n := s.nodo
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if args.Termino < n.termino {
+		reply.Termino = n.termino
+		return nil
+	}
+	if args.Termino > n.termino || n.rol != seguidorRaft {
+		n.pasarASeguidor(args.Termino)
+	}
+	reply.Termino = n.termino
+	n.reiniciarEleccion()
+	if n.lider != args.Lider || n.liderClientes != args.LiderClientes {
+		n.lider, n.liderClientes = args.Lider, args.LiderClientes
+		n.avisar()
+	}
+	ultimo, _ := n.ultimo()
+	if args.IndiceAnterior > ultimo {
+		reply.Siguiente = ultimo + 1
+		return nil
+	}
+	anterior, terminoAnterior, entradas := args.IndiceAnterior, args.TerminoAnterior, args.Entradas
+	if anterior < n.base {
+		saltar := min(n.base-anterior, uint64(len(entradas)))
+		if saltar > 0 {
+			terminoAnterior = entradas[saltar-1].Termino
+		}
+		anterior += saltar
+		entradas = entradas[saltar:]
+	}
+	if anterior >= n.base {
+		if termino := n.terminoEn(anterior); termino != terminoAnterior {
+			// El líder vuelve a enviar todo el término en conflicto en lugar de retroceder de una en una.
+			indice := anterior
+			for indice > n.base+1 && n.terminoEn(indice-1) == termino {
+				indice--
+			}
+			reply.Siguiente = indice
+			return nil
+		}
+	}
+	for i, entrada := range entradas {
+		indice := anterior + 1 + uint64(i)
+		if indice <= ultimo {
+			if n.terminoEn(indice) == entrada.Termino {
+				continue
+			}
+			if err := n.truncar(indice); err != nil {
+				return err
+			}
+		}
+		if err := n.escribir(entradas[i:]); err != nil {
+			return err
+		}
+		if err := n.archivo.Sync(); err != nil {
+			return err
+		}
+		n.avisar()
+		break
+	}
+	if confirmado := min(args.Confirmado, args.IndiceAnterior+uint64(len(args.Entradas))); confirmado > n.confirmado {
+		n.confirmado = confirmado
+		n.avisar()
+	}
+	reply.Exito = true
+	return nil
+}
+
+// InstalarInstantanea es un método RPC con el que el líder envía su instantánea a un nodo al que le faltan
+// entradas que el líder ya ha descartado de su registro.
+//
+// Comportamiento:
+// - Rechaza las llamadas de un término anterior al del nodo y no hace nada si la instantánea del nodo ya contiene la recibida.
+// - Guarda la instantánea y descarta del registro las entradas que contiene; si el registro no tiene la última de ellas, lo descarta entero.
+// - Confirma las entradas de la instantánea, que el broker aplica cargándola.
+func (s *ServicioRaft) InstalarInstantanea(args *ArgsInstalarInstantanea, reply *ReplyInstalarInstantanea) error {
+	n := s.nodo
+	n.muxInstantanea.Lock()
+	defer n.muxInstantanea.Unlock()
+	n.mux.Lock()
+	if args.Termino < n.termino {
+		reply.Termino = n.termino
+		n.mux.Unlock()
+		return nil
+	}
+	if args.Termino > n.termino || n.rol != seguidorRaft {
+		n.pasarASeguidor(args.Termino)
+	}
+	reply.Termino = n.termino
+	n.reiniciarEleccion()
+	if n.lider != args.Lider || n.liderClientes != args.LiderClientes {
+		n.lider, n.liderClientes = args.Lider, args.LiderClientes
+		n.avisar()
+	}
+	base := n.base
+	n.mux.Unlock()
+	if args.Instantanea.Indice <= base {
+		return nil
+	}
+	// Las entradas de una instantánea están confirmadas, así que se puede guardar aunque cambie el término mientras tanto.
+	if err := n.guardarInstantanea(args.Instantanea); err != nil {
+		return err
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if err := n.descartarHasta(args.Instantanea.Indice, args.Instantanea.Termino); err != nil {
+		return err
+	}
+	n.confirmado = max(n.confirmado, args.Instantanea.Indice)
+	n.reiniciarEleccion()
+	n.avisar()
+	fmt.Println("Instantánea del líder instalada hasta la entrada", args.Instantanea.Indice)
+	return nil
+}
+
+// proponer añade una operación al registro del líder para replicarla.
+//
+// Parámetros:
+// - op: La operación.
+// - termino: El término en que el nodo debe ser líder; si ya no lo es, la operación no se añade.
+//
+// Retorna:
+// - El índice de la entrada añadida, o un error si el nodo no es líder en el término o no se puede escribir el registro.
+func (n *NodoRaft) proponer(op OperacionReplica, termino uint64) (uint64, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.rol != liderRaft || n.termino != termino {
+		return 0, errNoLider
+	}
+	if err := n.escribir([]EntradaRaft{{Termino: termino, Op: op}}); err != nil {
+		// Un líder que no puede escribir su registro deja de serlo, de modo que el broker descarta las
+		// operaciones que ya ha aplicado sin proponerlas y reconstruye sus colas desde el registro.
+		fmt.Println("Error al escribir el registro de Raft:", err)
+		n.pasarASeguidor(n.termino)
+		n.reiniciarEleccion()
+		return 0, err
+	}
+	n.pedirSincronizacion()
+	n.avisar()
+	indice, _ := n.ultimo()
+	return indice, nil
+}
+
+// esperarConfirmado espera a que se confirme la entrada del registro del líder con el índice especificado.
+//
+// Parámetros:
+// - termino: El término en que el nodo debe seguir siendo líder.
+// - indice: El índice de la entrada, devuelto por `proponer` en el término.
+// - plazo: El tiempo máximo de espera.
+//
+// Retorna:
+// - Un error si el nodo deja de ser líder en el término, vence el plazo o se detiene el nodo.
+func (n *NodoRaft) esperarConfirmado(termino, indice uint64, plazo time.Duration) error {
+	timer := time.NewTimer(plazo)
+	defer timer.Stop()
+	n.mux.Lock()
+	for {
+		if n.rol != liderRaft || n.termino != termino {
+			n.mux.Unlock()
+			return errLiderazgoPerdido
+		}
+		if n.confirmado >= indice {
+			n.mux.Unlock()
+			return nil
+		}
+		cambio := n.cambio
+		n.mux.Unlock()
+		select {
+		case <-cambio:
+		case <-timer.C:
+			return fmt.Errorf("la operación no se ha confirmado en el clúster en %v", plazo)
+		case <-n.fin:
+			return errApagando
+		}
+		n.mux.Lock()
+	}
+}
+
+// estado devuelve el estado del nodo y un canal que se cierra cuando cambia.
+func (n *NodoRaft) estado() (EstadoRaft, <-chan struct{}) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	ultimo, _ := n.ultimo()
+	return EstadoRaft{
+		Rol:           n.rol,
+		Termino:       n.termino,
+		Ultimo:        ultimo,
+		Confirmado:    n.confirmado,
+		Instantanea:   n.base,
+		Lider:         n.lider,
+		LiderClientes: n.liderClientes,
+	}, n.cambio
+}
+
+// entradas devuelve una copia de las entradas entre los índices especificados, ambos incluidos, o nil si
+// alguna ya se ha descartado al compactar el registro.
+func (n *NodoRaft) entradas(desde, hasta uint64) []EntradaRaft {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if desde <= n.base {
+		return nil
+	}
+	return append([]EntradaRaft(nil), n.registro[desde-n.base-1:hasta-n.base]...)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// esperaPruebaRaft es el tiempo máximo que las pruebas de Raft esperan a que el clúster llegue a un estado.
+const esperaPruebaRaft = 10 * time.Second
+
+// nodoPruebaRaft es un nodo de un clúster de prueba que atiende en 127.0.0.1.
+type nodoPruebaRaft struct {
+	*NodoRaft
+	dir     string
+	activo  bool
+	cluster *clusterPruebaRaft
+}
+
+// clusterPruebaRaft es un clúster Raft de prueba cuyos nodos se detienen al terminar la prueba.
+type clusterPruebaRaft struct {
+	t     *testing.T
+	nodos []*nodoPruebaRaft
+	ids   []string
+}
+
+// arrancarClusterRaft arranca un clúster de n nodos, cada uno con su directorio y un puerto libre de 127.0.0.1.
+func arrancarClusterRaft(t *testing.T, n int) *clusterPruebaRaft {
+	t.Helper()
+	c := &clusterPruebaRaft{t: t}
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = ln
+		c.ids = append(c.ids, ln.Addr().String())
+	}
+	for _, ln := range listeners {
+		nodo := &nodoPruebaRaft{dir: t.TempDir(), cluster: c}
+		c.nodos = append(c.nodos, nodo)
+		nodo.arrancar(ln)
+	}
+	t.Cleanup(func() {
+		for _, nodo := range c.nodos {
+			if nodo.activo {
+				nodo.detener()
+			}
+		}
+	})
+	return c
+}
+
+// arrancar abre el estado del nodo y lo inicia en el listener especificado, o en su dirección si es nil.
+func (nodo *nodoPruebaRaft) arrancar(ln net.Listener) {
+	c := nodo.cluster
+	c.t.Helper()
+	i := slices.Index(c.nodos, nodo)
+	id := c.ids[i]
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", id); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	pares := slices.Delete(slices.Clone(c.ids), i, i+1)
+	n, err := abrirNodoRaft(nodo.dir, id, pares, "clientes-"+id)
+	if err != nil {
+		ln.Close()
+		c.t.Fatal("Error al abrir el nodo", id+":", err)
+	}
+	if err := n.iniciar(ln); err != nil {
+		ln.Close()
+		c.t.Fatal("Error al iniciar el nodo", id+":", err)
+	}
+	nodo.NodoRaft, nodo.activo = n, true
+}
+
+// detener detiene el nodo, como si se cayera.
+func (nodo *nodoPruebaRaft) detener() {
+	nodo.NodoRaft.detener()
+	nodo.activo = false
+}
+
+// esperarLider espera a que todos los nodos activos reconozcan al mismo líder en el mismo término y lo devuelve.
+func (c *clusterPruebaRaft) esperarLider() *nodoPruebaRaft {
+	c.t.Helper()
+	limite := time.Now().Add(esperaPruebaRaft)
+	for time.Now().Before(limite) {
+		var lider *nodoPruebaRaft
+		var estados []EstadoRaft
+		for _, nodo := range c.nodos {
+			if !nodo.activo {
+				continue
+			}
+			estado, _ := nodo.estado()
+			estados = append(estados, estado)
+			if estado.Rol == liderRaft {
+				lider = nodo
+			}
+		}
+		if lider != nil && !slices.ContainsFunc(estados, func(e EstadoRaft) bool {
+			return e.Lider != lider.id || e.Termino != estados[0].Termino
+		}) {
+			return lider
+		}
+		time.Sleep(latidoRaft / 2)
+	}
+	c.t.Fatal("Los nodos no han elegido un líder en", esperaPruebaRaft)
+	return nil
+}
+
+// proponerConfirmada propone en el líder una declaración de la cola especificada y espera a que se confirme.
+//
+// Retorna:
+// - El índice de la entrada en el registro.
+func (c *clusterPruebaRaft) proponerConfirmada(lider *nodoPruebaRaft, nombre string) uint64 {
+	c.t.Helper()
+	estado, _ := lider.estado()
+	indice, err := lider.proponer(OperacionReplica{Tipo: opDeclarar, Nombre: nombre}, estado.Termino)
+	if err != nil {
+		c.t.Fatal("Error al proponer", nombre+":", err)
+	}
+	if err := lider.esperarConfirmado(estado.Termino, indice, esperaPruebaRaft); err != nil {
+		c.t.Fatal("La operación", nombre, "no se ha confirmado:", err)
+	}
+	return indice
+}
+
+// esperarConfirmada espera a que el nodo sepa que la entrada con el índice especificado está confirmada.
+func (c *clusterPruebaRaft) esperarConfirmada(nodo *nodoPruebaRaft, indice uint64) {
+	c.t.Helper()
+	limite := time.Now().Add(esperaPruebaRaft)
+	for {
+		estado, cambio := nodo.estado()
+		if estado.Confirmado >= indice {
+			return
+		}
+		select {
+		case <-cambio:
+		case <-time.After(time.Until(limite)):
+			c.t.Fatalf("El nodo %s no ha confirmado la entrada %d: %+v", nodo.id, indice, estado)
+		}
+	}
+}
+
+// comprobarEntrada comprueba que la entrada con el índice especificado del registro del nodo es la
+// operación sobre la cola especificada.
+func (c *clusterPruebaRaft) comprobarEntrada(nodo *nodoPruebaRaft, indice uint64, nombre string) {
+	c.t.Helper()
+	entradas := nodo.entradas(indice, indice)
+	if len(entradas) != 1 || entradas[0].Op.Nombre != nombre {
+		c.t.Fatalf("La entrada %d del nodo %s es %+v en lugar de la operación sobre %s", indice, nodo.id, entradas, nombre)
+	}
+}
+
+// TestEleccionRaft comprueba que tres nodos eligen un líder y confirman sus entradas en todos ellos.
+func TestEleccionRaft(t *testing.T) {
+	c := arrancarClusterRaft(t, 3)
+	lider := c.esperarLider()
+	indice := c.proponerConfirmada(lider, "cola")
+	for _, nodo := range c.nodos {
+		c.esperarConfirmada(nodo, indice)
+		c.comprobarEntrada(nodo, indice, "cola")
+	}
+}
+
+// TestConfirmacionTrasCaerLiderRaft comprueba que, al caer el líder, los otros dos nodos eligen otro que
+// conserva las entradas confirmadas y sigue confirmando entradas nuevas.
+func TestConfirmacionTrasCaerLiderRaft(t *testing.T) {
+	c := arrancarClusterRaft(t, 3)
+	lider := c.esperarLider()
+	antes := c.proponerConfirmada(lider, "antes")
+	lider.detener()
+	nuevo := c.esperarLider()
+	if nuevo == lider {
+		t.Fatal("El nodo detenido sigue siendo el líder")
+	}
+	// La entrada confirmada por el líder anterior sobrevive y se pueden confirmar otras con dos de los tres nodos.
+	c.comprobarEntrada(nuevo, antes, "antes")
+	despues := c.proponerConfirmada(nuevo, "despues")
+	for _, nodo := range c.nodos {
+		if nodo.activo {
+			c.esperarConfirmada(nodo, despues)
+			c.comprobarEntrada(nodo, despues, "despues")
+		}
+	}
+}
+
+// TestInstantaneaSeguidorAtrasadoRaft comprueba que un nodo que vuelve después de que el líder haya
+// compactado su registro se pone al día con la instantánea del líder.
+func TestInstantaneaSeguidorAtrasadoRaft(t *testing.T) {
+	c := arrancarClusterRaft(t, 3)
+	lider := c.esperarLider()
+	atrasado := c.nodos[slices.IndexFunc(c.nodos, func(nodo *nodoPruebaRaft) bool { return nodo != lider })]
+	atrasado.detener()
+	var indice uint64
+	for i := 0; i < 20; i++ {
+		indice = c.proponerConfirmada(lider, fmt.Sprint("cola", i))
+	}
+	termino := lider.entradas(indice, indice)[0].Termino
+	if err := lider.compactar(indice, termino, []byte("estado")); err != nil {
+		t.Fatal("Error al compactar el registro del líder:", err)
+	}
+	if estado, _ := lider.estado(); estado.Instantanea != indice {
+		t.Fatalf("La instantánea del líder llega hasta la entrada %d en lugar de la %d", estado.Instantanea, indice)
+	}
+	// Al volver, al nodo le faltan entradas que el líder ya ha descartado, así que recibe la instantánea.
+	atrasado.arrancar(nil)
+	c.esperarConfirmada(atrasado, indice)
+	estado, _ := atrasado.estado()
+	if estado.Instantanea != indice {
+		t.Fatalf("La instantánea del nodo atrasado llega hasta la entrada %d en lugar de la %d", estado.Instantanea, indice)
+	}
+	instantanea, err := atrasado.instantanea()
+	if err != nil {
+		t.Fatal("Error al leer la instantánea del nodo atrasado:", err)
+	}
+	if string(instantanea.Datos) != "estado" {
+		t.Fatalf("La instantánea del nodo atrasado contiene %q", instantanea.Datos)
+	}
+	// Tras la instantánea, el nodo sigue recibiendo las entradas nuevas.
+	siguiente := c.proponerConfirmada(lider, "siguiente")
+	c.esperarConfirmada(atrasado, siguiente)
+	c.comprobarEntrada(atrasado, siguiente, "siguiente")
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tamSegmentoPorDefecto es el tamaño a partir del cual se empieza un segmento nuevo del registro.
+const tamSegmentoPorDefecto = 1 << 20
+
+// intervaloCompactacion es cada cuánto se avanza el offset consumido y se borran los segmentos
+// que ya no contienen mensajes pendientes.
+const intervaloCompactacion = time.Second
+
+// Nombres de los archivos del registro de una cola dentro de su directorio.
+const (
+	extensionSegmento = ".seg"
+	archivoAcks       = "acks"
+	archivoConsumido  = "consumido"
+)
+
+// Registro es el almacenamiento duradero de una cola: un registro de solo adición dividido en segmentos.
+//
+// Cada mensaje publicado se añade al segmento activo con un offset creciente; los offsets que se saltan
+// (ver `Anadir`) se recuerdan como huecos. Los mensajes consumidos
+// no se borran del segmento: su offset se añade al archivo `acks`. En segundo plano, `compactar` avanza
+// el offset consumido (todos los anteriores están confirmados o son huecos), lo guarda en el archivo `consumido`,
+// borra los segmentos que quedan por debajo y reescribe `acks` sin las confirmaciones ya cubiertas.
+// Así, publicar y consumir cuestan lo mismo sea cual sea el tamaño de la cola.
+//
+// Los mensajes se sincronizan con el disco según la política del registro; `EsperarSincronizado`
+// permite esperar a que un mensaje esté en el disco antes de confirmarlo al productor.
+type Registro struct {
+	dir string
+	mux sync.Mutex
+	// segmentos contiene el offset base de cada segmento, en orden; el último es el activo.
+	segmentos []uint64
+	activo    *os.File
+	tamActivo int64
+	siguiente uint64
+	acks      *os.File
+	numAcks   int
+	// confirmados contiene los offsets confirmados que no están cubiertos por `consumido`.
+	confirmados map[uint64]struct{}
+	// huecos contiene el final de cada intervalo de offsets sin mensajes posterior a `consumido`,
+	// indexado por su inicio.
+	huecos      map[uint64]uint64
+	consumido   uint64
+	tamSegmento int64
+	// codificacion indica cómo se cifran y comprimen las entradas.
+	codificacion codificacion
+	sinc         *sincronizador
+	fin          chan struct{}
+	tareas       sync.WaitGroup
+	cerrar       sync.Once
+	errCerrar    error
+}
+
+// abrirRegistro abre o crea el registro de una cola en el directorio especificado.
+//
+// Parámetros:
+// - dir: El directorio del registro.
+// - politica: La política de sincronización con el disco de los mensajes que se añadan.
+// - cod: Cómo se cifran y comprimen las entradas nuevas; su llavero descifra también las existentes.
+//
+// Retorna:
+// - El registro abierto.
+// - Los mensajes pendientes de consumir, en el orden en que se publicaron.
+// - Un error si no se puede leer o crear el registro.
+//
+// Comportamiento:
+// - Lee el offset consumido y las confirmaciones posteriores.
+// - Recorre los segmentos y devuelve los mensajes no confirmados. Si el último segmento acaba en una entrada incompleta (una escritura interrumpida), lo trunca tras la última entrada completa.
+// - Lanza la goroutine que compacta el registro periódicamente y, con la política `syncGrupo`, la que lo sincroniza.
+func abrirRegistro(dir string, politica PoliticaSync, cod codificacion) (*Registro, []Mensaje, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	r := &Registro{
+		dir:          dir,
+		confirmados:  make(map[uint64]struct{}),
+		huecos:       make(map[uint64]uint64),
+		tamSegmento:  tamSegmentoPorDefecto,
+		codificacion: cod,
+		fin:          make(chan struct{}),
+	}
+	if err := r.leerConsumido(); err != nil {
+		return nil, nil, err
+	}
+	if err := r.leerAcks(); err != nil {
+		return nil, nil, err
+	}
+	pendientes, err := r.leerSegmentos()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(r.segmentos) == 0 {
+		r.segmentos = []uint64{r.siguiente}
+	}
+	base := r.segmentos[len(r.segmentos)-1]
+	r.activo, err = os.OpenFile(r.rutaSegmento(base), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := r.activo.Stat()
+	if err != nil {
+		r.activo.Close()
+		return nil, nil, err
+	}
+	r.tamActivo = info.Size()
+	r.acks, err = os.OpenFile(filepath.Join(dir, archivoAcks), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		r.activo.Close()
+		return nil, nil, err
+	}
+	r.sinc = nuevoSincronizador(politica, &r.mux, r.siguiente)
+	r.tareas.Add(1)
+	go r.compactarPeriodicamente()
+	if politica.Modo == syncGrupo {
+		r.tareas.Add(1)
+		go func() {
+			defer r.tareas.Done()
+			r.sinc.periodicamente(&r.mux, r.fin, r.sincronizarActivo)
+		}()
+	}
+	return r, pendientes, nil
+}
+
+// rutaSegmento devuelve la ruta del segmento con el offset base especificado.
+func (r *Registro) rutaSegmento(base uint64) string {
+	return filepath.Join(r.dir, fmt.Sprintf("%020d%s", base, extensionSegmento))
+}
+
+// leerConsumido carga el offset consumido guardado en el directorio del registro, si existe.
+func (r *Registro) leerConsumido() error {
+	datos, err := os.ReadFile(filepath.Join(r.dir, archivoConsumido))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(datos) != 8 {
+		return fmt.Errorf("archivo %s corrupto en %s", archivoConsumido, r.dir)
+	}
+	r.consumido = binary.BigEndian.Uint64(datos)
+	r.siguiente = r.consumido
+	return nil
+}
+
+// leerAcks carga las confirmaciones posteriores al offset consumido. Si el archivo acaba en una
+// confirmación incompleta, la descarta.
+func (r *Registro) leerAcks() error {
+	ruta := filepath.Join(r.dir, archivoAcks)
+	datos, err := os.ReadFile(ruta)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	completos := len(datos) - len(datos)%8
+	if completos != len(datos) {
+		fmt.Println("Descartando confirmación incompleta en", ruta)
+		if err := os.Truncate(ruta, int64(completos)); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < completos; i += 8 {
+		offset := binary.BigEndian.Uint64(datos[i:])
+		if offset >= r.consumido {
+			r.confirmados[offset] = struct{}{}
+		}
+	}
+	r.numAcks = completos / 8
+	return nil
+}
+
+// leerSegmentos recorre los segmentos del registro en orden y devuelve los mensajes no confirmados.
+// Si el último segmento acaba en una escritura interrumpida, lo trunca; cualquier otra entrada no válida
+// es un error, porque truncar en ese punto perdería los mensajes que la siguen.
+func (r *Registro) leerSegmentos() ([]Mensaje, error) {
+	entradas, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entrada := range entradas {
+		nombre, ok := strings.CutSuffix(entrada.Name(), extensionSegmento)
+		if !ok || entrada.IsDir() {
+			continue
+		}
+		base, err := strconv.ParseUint(nombre, 10, 64)
+		if err != nil {
+			continue
+		}
+		r.segmentos = append(r.segmentos, base)
+	}
+	sort.Slice(r.segmentos, func(i, j int) bool { return r.segmentos[i] < r.segmentos[j] })
+	var pendientes []Mensaje
+	for i, base := range r.segmentos {
+		ruta := r.rutaSegmento(base)
+		datos, err := os.ReadFile(ruta)
+		if err != nil {
+			return nil, err
+		}
+		pos := 0
+		for pos < len(datos) {
+			mensaje, n, err := decodificarEntrada(datos[pos:], r.codificacion.llavero)
+			if err != nil {
+				if i != len(r.segmentos)-1 || !escrituraInterrumpida(datos[pos:], err) {
+					return nil, fmt.Errorf("segmento %s: entrada no válida en la posición %d: %w", ruta, pos, err)
+				}
+				fmt.Println("Truncando escritura interrumpida en", ruta, "posición", pos)
+				if err := os.Truncate(ruta, int64(pos)); err != nil {
+					return nil, err
+				}
+				break
+			}
+			pos += n
+			if mensaje.Offset > r.siguiente {
+				r.huecos[r.siguiente] = mensaje.Offset
+			}
+			if mensaje.Offset >= r.siguiente {
+				r.siguiente = mensaje.Offset + 1
+			}
+			if mensaje.Offset < r.consumido {
+				continue
+			}
+			if _, ok := r.confirmados[mensaje.Offset]; ok {
+				continue
+			}
+			pendientes = append(pendientes, mensaje)
+		}
+	}
+	return pendientes, nil
+}
+
+// escrituraInterrumpida indica si el error al decodificar la entrada que empieza al principio de datos
+// se debe a que la última escritura del segmento no terminó: la entrada está incompleta, o es la última
+// del segmento y su CRC no coincide porque solo llegó al disco una parte de su contenido.
+//
+// Comportamiento:
+// - El CRC no cubre la cabecera, así que una longitud dañada en mitad del segmento también hace que la entrada parezca llegar al final. Por eso no se considera interrumpida si detrás empieza alguna entrada válida: es una entrada corrupta.
+func escrituraInterrumpida(datos []byte, err error) bool {
+	if !errors.Is(err, errEntradaIncompleta) {
+		if !errors.Is(err, errEntradaCorrupta) || len(datos) < cabeceraEntrada || datos[0] != magiaEntrada ||
+			!versionConocida(datos[1]) || cabeceraEntrada+int(binary.BigEndian.Uint32(datos[2:])) != len(datos) {
+			return false
+		}
+	}
+	return !registroValidoPosterior(datos, magiaEntrada, func(datos []byte) (int, error) {
+		_, _, n, err := leerMarco(datos)
+		return n, err
+	})
+}
+
+// registroValidoPosterior indica si en datos, a partir del segundo byte, empieza algún registro válido.
+//
+// Parámetros:
+// - magia: El primer byte de todo registro.
+// - decodificar: Devuelve la longitud del registro que empieza al principio de los datos, o un error si no es válido.
+func registroValidoPosterior(datos []byte, magia byte, decodificar func([]byte) (int, error)) bool {
+	for p := 1; p < len(datos); p++ {
+		if datos[p] != magia {
+			continue
+		}
+		if _, err := decodificar(datos[p:]); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Anadir añade un mensaje al final del registro.
+//
+// Parámetros:
+// - m: El mensaje. Conserva su offset si es mayor que el de todos los anteriores; si no, se le asigna el siguiente offset del registro.
+//
+// Retorna:
+// - Un error si el mensaje no cabe en el formato de las entradas o no se pudo escribir.
+//
+// Comportamiento:
+// - Si el segmento activo supera el tamaño máximo, empieza un segmento nuevo antes de escribir.
+// - Con la política `syncSiempre`, sincroniza el segmento con el disco antes de retornar.
+func (r *Registro) Anadir(m *Mensaje) error {
+	if err := validarMensaje(m); err != nil {
+		return err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.activo == nil {
+		return errAlmacenCerrado
+	}
+	if r.sinc.err != nil {
+		return r.sinc.err
+	}
+	m.Offset = max(m.Offset, r.siguiente)
+	entrada := codificarEntrada(m, r.codificacion)
+	if r.tamActivo > 0 && r.tamActivo+int64(len(entrada)) > r.tamSegmento {
+		if err := r.nuevoSegmento(); err != nil {
+			return err
+		}
+	}
+	n, err := r.activo.Write(entrada)
+	r.tamActivo += int64(n)
+	if err != nil {
+		// Una entrada escrita a medias solo se puede descartar al reabrir el registro, así que no se escribe nada más detrás.
+		return r.sinc.fallo(fmt.Errorf("error al escribir en el registro %s: %w", r.dir, err))
+	}
+	if m.Offset > r.siguiente {
+		r.huecos[r.siguiente] = m.Offset
+	}
+	r.siguiente = m.Offset + 1
+	if r.sinc.politica.Modo == syncSiempre {
+		return r.sincronizarActivo()
+	}
+	return nil
+}
+
+// EsperarSincronizado espera a que el mensaje con el offset especificado esté sincronizado con el disco
+// según la política del registro (ver `sincronizador.esperar`).
+func (r *Registro) EsperarSincronizado(offset uint64) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.sinc.esperar(offset)
+}
+
+// sincronizarActivo sincroniza el segmento activo con el disco y avisa a los que esperan en
+// `EsperarSincronizado`. Debe llamarse con `r.mux` bloqueado.
+func (r *Registro) sincronizarActivo() error {
+	return r.sinc.sincronizar(r.activo, r.siguiente)
+}
+
+// nuevoSegmento cierra el segmento activo y empieza otro cuyo offset base es el siguiente offset.
+// Debe llamarse con `r.mux` bloqueado.
+func (r *Registro) nuevoSegmento() error {
+	if err := r.sincronizarActivo(); err != nil {
+		return err
+	}
+	if err := r.activo.Close(); err != nil {
+		return err
+	}
+	activo, err := os.OpenFile(r.rutaSegmento(r.siguiente), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		r.activo = nil
+		return r.sinc.fallo(err)
+	}
+	r.activo = activo
+	r.tamActivo = 0
+	r.segmentos = append(r.segmentos, r.siguiente)
+	return nil
+}
+
+// Confirmar marca como consumido el mensaje con el offset especificado añadiéndolo al archivo de confirmaciones.
+//
+// Parámetros:
+// - offset: El offset del mensaje consumido.
+//
+// Retorna:
+// - Un error si no se pudo escribir la confirmación.
+func (r *Registro) Confirmar(offset uint64) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.acks == nil {
+		return errAlmacenCerrado
+	}
+	if offset < r.consumido {
+		return nil
+	}
+	var entrada [8]byte
+	binary.BigEndian.PutUint64(entrada[:], offset)
+	if _, err := r.acks.Write(entrada[:]); err != nil {
+		return err
+	}
+	r.confirmados[offset] = struct{}{}
+	r.numAcks++
+	return nil
+}
+
+// compactarPeriodicamente llama a `compactar` cada `intervaloCompactacion` hasta que se cierra el registro.
+func (r *Registro) compactarPeriodicamente() {
+	defer r.tareas.Done()
+	ticker := time.NewTicker(intervaloCompactacion)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.fin:
+			return
+		case <-ticker.C:
+			if err := r.compactar(); err != nil {
+				fmt.Println("Error al compactar el registro", r.dir+":", err)
+			}
+		}
+	}
+}
+
+// compactar avanza el offset consumido, borra los segmentos que ya no contienen mensajes pendientes y
+// reescribe el archivo de confirmaciones cuando la mayoría de ellas ya están cubiertas por el offset consumido.
+//
+// Comportamiento:
+// - El offset consumido se guarda antes de borrar segmentos o confirmaciones, de modo que una caída en mitad de la compactación no hace reaparecer mensajes consumidos.
+func (r *Registro) compactar() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.acks == nil {
+		return nil
+	}
+	anterior := r.consumido
+	for r.consumido < r.siguiente {
+		if fin, ok := r.huecos[r.consumido]; ok {
+			delete(r.huecos, r.consumido)
+			r.consumido = fin
+			continue
+		}
+		if _, ok := r.confirmados[r.consumido]; !ok {
+			break
+		}
+		delete(r.confirmados, r.consumido)
+		r.consumido++
+	}
+	if r.consumido == anterior {
+		return nil
+	}
+	var datos [8]byte
+	binary.BigEndian.PutUint64(datos[:], r.consumido)
+	if err := escribirAtomico(filepath.Join(r.dir, archivoConsumido), datos[:]); err != nil {
+		return err
+	}
+	for len(r.segmentos) > 1 && r.segmentos[1] <= r.consumido {
+		if err := os.Remove(r.rutaSegmento(r.segmentos[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		r.segmentos = r.segmentos[1:]
+	}
+	if r.numAcks > 2*len(r.confirmados)+1024 {
+		return r.reescribirAcks()
+	}
+	return nil
+}
+
+// reescribirAcks sustituye el archivo de confirmaciones por otro que solo contiene las que no están
+// cubiertas por el offset consumido. Debe llamarse con `r.mux` bloqueado.
+func (r *Registro) reescribirAcks() error {
+	datos := make([]byte, 0, 8*len(r.confirmados))
+	for offset := range r.confirmados {
+		datos = binary.BigEndian.AppendUint64(datos, offset)
+	}
+	ruta := filepath.Join(r.dir, archivoAcks)
+	if err := escribirAtomico(ruta, datos); err != nil {
+		return err
+	}
+	acks, err := os.OpenFile(ruta, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	r.acks.Close()
+	r.acks = acks
+	r.numAcks = len(r.confirmados)
+	return nil
+}
+
+// Sincronizar fuerza la escritura en disco del segmento activo y del archivo de confirmaciones.
+func (r *Registro) Sincronizar() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.activo == nil {
+		return errAlmacenCerrado
+	}
+	if err := r.sincronizarActivo(); err != nil {
+		return err
+	}
+	return r.acks.Sync()
+}
+
+// Cerrar detiene la compactación periódica, compacta por última vez y cierra los archivos del registro.
+// Las llamadas posteriores devuelven el resultado de la primera.
+func (r *Registro) Cerrar() error {
+	r.cerrar.Do(func() {
+		close(r.fin)
+		r.tareas.Wait()
+		errCompactar := r.compactar()
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		errs := []error{errCompactar, r.acks.Sync(), r.acks.Close()}
+		if r.activo != nil {
+			errs = append(errs, r.sincronizarActivo(), r.activo.Close())
+		}
+		r.errCerrar = errors.Join(errs...)
+		r.activo, r.acks = nil, nil
+		r.sinc.cerrar()
+	})
+	return r.errCerrar
+}
+
+// Borrar cierra el registro y elimina su directorio con todos sus archivos.
+func (r *Registro) Borrar() error {
+	if err := r.Cerrar(); err != nil {
+		fmt.Println("Error al cerrar el registro", r.dir+":", err)
+	}
+	return os.RemoveAll(r.dir)
+}
+
+// escribirAtomico sustituye el contenido de un archivo de forma atómica: escribe un archivo temporal,
+// lo sincroniza con el disco y lo renombra sobre el original.
+func escribirAtomico(ruta string, datos []byte) error {
+	temporal := ruta + ".tmp"
+	file, err := os.OpenFile(temporal, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(datos); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temporal, ruta); err != nil {
+		return err
+	}
+	// El renombrado solo es duradero cuando se sincroniza el directorio que lo contiene.
+	directorio, err := os.Open(filepath.Dir(ruta))
+	if err != nil {
+		return err
+	}
+	defer directorio.Close()
+	return directorio.Sync()
+}
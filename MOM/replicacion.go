@@ -0,0 +1,678 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Replicación primario/seguidor de las colas duraderas.
+//
+// Un broker arrancado con -seguir es seguidor de otro broker, el primario: no acepta clientes y mantiene
+// en su directorio de datos una copia de las colas duraderas del primario. Para ello pide al primario
+// una instantánea con `Instantanea` (las colas duraderas y sus mensajes sin confirmar) y después las
+// operaciones posteriores con `Replicar`: declaraciones, publicaciones, confirmaciones y borrados.
+//
+// El primario ofrece `Instantanea` y `Replicar` con el servicio RPC "Replicacion" en la dirección -replicacion,
+// separada de la de los clientes, de modo que los productores y consumidores no pueden descargar las colas
+// duraderas ni leer sus operaciones. Esa dirección solo debe ser accesible para los seguidores.
+//
+// La replicación es asíncrona: el primario responde a los productores sin esperar al seguidor, así que
+// al perder el primario se pueden perder sus últimas operaciones. La operación "promocionar" de la consola
+// convierte al seguidor en primario: deja de replicar, carga las colas replicadas como al arrancar y
+// empieza a aceptar clientes.
+//
+// El primario solo guarda las operaciones desde que un seguidor pide la primera instantánea, y como
+// mucho las `maxOperacionesReplica` últimas; un seguidor que se queda más atrás pide otra instantánea.
+// Todas las operaciones se pueden aplicar más de una vez con el mismo resultado, de modo que el
+// seguidor puede aplicar las posteriores a la instantánea aunque ya estuvieran incluidas en ella.
+
+// Tipos de operación replicada.
+const (
+	opDeclarar  = "declarar"
+	opPublicar  = "publicar"
+	opConfirmar = "confirmar"
+	opBorrar    = "borrar"
+)
+
+// maxOperacionesReplica es el número de operaciones que el primario guarda para los seguidores.
+const maxOperacionesReplica = 10000
+
+// maxOperacionesLote es el número máximo de operaciones que devuelve una llamada a `Replicar`.
+const maxOperacionesLote = 1000
+
+// esperaReplicacion es el tiempo que espera `Replicar` a que haya operaciones nuevas, y
+// esperaReconexionReplica el que espera el seguidor antes de volver a conectar con el primario.
+const (
+	esperaReplicacion       = 5 * time.Second
+	esperaReconexionReplica = time.Second
+)
+
+// errReplicaAtrasada es el error con que el seguidor vuelve a pedir una instantánea porque el primario
+// ya no tiene las operaciones que le faltan.
+var errReplicaAtrasada = errors.New("el primario ya no tiene las operaciones pendientes de replicar")
+
+// OperacionReplica es una operación sobre una cola duradera del primario.
+//
+// - Secuencia: el número de la operación; crece de uno en uno.
+// - Tipo: `opDeclarar`, `opPublicar`, `opConfirmar` u `opBorrar`.
+// - Nombre: el nombre de la cola.
+// - Cola: la entrada del manifiesto de la cola declarada (`opDeclarar`).
+// - Mensaje: el mensaje publicado (`opPublicar`).
+// - Offset: el offset del mensaje confirmado (`opConfirmar`). A diferencia del ID, que se conserva al
+// importar mensajes, el offset identifica un único mensaje de la cola.
+type OperacionReplica struct {
+	Secuencia uint64
+	Tipo      string
+	Nombre    string
+	Cola      EntradaManifiesto
+	Mensaje   Mensaje
+	Offset    uint64
+}
+
+// ColaReplicada es una cola duradera de una instantánea con sus mensajes sin confirmar, ordenados por offset.
+type ColaReplicada struct {
+	Cola     EntradaManifiesto
+	Mensajes []Mensaje
+}
+
+// ArgsInstantanea representa los argumentos de `Instantanea`.
+type ArgsInstantanea struct{}
+
+// ReplyInstantanea representa la respuesta de `Instantanea`.
+// Secuencia es la de la primera operación que el seguidor debe pedir después con `Replicar`.
+type ReplyInstantanea struct {
+	Secuencia uint64
+	Colas     []ColaReplicada
+}
+
+// ArgsReplicar representa los argumentos de `Replicar`: la secuencia de la primera operación que se
+// pide y el tiempo máximo que se espera a que haya alguna.
+type ArgsReplicar struct {
+	Desde  uint64
+	Espera time.Duration
+}
+
+// ReplyReplicar representa la respuesta de `Replicar`.
+// Reiniciar es verdadero si el primario ya no tiene las operaciones pedidas y el seguidor debe pedir
+// otra instantánea.
+type ReplyReplicar struct {
+	Operaciones []OperacionReplica
+	Reiniciar   bool
+}
+
+// registroReplicacion guarda las últimas operaciones sobre las colas duraderas para los seguidores.
+// No guarda nada hasta que se activa con la primera instantánea.
+type registroReplicacion struct {
+	mux         sync.Mutex
+	activo      bool
+	operaciones []OperacionReplica
+	siguiente   uint64
+	// nueva se cierra al anotar una operación y se sustituye por otro canal.
+	nueva chan struct{}
+}
+
+// activar empieza a guardar operaciones, si no lo estaba ya, y devuelve la secuencia de la siguiente.
+func (r *registroReplicacion) activar() uint64 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if !r.activo {
+		r.activo = true
+		r.nueva = make(chan struct{})
+	}
+	return r.siguiente
+}
+
+// anotar guarda una operación, asignándole la siguiente secuencia, y avisa a los seguidores que esperan.
+// Debe llamarse después de aplicar la operación.
+func (r *registroReplicacion) anotar(op OperacionReplica) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if !r.activo {
+		return
+	}
+	op.Secuencia = r.siguiente
+	r.siguiente++
+	r.operaciones = append(r.operaciones, op)
+	// Las operaciones antiguas se descartan de vez en cuando copiando las vigentes, para liberar memoria.
+	if len(r.operaciones) > 2*maxOperacionesReplica {
+		r.operaciones = append([]OperacionReplica(nil), r.operaciones[len(r.operaciones)-maxOperacionesReplica:]...)
+	}
+	close(r.nueva)
+	r.nueva = make(chan struct{})
+}
+
+// leer devuelve las operaciones a partir de la secuencia especificada.
+//
+// Parámetros:
+// - desde: La secuencia de la primera operación pedida.
+// - espera: El tiempo máximo que se espera a que haya alguna operación.
+// - fin: Un canal que, al cerrarse, deja de esperar.
+//
+// Retorna:
+// - Las operaciones, como mucho `maxOperacionesLote`, que pueden ser ninguna si vence la espera.
+// - Falso si el registro no tiene las operaciones pedidas.
+func (r *registroReplicacion) leer(desde uint64, espera time.Duration, fin <-chan struct{}) ([]OperacionReplica, bool) {
+	timer := time.NewTimer(espera)
+	defer timer.Stop()
+	for {
+		r.mux.Lock()
+		primera := r.siguiente - uint64(min(len(r.operaciones), maxOperacionesReplica))
+		if !r.activo || desde < primera || desde > r.siguiente {
+			r.mux.Unlock()
+			return nil, false
+		}
+		if desde < r.siguiente {
+			inicio := len(r.operaciones) - int(r.siguiente-desde)
+			hasta := min(len(r.operaciones), inicio+maxOperacionesLote)
+			operaciones := append([]OperacionReplica(nil), r.operaciones[inicio:hasta]...)
+			r.mux.Unlock()
+			return operaciones, true
+		}
+		nueva := r.nueva
+		r.mux.Unlock()
+		select {
+		case <-nueva:
+		case <-timer.C:
+			return nil, true
+		case <-fin:
+			return nil, true
+		}
+	}
+}
+
+// anotarReplica anota una operación sobre una cola para los seguidores si la cola es duradera y, si el
+// broker es un nodo de un clúster, la propone en el clúster.
+//
+// Retorna:
+// - El índice de la operación en el registro del clúster, o cero si no se propone.
+// - Un error si no se puede proponer la operación en el clúster.
+func (l *Broker) anotarReplica(cola *Cola, op OperacionReplica) (uint64, error) {
+	if !cola.durability {
+		return 0, nil
+	}
+	op.Nombre = cola.nombre
+	l.replicacion.anotar(op)
+	if l.cluster == nil {
+		return 0, nil
+	}
+	return l.cluster.proponer(op)
+}
+
+// ServicioReplicacion es el servicio RPC "Replicacion" que el primario ofrece a sus seguidores; hay uno por
+// cada conexión de un seguidor.
+type ServicioReplicacion struct {
+	broker *Broker
+	conn   net.Conn
+}
+
+// ejecutarReplicacion atiende a los seguidores en la dirección especificada hasta que se apaga el broker.
+func (l *Broker) ejecutarReplicacion(direccion string) {
+	ln, err := net.Listen("tcp", direccion)
+	if err != nil {
+		fmt.Println("Error al iniciar la replicación:", err)
+		return
+	}
+	defer ln.Close()
+	l.mux.Lock()
+	if l.apagandose() {
+		l.mux.Unlock()
+		return
+	}
+	l.listenerReplicacion = ln
+	l.mux.Unlock()
+	fmt.Println("Replicación escuchando en", direccion)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if l.apagandose() {
+				return
+			}
+			fmt.Println("Error al aceptar la conexión del seguidor:", err)
+			continue
+		}
+		servidor := rpc.NewServer()
+		if err := servidor.RegisterName("Replicacion", &ServicioReplicacion{broker: l, conn: conn}); err != nil {
+			fmt.Println("Error al registrar la replicación:", err)
+			conn.Close()
+			continue
+		}
+		go servidor.ServeConn(conn)
+	}
+}
+
+// Instantanea es un método RPC con el que un seguidor pide el estado de las colas duraderas.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsInstantanea`.
+// - reply: Un puntero a una estructura `ReplyInstantanea` donde se devuelven las colas y la secuencia desde la que replicar.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa.
+//
+// Comportamiento:
+// - Activa el registro de operaciones y devuelve cada cola duradera del manifiesto con los mensajes que aún no se han confirmado, incluidos los que están entregados a algún consumidor.
+func (s *ServicioReplicacion) Instantanea(args *ArgsInstantanea, reply *ReplyInstantanea) error {
+	l := s.broker
+	reply.Secuencia = l.replicacion.activar()
+	l.mux.Lock()
+	colas := make(map[string]*Cola)
+	entradas := make([]EntradaManifiesto, 0, len(l.manifiesto))
+	for nombre, entrada := range l.manifiesto {
+		if cola, ok := l.colas[nombre]; ok {
+			colas[nombre] = cola
+			entradas = append(entradas, entrada)
+		}
+	}
+	l.mux.Unlock()
+	sort.Slice(entradas, func(i, j int) bool { return entradas[i].Nombre < entradas[j].Nombre })
+	for _, entrada := range entradas {
+		cola := colas[entrada.Nombre]
+		replicada := ColaReplicada{Cola: entrada}
+		cola.mux.Lock()
+		for _, m := range cola.sinConfirmar {
+			replicada.Mensajes = append(replicada.Mensajes, *m)
+		}
+		cola.mux.Unlock()
+		sort.Slice(replicada.Mensajes, func(i, j int) bool { return replicada.Mensajes[i].Offset < replicada.Mensajes[j].Offset })
+		reply.Colas = append(reply.Colas, replicada)
+	}
+	fmt.Println("Instantánea enviada al seguidor", s.conn.RemoteAddr(), "desde la operación", reply.Secuencia)
+	return nil
+}
+
+// Replicar es un método RPC con el que un seguidor pide las operaciones sobre las colas duraderas
+// posteriores a su instantánea.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsReplicar` con la secuencia de la primera operación pedida y la espera máxima.
+// - reply: Un puntero a una estructura `ReplyReplicar` donde se devuelven las operaciones.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa.
+//
+// Comportamiento:
+// - Si no hay operaciones nuevas, espera hasta `args.Espera` (como mucho `esperaReplicacion`) a que las haya.
+// - Si el primario ya no tiene las operaciones pedidas, devuelve `reply.Reiniciar` a verdadero.
+func (s *ServicioReplicacion) Replicar(args *ArgsReplicar, reply *ReplyReplicar) error {
+	espera := min(max(args.Espera, 0), esperaReplicacion)
+	operaciones, ok := s.broker.replicacion.leer(args.Desde, espera, s.broker.apagando)
+	reply.Operaciones = operaciones
+	reply.Reiniciar = !ok
+	return nil
+}
+
+// Seguidor replica en el broker las colas duraderas de un broker primario (ver `Instantanea` y `Replicar`).
+// Las colas replicadas no se cargan en el broker hasta que se promociona; mientras tanto el seguidor
+// solo guarda sus mensajes en sus almacenes.
+type Seguidor struct {
+	primario string
+	// mux protege `replica`, `secuencia` y `conectado`, y se bloquea mientras se aplica una operación.
+	mux       sync.Mutex
+	replica   replica
+	secuencia uint64
+	conectado bool
+	fin       chan struct{}
+	terminado chan struct{}
+}
+
+// replica contiene las colas duraderas replicadas en el broker, que no se cargan en él hasta que se
+// promociona: `aplicar` guarda en sus almacenes las operaciones recibidas.
+type replica struct {
+	broker *Broker
+	colas  map[string]*colaReplica
+}
+
+// colaReplica es una cola duradera replicada: su almacén, que guarda los mensajes con el offset que tienen en
+// el primario, los offsets de los mensajes sin confirmar y el siguiente offset que se espera del primario.
+type colaReplica struct {
+	almacen    Almacen
+	pendientes map[uint64]struct{}
+	siguiente  uint64
+}
+
+// nuevaReplica crea una réplica vacía de las colas duraderas del broker especificado.
+func nuevaReplica(l *Broker) replica {
+	return replica{broker: l, colas: make(map[string]*colaReplica)}
+}
+
+// seguir convierte al broker en seguidor del primario especificado y empieza a replicar sus colas duraderas.
+// Debe llamarse después de `abrirDatos` y en lugar de `RescatarColasAnteriores`.
+func (l *Broker) seguir(primario string) {
+	s := &Seguidor{
+		primario:  primario,
+		replica:   nuevaReplica(l),
+		fin:       make(chan struct{}),
+		terminado: make(chan struct{}),
+	}
+	l.mux.Lock()
+	l.seguidor = s
+	l.mux.Unlock()
+	fmt.Println("Siguiendo al primario", primario)
+	go s.ejecutar()
+}
+
+// Promocionar convierte al broker seguidor en primario.
+//
+// Parámetros:
+// - ip: La dirección en la que el broker empieza a aceptar clientes.
+//
+// Retorna:
+// - Un error si el broker no es seguidor.
+//
+// Comportamiento:
+// - Deja de replicar y cierra los almacenes de las colas replicadas.
+// - Carga las colas replicadas con `RescatarColasAnteriores`, como al arrancar, y empieza a aceptar clientes
+// y, si el broker tiene dirección de replicación, seguidores.
+func (l *Broker) Promocionar(ip string) error {
+	l.mux.Lock()
+	s := l.seguidor
+	l.seguidor = nil
+	l.mux.Unlock()
+	if s == nil {
+		return errors.New("el broker ya es primario")
+	}
+	s.detener()
+	fmt.Println("Promocionando el broker a primario")
+	l.RescatarColasAnteriores()
+	go l.EjecutarBroker(ip)
+	if l.direccionReplicacion != "" {
+		go l.ejecutarReplicacion(l.direccionReplicacion)
+	}
+	return nil
+}
+
+// detener deja de replicar, espera a que termine la operación en curso y cierra los almacenes de las colas replicadas.
+func (s *Seguidor) detener() {
+	close(s.fin)
+	<-s.terminado
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.replica.cerrar()
+}
+
+// mostrar muestra en la consola el estado de la replicación.
+func (s *Seguidor) mostrar() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	estado := "desconectado"
+	if s.conectado {
+		estado = "conectado"
+	}
+	fmt.Println("Seguidor de", s.primario, "("+estado+"):", len(s.replica.colas), "colas replicadas, siguiente operación", s.secuencia)
+	s.replica.mostrar()
+}
+
+// ejecutar replica las colas del primario hasta que se detiene el seguidor, volviendo a conectar tras
+// cada error.
+func (s *Seguidor) ejecutar() {
+	defer close(s.terminado)
+	for {
+		err := s.replicar()
+		s.mux.Lock()
+		s.conectado = false
+		s.mux.Unlock()
+		select {
+		case <-s.fin:
+			return
+		default:
+		}
+		fmt.Println("Error al replicar desde el primario", s.primario+":", err)
+		select {
+		case <-s.fin:
+			return
+		case <-time.After(esperaReconexionReplica):
+		}
+	}
+}
+
+// replicar conecta con el primario, aplica una instantánea y después las operaciones posteriores,
+// hasta que falla la conexión o se detiene el seguidor.
+func (s *Seguidor) replicar() error {
+	cliente, err := rpc.Dial("tcp", s.primario)
+	if err != nil {
+		return err
+	}
+	defer cliente.Close()
+	var instantanea ReplyInstantanea
+	if err := s.llamar(cliente, "Replicacion.Instantanea", &ArgsInstantanea{}, &instantanea); err != nil {
+		return err
+	}
+	if err := s.aplicarInstantanea(&instantanea); err != nil {
+		return err
+	}
+	for {
+		s.mux.Lock()
+		desde := s.secuencia
+		s.mux.Unlock()
+		var reply ReplyReplicar
+		if err := s.llamar(cliente, "Replicacion.Replicar", &ArgsReplicar{Desde: desde, Espera: esperaReplicacion}, &reply); err != nil {
+			return err
+		}
+		if reply.Reiniciar {
+			return errReplicaAtrasada
+		}
+		for _, op := range reply.Operaciones {
+			if err := s.aplicar(op); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// llamar hace una llamada RPC al primario. Si el seguidor se detiene o el primario no responde en
+// `esperaReplicacion` más de lo que la llamada puede esperar, cierra la conexión y devuelve un error.
+func (s *Seguidor) llamar(cliente *rpc.Client, metodo string, args, reply any) error {
+	return llamarConPlazo(cliente, metodo, args, reply, 2*esperaReplicacion, s.fin)
+}
+
+// llamarConPlazo hace una llamada RPC a otro broker.
+//
+// Parámetros:
+// - plazo: El tiempo máximo que se espera la respuesta.
+// - fin: Un canal que, al cerrarse, deja de esperar.
+//
+// Retorna:
+// - El error de la llamada, o un error si vence el plazo o se cierra `fin`; en ambos casos cierra el cliente.
+func llamarConPlazo(cliente *rpc.Client, metodo string, args, reply any, plazo time.Duration, fin <-chan struct{}) error {
+	llamada := cliente.Go(metodo, args, reply, nil)
+	timer := time.NewTimer(plazo)
+	defer timer.Stop()
+	select {
+	case <-llamada.Done:
+		return llamada.Error
+	case <-timer.C:
+		cliente.Close()
+		return fmt.Errorf("el broker no responde a %s en %v", metodo, plazo)
+	case <-fin:
+		cliente.Close()
+		return errors.New("llamada cancelada")
+	}
+}
+
+// aplicarInstantanea sustituye las colas duraderas del seguidor por las de una instantánea y sigue
+// replicando desde la secuencia de la instantánea.
+func (s *Seguidor) aplicarInstantanea(instantanea *ReplyInstantanea) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.replica.cargar(instantanea.Colas); err != nil {
+		return err
+	}
+	s.secuencia = instantanea.Secuencia
+	s.conectado = true
+	fmt.Println("Instantánea del primario aplicada:", len(instantanea.Colas), "colas, desde la operación", instantanea.Secuencia)
+	return nil
+}
+
+// aplicar aplica una operación replicada y sigue replicando desde la siguiente.
+func (s *Seguidor) aplicar(op OperacionReplica) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.replica.aplicar(op); err != nil {
+		return err
+	}
+	s.secuencia = op.Secuencia + 1
+	return nil
+}
+
+// aplicar guarda una operación replicada en las colas de la réplica.
+func (r *replica) aplicar(op OperacionReplica) error {
+	var err error
+	switch op.Tipo {
+	case opDeclarar:
+		err = r.declarar(op.Cola)
+	case opPublicar:
+		err = r.publicar(op.Nombre, op.Mensaje)
+	case opConfirmar:
+		err = r.confirmar(op.Nombre, op.Offset)
+	case opBorrar:
+		err = r.borrar(op.Nombre)
+	default:
+		err = fmt.Errorf("operación replicada desconocida: %q", op.Tipo)
+	}
+	if err != nil {
+		return fmt.Errorf("operación %d (%s %s): %w", op.Secuencia, op.Tipo, op.Nombre, err)
+	}
+	return nil
+}
+
+// limpiar borra todas las colas duraderas del manifiesto del broker, incluidas las que quedaron de otra ejecución.
+func (r *replica) limpiar() error {
+	l := r.broker
+	l.mux.Lock()
+	nombres := make([]string, 0, len(l.manifiesto))
+	for nombre := range l.manifiesto {
+		nombres = append(nombres, nombre)
+	}
+	l.mux.Unlock()
+	for _, nombre := range nombres {
+		if err := r.borrar(nombre); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cargar sustituye las colas duraderas del broker por las colas especificadas con sus mensajes.
+func (r *replica) cargar(colas []ColaReplicada) error {
+	if err := r.limpiar(); err != nil {
+		return err
+	}
+	for _, replicada := range colas {
+		if err := r.declarar(replicada.Cola); err != nil {
+			return err
+		}
+		for _, m := range replicada.Mensajes {
+			if err := r.publicar(replicada.Cola.Nombre, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cerrar cierra los almacenes de las colas replicadas y vacía la réplica.
+func (r *replica) cerrar() {
+	for nombre, c := range r.colas {
+		if err := c.almacen.Cerrar(); err != nil {
+			fmt.Println("Error al cerrar el almacén de la cola replicada", nombre+":", err)
+		}
+	}
+	r.colas = make(map[string]*colaReplica)
+}
+
+// mostrar muestra en la consola las colas replicadas y sus mensajes sin confirmar.
+func (r *replica) mostrar() {
+	nombres := make([]string, 0, len(r.colas))
+	for nombre := range r.colas {
+		nombres = append(nombres, nombre)
+	}
+	sort.Strings(nombres)
+	for _, nombre := range nombres {
+		fmt.Println("  ", nombre, "-", len(r.colas[nombre].pendientes), "mensajes")
+	}
+}
+
+// declarar crea una cola replicada si no existe.
+func (r *replica) declarar(entrada EntradaManifiesto) error {
+	if _, ok := r.colas[entrada.Nombre]; ok {
+		return nil
+	}
+	if err := validarNombreDuradero(entrada.Nombre); err != nil {
+		return err
+	}
+	l := r.broker
+	l.mux.Lock()
+	entrada, err := l.registrarDuradera(entrada)
+	l.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	cod := codificacion{llavero: l.llavero, compresion: entrada.Compresion}
+	almacen, _, err := abrirAlmacen(entrada.Almacen, filepath.Join(l.datos, entrada.Directorio), entrada.Sincronizacion, cod)
+	if err != nil {
+		return err
+	}
+	r.colas[entrada.Nombre] = &colaReplica{almacen: almacen, pendientes: make(map[uint64]struct{})}
+	return nil
+}
+
+// publicar guarda un mensaje en una cola replicada si no lo tenía ya. El primario publica los mensajes
+// de cada cola en orden de offset, así que la réplica ya tiene los que tienen un offset anterior al siguiente.
+func (r *replica) publicar(nombre string, m Mensaje) error {
+	c, ok := r.colas[nombre]
+	if !ok {
+		return nil
+	}
+	if m.Offset < c.siguiente {
+		return nil
+	}
+	if err := c.almacen.Anadir(&m); err != nil {
+		return err
+	}
+	c.pendientes[m.Offset] = struct{}{}
+	c.siguiente = m.Offset + 1
+	return nil
+}
+
+// confirmar marca como consumido el mensaje con el offset especificado de una cola replicada.
+func (r *replica) confirmar(nombre string, offset uint64) error {
+	c, ok := r.colas[nombre]
+	if !ok {
+		return nil
+	}
+	if _, ok := c.pendientes[offset]; !ok {
+		return nil
+	}
+	delete(c.pendientes, offset)
+	return c.almacen.Confirmar(offset)
+}
+
+// borrar elimina una cola replicada y su almacén.
+func (r *replica) borrar(nombre string) error {
+	l := r.broker
+	l.mux.Lock()
+	entrada, enManifiesto := l.manifiesto[nombre]
+	var err error
+	if enManifiesto {
+		err = l.olvidarDuradera(nombre)
+	}
+	l.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	if c, ok := r.colas[nombre]; ok {
+		delete(r.colas, nombre)
+		return c.almacen.Borrar()
+	}
+	if enManifiesto {
+		return os.RemoveAll(filepath.Join(l.datos, entrada.Directorio))
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sesion representa la conexión de un cliente con el broker.
+// Cada conexión tiene su propio servidor RPC registrado con el nombre "Broker", de modo que los
+// métodos de la sesión conocen la conexión por la que llegan y pueden entregar mensajes por ella.
+// Los métodos de `Broker` se promueven a la sesión y siguen disponibles para el cliente.
+type Sesion struct {
+	*Broker
+	mux           sync.Mutex
+	suscripciones map[string]*Suscripcion
+	// conn es la conexión del cliente; registra el momento de la última actividad recibida.
+	conn *conexionVigilada
+	// fin se cierra cuando la conexión termina.
+	fin <-chan struct{}
+	// latido es el intervalo de latidos negociado con `Conectar`; cero si no se ha negociado.
+	latido time.Duration
+	// compresion es el algoritmo de compresión negociado con `Conectar`; vacío si no se ha negociado.
+	compresion string
+	// llamadas guarda un canal por cada llamada en curso que se puede abortar y abortadas el momento en
+	// que se abortaron las llamadas que aún no han empezado (ver `Abortar`).
+	llamadas  map[uint64]chan struct{}
+	abortadas map[uint64]time.Time
+}
+
+// Suscripcion representa un consumidor suscrito a una cola a través de una sesión.
+// El broker deja cada mensaje en `entregas`, el consumidor lo recoge con `SiguienteEntrega`
+// y devuelve el resultado de su callback por `confirmaciones`. El canal `fin` se cierra
+// cuando la suscripción termina.
+// Si `tiempoEntrega` es mayor que cero, cada entrega debe recogerse y confirmarse dentro de ese plazo.
+type Suscripcion struct {
+	tag            string
+	nombre         string
+	entregas       chan ReplyEntrega
+	confirmaciones chan ArgsConfirmarEntrega
+	fin            chan struct{}
+	cerrar         sync.Once
+	tiempoEntrega  time.Duration
+	// entregados, fallidos y vencidos cuentan las entregas confirmadas, las que fallaron en el
+	// callback y las que agotaron el tiempo de entrega.
+	entregados atomic.Uint64
+	fallidos   atomic.Uint64
+	vencidos   atomic.Uint64
+}
+
+// EstadisticasConsumidor representa los contadores de entregas de una suscripción.
+type EstadisticasConsumidor struct {
+	Entregados uint64
+	Fallidos   uint64
+	Vencidos   uint64
+}
+
+// Estados en los que puede acabar una entrega.
+const (
+	entregaConfirmada = iota
+	entregaVencida
+	entregaTerminada
+)
+
+// ArgsCancelar representa los argumentos para cancelar una suscripción.
+// Contiene la etiqueta de consumidor devuelta por `Consumir`.
+type ArgsCancelar struct {
+	Tag string
+}
+
+// ArgsSiguienteEntrega representa los argumentos para recoger la siguiente entrega de una suscripción.
+type ArgsSiguienteEntrega struct {
+	Tag string
+}
+
+// ReplyEntrega representa un mensaje entregado a un consumidor.
+// Fin es verdadero si la suscripción ha terminado y no habrá más entregas.
+// ID y Cabeceras son el identificador y las cabeceras con que se publicó el mensaje.
+// Compresion es el algoritmo con que está comprimido Mensaje, o vacío si no lo está.
+type ReplyEntrega struct {
+	Mensaje    string
+	Etiqueta   uint64
+	Fin        bool
+	ID         string
+	Cabeceras  map[string]string
+	Compresion string
+}
+
+// ArgsConfirmarEntrega representa el resultado del callback del consumidor para una entrega.
+// Error está vacío si el callback terminó correctamente.
+type ArgsConfirmarEntrega struct {
+	Tag      string
+	Etiqueta uint64
+	Error    string
+}
+
+// atenderConexion atiende las llamadas RPC de un cliente conectado hasta que cierra la conexión.
+//
+// Parámetros:
+// - conn: La conexión aceptada del cliente.
+//
+// Comportamiento:
+// - Crea una sesión para la conexión y la registra en un servidor RPC propio con el nombre "Broker".
+// - Sirve las llamadas con `ServeConn` hasta que la conexión se cierra.
+// - Si el cliente negocia latidos con `Conectar`, la conexión se cierra cuando deja de enviarlos.
+// - Al cerrarse la conexión termina todas las suscripciones de la sesión, lo que devuelve a sus colas los mensajes que estuvieran en curso.
+func (l *Broker) atenderConexion(conn net.Conn) {
+	vigilada := &conexionVigilada{Conn: conn, cerrada: make(chan struct{})}
+	vigilada.actividad()
+	sesion := &Sesion{
+		Broker:        l,
+		suscripciones: make(map[string]*Suscripcion),
+		llamadas:      make(map[uint64]chan struct{}),
+		abortadas:     make(map[uint64]time.Time),
+		conn:          vigilada,
+		fin:           vigilada.cerrada,
+	}
+	servidor := rpc.NewServer()
+	if err := servidor.RegisterName("Broker", sesion); err != nil {
+		fmt.Println("Error al registrar la sesión:", err)
+		conn.Close()
+		return
+	}
+	l.mux.Lock()
+	if l.apagandose() {
+		l.mux.Unlock()
+		conn.Close()
+		return
+	}
+	l.sesiones[sesion] = struct{}{}
+	l.mux.Unlock()
+	defer func() {
+		l.mux.Lock()
+		delete(l.sesiones, sesion)
+		l.mux.Unlock()
+	}()
+	// Las suscripciones se cancelan en cuanto se pierde la conexión: `ServeConn` no termina
+	// hasta que acaban las llamadas en curso, y `SiguienteEntrega` solo acaba al cancelarlas.
+	go func() {
+		<-sesion.fin
+		sesion.mux.Lock()
+		defer sesion.mux.Unlock()
+		for _, sus := range sesion.suscripciones {
+			sesion.cancelar(sus)
+		}
+	}()
+	servidor.ServeConn(vigilada)
+	fmt.Println("Cliente desconectado")
+}
+
+// Consumir es un método RPC que suscribe al cliente de la sesión a una cola.
+// Los mensajes se entregan por la misma conexión: el cliente los recoge con `SiguienteEntrega`
+// y devuelve el resultado de su callback con `ConfirmarEntrega`.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsConsumir` que contiene el nombre de la cola.
+// - reply: Un puntero a una estructura `ReplyConsumir` donde se devuelve la etiqueta de consumidor.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la cola no existe.
+func (s *Sesion) Consumir(args *ArgsConsumir, reply *ReplyConsumir) error {
+	if _, ok := s.cola(args.Nombre); !ok {
+		return fmt.Errorf("la cola %s no existe", args.Nombre)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	select {
+	case <-s.fin:
+		return fmt.Errorf("la conexión se ha cerrado")
+	default:
+	}
+	sus := &Suscripcion{
+		tag:            "ctag-" + strconv.FormatUint(s.siguienteTag.Add(1), 10),
+		nombre:         args.Nombre,
+		entregas:       make(chan ReplyEntrega),
+		confirmaciones: make(chan ArgsConfirmarEntrega, 1),
+		fin:            make(chan struct{}),
+		tiempoEntrega:  args.TiempoEntrega,
+	}
+	s.suscripciones[sus.tag] = sus
+	s.Broker.mux.Lock()
+	s.consumidores[args.Nombre] = append(s.consumidores[args.Nombre], sus)
+	s.Broker.mux.Unlock()
+	go s.Leer(args.Nombre, sus)
+	reply.Tag = sus.tag
+	return nil
+}
+
+// Cancelar es un método RPC que cancela una suscripción de la sesión.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsCancelar` con la etiqueta de consumidor devuelta por `Consumir`.
+// - reply: Un puntero a una estructura `Reply` que puede contener la respuesta del servidor RPC.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la suscripción no existe.
+//
+// Comportamiento:
+// - Detiene las entregas de la suscripción; el mensaje en curso que no se haya confirmado vuelve a la cola.
+// - Elimina al consumidor de la lista de consumidores de la cola.
+// - Una llamada a `SiguienteEntrega` que estuviera esperando devuelve `Fin` a verdadero.
+func (s *Sesion) Cancelar(args *ArgsCancelar, reply *Reply) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sus, ok := s.suscripciones[args.Tag]
+	if !ok {
+		return fmt.Errorf("etiqueta de consumidor desconocida: %s", args.Tag)
+	}
+	s.cancelar(sus)
+	fmt.Println("Suscripción cancelada", args.Tag)
+	return nil
+}
+
+// cancelar termina una suscripción y la elimina de la sesión y de la lista de consumidores de su cola.
+// Debe llamarse con `s.mux` bloqueado.
+//
+// Parámetros:
+// - sus: La suscripción a cancelar.
+func (s *Sesion) cancelar(sus *Suscripcion) {
+	sus.terminar()
+	delete(s.suscripciones, sus.tag)
+	s.Broker.mux.Lock()
+	defer s.Broker.mux.Unlock()
+	lista := s.consumidores[sus.nombre]
+	for i, otra := range lista {
+		if otra == sus {
+			s.consumidores[sus.nombre] = append(lista[:i:i], lista[i+1:]...)
+			break
+		}
+	}
+}
+
+// suscripcion devuelve la suscripción de la sesión con la etiqueta de consumidor especificada.
+//
+// Parámetros:
+// - tag: La etiqueta de consumidor devuelta por `Consumir`.
+//
+// Retorna:
+// - La suscripción, o un error si la sesión no tiene ninguna con esa etiqueta.
+func (s *Sesion) suscripcion(tag string) (*Suscripcion, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sus, ok := s.suscripciones[tag]
+	if !ok {
+		return nil, fmt.Errorf("etiqueta de consumidor desconocida: %s", tag)
+	}
+	return sus, nil
+}
+
+// SiguienteEntrega es un método RPC que espera el siguiente mensaje de una suscripción de la sesión.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsSiguienteEntrega` con la etiqueta de consumidor.
+// - reply: Un puntero a una estructura `ReplyEntrega` donde se devuelve el mensaje y su etiqueta de entrega.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la suscripción no existe.
+//
+// Comportamiento:
+// - Se bloquea hasta que el broker entrega un mensaje a la suscripción.
+// - Si la sesión ha negociado compresión, puede devolver el mensaje comprimido (ver `comprimirEntrega`).
+// - Si la suscripción termina mientras espera, devuelve `reply.Fin` a verdadero.
+func (s *Sesion) SiguienteEntrega(args *ArgsSiguienteEntrega, reply *ReplyEntrega) error {
+	sus, err := s.suscripcion(args.Tag)
+	if err != nil {
+		return err
+	}
+	select {
+	case entrega := <-sus.entregas:
+		*reply = entrega
+		reply.Compresion = s.comprimirEntrega(sus.nombre, &reply.Mensaje)
+	case <-sus.fin:
+		reply.Fin = true
+	}
+	return nil
+}
+
+// ConfirmarEntrega es un método RPC con el que el consumidor informa del resultado de su callback
+// para una entrega.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsConfirmarEntrega` con la etiqueta de consumidor, la etiqueta de entrega y el error del callback, si lo hubo.
+// - reply: Un puntero a una estructura `Reply` que puede contener la respuesta del servidor RPC.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la suscripción no existe.
+func (s *Sesion) ConfirmarEntrega(args *ArgsConfirmarEntrega, reply *Reply) error {
+	sus, err := s.suscripcion(args.Tag)
+	if err != nil {
+		return err
+	}
+	select {
+	case sus.confirmaciones <- *args:
+	case <-sus.fin:
+	}
+	return nil
+}
+
+// EstadisticasConsumidor es un método RPC que devuelve los contadores de entregas de una suscripción de la sesión.
+//
+// Parámetros:
+// - args: Un puntero a una estructura `ArgsCancelar` con la etiqueta de consumidor.
+// - reply: Un puntero a una estructura `EstadisticasConsumidor` donde se devuelven los contadores.
+//
+// Retorna:
+// - Un valor de tipo `error` que es `nil` si la operación es exitosa, o un error si la suscripción no existe.
+func (s *Sesion) EstadisticasConsumidor(args *ArgsCancelar, reply *EstadisticasConsumidor) error {
+	sus, err := s.suscripcion(args.Tag)
+	if err != nil {
+		return err
+	}
+	*reply = sus.estadisticas()
+	return nil
+}
+
+// entregar deja un mensaje para que el consumidor lo recoja y espera la confirmación de su callback,
+// descartando las confirmaciones de entregas anteriores.
+//
+// Parámetros:
+// - entrega: El mensaje y su etiqueta de entrega.
+//
+// Retorna:
+// - El error del callback (vacío si terminó correctamente).
+// - El estado de la entrega: confirmada, vencida si se agotó el tiempo de entrega o terminada si la suscripción terminó antes.
+func (sus *Suscripcion) entregar(entrega ReplyEntrega) (string, int) {
+	var plazo <-chan time.Time
+	if sus.tiempoEntrega > 0 {
+		timer := time.NewTimer(sus.tiempoEntrega)
+		defer timer.Stop()
+		plazo = timer.C
+	}
+	select {
+	case sus.entregas <- entrega:
+	case <-plazo:
+		return "", entregaVencida
+	case <-sus.fin:
+		return "", entregaTerminada
+	}
+	for {
+		select {
+		case confirmacion := <-sus.confirmaciones:
+			if confirmacion.Etiqueta == entrega.Etiqueta {
+				return confirmacion.Error, entregaConfirmada
+			}
+		case <-plazo:
+			return "", entregaVencida
+		case <-sus.fin:
+			return "", entregaTerminada
+		}
+	}
+}
+
+// estadisticas devuelve una copia de los contadores de entregas de la suscripción.
+func (sus *Suscripcion) estadisticas() EstadisticasConsumidor {
+	return EstadisticasConsumidor{
+		Entregados: sus.entregados.Load(),
+		Fallidos:   sus.fallidos.Load(),
+		Vencidos:   sus.vencidos.Load(),
+	}
+}
+
+// terminar cierra la suscripción; la goroutine `Leer` asociada devuelve el mensaje en curso y termina.
+// Puede llamarse varias veces.
+func (sus *Suscripcion) terminar() {
+	sus.cerrar.Do(func() { close(sus.fin) })
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Modos de sincronización con el disco de las colas duraderas.
+//
+// - syncSiempre: cada publicación se sincroniza con el disco antes de confirmarse al productor.
+// - syncGrupo: las publicaciones se sincronizan juntas cada cierto intervalo y cada una se confirma al productor tras la sincronización que la incluye.
+// - syncSO: las publicaciones se confirman en cuanto se escriben y el sistema operativo decide cuándo llegan al disco.
+const (
+	syncSiempre = "siempre"
+	syncGrupo   = "grupo"
+	syncSO      = "so"
+)
+
+// intervaloGrupoPorDefecto es el intervalo de sincronización del modo `syncGrupo` si no se indica otro.
+const intervaloGrupoPorDefecto = 10 * time.Millisecond
+
+// PoliticaSync indica cuándo se sincronizan con el disco las publicaciones de una cola duradera
+// y, por tanto, cuándo se confirman al productor.
+type PoliticaSync struct {
+	Modo string
+	// Intervalo es el tiempo entre sincronizaciones en el modo `syncGrupo`.
+	Intervalo time.Duration
+}
+
+// nuevaPoliticaSync valida un modo de sincronización y devuelve la política correspondiente.
+//
+// Parámetros:
+// - modo: `syncSiempre`, `syncGrupo` o `syncSO`.
+// - intervalo: El intervalo de sincronización del modo `syncGrupo`; si es cero se usa `intervaloGrupoPorDefecto`.
+//
+// Retorna:
+// - La política y un error si el modo o el intervalo no son válidos.
+func nuevaPoliticaSync(modo string, intervalo time.Duration) (PoliticaSync, error) {
+	switch modo {
+	case syncSiempre, syncSO:
+		return PoliticaSync{Modo: modo}, nil
+	case syncGrupo:
+		if intervalo < 0 {
+			return PoliticaSync{}, fmt.Errorf("intervalo de sincronización negativo: %v", intervalo)
+		}
+		if intervalo == 0 {
+			intervalo = intervaloGrupoPorDefecto
+		}
+		return PoliticaSync{Modo: modo, Intervalo: intervalo}, nil
+	}
+	return PoliticaSync{}, fmt.Errorf("modo de sincronización desconocido: %q (use %s, %s o %s)", modo, syncSiempre, syncGrupo, syncSO)
+}
+
+// String devuelve la política en el formato en que se muestra al listar las colas.
+func (p PoliticaSync) String() string {
+	if p.Modo == syncGrupo {
+		return fmt.Sprintf("%s cada %v", p.Modo, p.Intervalo)
+	}
+	return p.Modo
+}
+
+// politicaCola devuelve la política de sincronización de una cola que se declara con los argumentos
+// especificados: la indicada en la declaración o, si no se indica ninguna, la del broker.
+func (l *Broker) politicaCola(args *ArgsDeclararCola) (PoliticaSync, error) {
+	if args.Sincronizacion == "" {
+		return l.politicaSync, nil
+	}
+	return nuevaPoliticaSync(args.Sincronizacion, args.IntervaloSincronizacion)
+}
+
+// sincronizador lleva la cuenta de qué mensajes de un almacén están ya en el disco y hace esperar a las
+// publicaciones hasta que lo estén, según la política del almacén. Salvo `periodicamente`, sus métodos
+// deben llamarse con el mutex del almacén bloqueado.
+type sincronizador struct {
+	politica PoliticaSync
+	// sincronizado es el primer offset que puede no estar aún en el disco.
+	sincronizado uint64
+	// err es el error de la última escritura o sincronización fallida. Tras un fallo el almacén no
+	// acepta más mensajes, porque no se puede saber qué parte de lo escrito llegó al disco.
+	err     error
+	cerrado bool
+	// cambio avisa a los que esperan en `esperar` de que ha cambiado `sincronizado`, `err` o `cerrado`.
+	cambio *sync.Cond
+}
+
+// nuevoSincronizador crea un sincronizador para un almacén protegido por el mutex especificado cuyos
+// mensajes anteriores a `sincronizado` ya están en el disco.
+func nuevoSincronizador(politica PoliticaSync, mux *sync.Mutex, sincronizado uint64) *sincronizador {
+	return &sincronizador{politica: politica, sincronizado: sincronizado, cambio: sync.NewCond(mux)}
+}
+
+// fallo anota un error de escritura o sincronización, avisa a los que esperan y devuelve el error.
+func (s *sincronizador) fallo(err error) error {
+	s.err = err
+	s.cambio.Broadcast()
+	return err
+}
+
+// sincronizar sincroniza con el disco el archivo especificado, que contiene los mensajes anteriores a
+// `hasta`, y avisa a los que esperan esos mensajes.
+func (s *sincronizador) sincronizar(archivo *os.File, hasta uint64) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.sincronizado >= hasta {
+		return nil
+	}
+	if err := archivo.Sync(); err != nil {
+		return s.fallo(fmt.Errorf("error al sincronizar %s: %w", archivo.Name(), err))
+	}
+	s.sincronizado = hasta
+	s.cambio.Broadcast()
+	return nil
+}
+
+// esperar espera a que el mensaje con el offset especificado esté en el disco según la política.
+//
+// Retorna:
+// - Un error si la sincronización falló o el almacén se cerró sin sincronizar el mensaje.
+//
+// Comportamiento:
+// - Con las políticas `syncSiempre` y `syncSO` retorna enseguida: el almacén ya sincronizó el mensaje al escribirlo o la sincronización se deja al sistema operativo.
+// - Con la política `syncGrupo` espera a la siguiente sincronización periódica.
+func (s *sincronizador) esperar(offset uint64) error {
+	if s.politica.Modo != syncGrupo {
+		return nil
+	}
+	for s.sincronizado <= offset && s.err == nil && !s.cerrado {
+		s.cambio.Wait()
+	}
+	switch {
+	case s.sincronizado > offset:
+		return nil
+	case s.err != nil:
+		return s.err
+	}
+	return errAlmacenCerrado
+}
+
+// cerrar marca el almacén como cerrado y despierta a los que esperan.
+func (s *sincronizador) cerrar() {
+	s.cerrado = true
+	s.cambio.Broadcast()
+}
+
+// periodicamente llama a `sincronizar` con el mutex bloqueado cada `politica.Intervalo` hasta que se
+// cierra `fin`, de modo que todas las publicaciones de cada intervalo comparten una única sincronización.
+func (s *sincronizador) periodicamente(mux *sync.Mutex, fin <-chan struct{}, sincronizar func() error) {
+	ticker := time.NewTicker(s.politica.Intervalo)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fin:
+			return
+		case <-ticker.C:
+			mux.Lock()
+			if !s.cerrado && s.err == nil {
+				if err := sincronizar(); err != nil {
+					fmt.Println(err)
+				}
+			}
+			mux.Unlock()
+		}
+	}
+}
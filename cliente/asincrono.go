@@ -0,0 +1,107 @@
+package cliente
+
+import (
+	"context"
+	"errors"
+)
+
+// MaxEnVuelo es el número máximo de publicaciones asíncronas sin confirmar de un publicador creado con
+// `NuevoPublicador`.
+const MaxEnVuelo = 256
+
+// Publicacion es el resultado futuro de una publicación asíncrona. Se completa cuando el broker confirma
+// el mensaje o la publicación falla.
+type Publicacion struct {
+	Mensaje Mensaje
+	hecha   chan struct{}
+	err     error
+}
+
+// Hecha devuelve un canal que se cierra cuando la publicación se completa.
+func (pub *Publicacion) Hecha() <-chan struct{} {
+	return pub.hecha
+}
+
+// Err devuelve el error de la publicación, o nil si se publicó correctamente o todavía no se ha completado.
+func (pub *Publicacion) Err() error {
+	select {
+	case <-pub.hecha:
+		return pub.err
+	default:
+		return nil
+	}
+}
+
+// Esperar espera a que la publicación se complete.
+//
+// Retorna:
+// - El error de la publicación, o el del contexto si se cancela antes.
+func (pub *Publicacion) Esperar(ctx context.Context) error {
+	select {
+	case <-pub.hecha:
+		return pub.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PublicarAsincrono publica un mensaje sin esperar la confirmación del broker, igual que `PublicarMensaje`.
+// Si el publicador ya tiene su máximo de publicaciones sin confirmar, espera a que se confirme alguna.
+// Las publicaciones asíncronas se envían en paralelo, así que pueden llegar a la cola en otro orden.
+//
+// Parámetros:
+// - ctx: El contexto que limita la espera por un hueco y la publicación.
+// - m: El mensaje a publicar.
+//
+// Retorna:
+// - La publicación en curso, y un error si se cancela el contexto antes de poder enviarla.
+func (p *Publicador) PublicarAsincrono(ctx context.Context, m Mensaje) (*Publicacion, error) {
+	select {
+	case p.enVuelo <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	pub := &Publicacion{Mensaje: m, hecha: make(chan struct{})}
+	p.mux.Lock()
+	if p.pendientes == 0 {
+		p.vacio = make(chan struct{})
+	}
+	p.pendientes++
+	p.mux.Unlock()
+	go func() {
+		pub.err = p.PublicarMensaje(ctx, m)
+		close(pub.hecha)
+		<-p.enVuelo
+		p.mux.Lock()
+		defer p.mux.Unlock()
+		if pub.err != nil {
+			p.fallidas = append(p.fallidas, pub.err)
+		}
+		p.pendientes--
+		if p.pendientes == 0 {
+			close(p.vacio)
+		}
+	}()
+	return pub, nil
+}
+
+// Vaciar espera a que se completen todas las publicaciones asíncronas en curso.
+//
+// Retorna:
+// - Los errores de las publicaciones asíncronas que han fallado desde el anterior `Vaciar`, unidos con
+// `errors.Join`, o el error del contexto si se cancela antes de que terminen.
+func (p *Publicador) Vaciar(ctx context.Context) error {
+	p.mux.Lock()
+	vacio := p.vacio
+	p.mux.Unlock()
+	select {
+	case <-vacio:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	err := errors.Join(p.fallidas...)
+	p.fallidas = nil
+	return err
+}
@@ -0,0 +1,136 @@
+package cliente
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPublicarAsincronoErrores comprueba que el error de una publicación asíncrona que falla aparece en
+// su `Publicacion` y en el de `Vaciar`, que solo lo devuelve una vez.
+func TestPublicarAsincronoErrores(t *testing.T) {
+	b := arrancarBrokerPrueba(t)
+	conexion := conectarPrueba(t, b)
+	ctx := context.Background()
+	publicador := NuevoPublicador(conexion)
+	if err := publicador.Declarar(ctx, "cola", false); err != nil {
+		t.Fatal("Error al declarar la cola:", err)
+	}
+	bien, err := publicador.PublicarAsincrono(ctx, Mensaje{Cola: "cola", Cuerpo: "bien"})
+	if err != nil {
+		t.Fatal("Error al publicar:", err)
+	}
+	mal, err := publicador.PublicarAsincrono(ctx, Mensaje{Cola: "inexistente", Cuerpo: "mal"})
+	if err != nil {
+		t.Fatal("Error al publicar:", err)
+	}
+
+	err = publicador.Vaciar(ctx)
+	for _, pub := range []*Publicacion{bien, mal} {
+		select {
+		case <-pub.Hecha():
+		default:
+			t.Fatalf("La publicación de %q no se ha completado tras Vaciar", pub.Mensaje.Cuerpo)
+		}
+	}
+	if err := bien.Err(); err != nil {
+		t.Fatal("La publicación correcta devuelve", err)
+	}
+	if mal.Err() == nil || !strings.Contains(mal.Err().Error(), "no existe") {
+		t.Fatal("La publicación en una cola que no existe devuelve", mal.Err())
+	}
+	if !errors.Is(err, mal.Err()) {
+		t.Fatalf("Vaciar devuelve %v en lugar del error de la publicación fallida, %v", err, mal.Err())
+	}
+	if err := publicador.Vaciar(ctx); err != nil {
+		t.Fatal("El segundo Vaciar devuelve", err, "en lugar de nil")
+	}
+	if recibidos := b.vaciar("cola"); !slices.Equal(recibidos, []string{"bien"}) {
+		t.Fatalf("La cola tiene %q en lugar de solo \"bien\"", recibidos)
+	}
+}
+
+// TestPublicarAsincronoLimite comprueba que, con `MaxEnVuelo` publicaciones sin confirmar, la siguiente
+// espera hasta que se cancela su contexto o se confirma alguna de las anteriores.
+func TestPublicarAsincronoLimite(t *testing.T) {
+	b := arrancarBrokerPrueba(t)
+	conexion := conectarPrueba(t, b)
+	ctx := context.Background()
+	publicador := NuevoPublicador(conexion)
+	if err := publicador.Declarar(ctx, "cola", false); err != nil {
+		t.Fatal("Error al declarar la cola:", err)
+	}
+	permisos := b.retener()
+	for i := 0; i < MaxEnVuelo; i++ {
+		if _, err := publicador.PublicarAsincrono(ctx, Mensaje{Cola: "cola", Cuerpo: "retenido"}); err != nil {
+			t.Fatal("Error al publicar:", err)
+		}
+	}
+
+	// Sin hueco libre, la publicación espera hasta que se cancela su contexto.
+	cancelable, cancelar := context.WithCancel(ctx)
+	resultado := publicarAsincronoPrueba(cancelable, publicador, "cancelado")
+	sinTerminarPrueba(t, resultado)
+	cancelar()
+	if r := esperarResultadoPrueba(t, resultado); r.pub != nil || !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("La publicación cancelada devuelve %v, %v en lugar del error del contexto", r.pub, r.err)
+	}
+
+	// Al confirmarse una de las anteriores, la publicación ocupa el hueco libre.
+	resultado = publicarAsincronoPrueba(ctx, publicador, "ultimo")
+	sinTerminarPrueba(t, resultado)
+	permisos <- struct{}{}
+	if r := esperarResultadoPrueba(t, resultado); r.err != nil {
+		t.Fatal("Error al publicar tras liberarse un hueco:", r.err)
+	}
+
+	close(permisos)
+	if err := publicador.Vaciar(ctx); err != nil {
+		t.Fatal("Error al vaciar el publicador:", err)
+	}
+	if n := len(b.vaciar("cola")); n != MaxEnVuelo+1 {
+		t.Fatal("La cola tiene", n, "mensajes en lugar de", MaxEnVuelo+1)
+	}
+}
+
+// resultadoPrueba es lo que devuelve una llamada a `PublicarAsincrono` hecha en segundo plano.
+type resultadoPrueba struct {
+	pub *Publicacion
+	err error
+}
+
+// publicarAsincronoPrueba llama en segundo plano a `PublicarAsincrono` y devuelve el canal por el que llega
+// su resultado.
+func publicarAsincronoPrueba(ctx context.Context, publicador *Publicador, cuerpo string) <-chan resultadoPrueba {
+	resultado := make(chan resultadoPrueba, 1)
+	go func() {
+		pub, err := publicador.PublicarAsincrono(ctx, Mensaje{Cola: "cola", Cuerpo: cuerpo})
+		resultado <- resultadoPrueba{pub, err}
+	}()
+	return resultado
+}
+
+// sinTerminarPrueba comprueba que una llamada en segundo plano sigue esperando al cabo de un rato.
+func sinTerminarPrueba(t *testing.T, resultado <-chan resultadoPrueba) {
+	t.Helper()
+	select {
+	case r := <-resultado:
+		t.Fatalf("PublicarAsincrono no espera con todos los huecos ocupados: %v, %v", r.pub, r.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// esperarResultadoPrueba espera hasta `esperaPrueba` el resultado de una llamada en segundo plano.
+func esperarResultadoPrueba(t *testing.T, resultado <-chan resultadoPrueba) resultadoPrueba {
+	t.Helper()
+	select {
+	case r := <-resultado:
+		return r
+	case <-time.After(esperaPrueba):
+		t.Fatal("PublicarAsincrono no ha terminado en", esperaPrueba)
+		return resultadoPrueba{}
+	}
+}
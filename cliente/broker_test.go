@@ -0,0 +1,362 @@
+package cliente
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Broker de prueba.
+//
+// El broker MOM es un programa (package main) y no se puede importar desde las pruebas, así que las
+// pruebas de la biblioteca hablan con `brokerPrueba`, un broker mínimo en un puerto libre de 127.0.0.1
+// que atiende la misma API RPC: cada conexión tiene su propia sesión registrada con el nombre "Broker",
+// las colas guardan en orden los mensajes publicados y cada suscripción entrega los mensajes de su cola
+// de uno en uno y apunta las confirmaciones. Los tipos de los argumentos y respuestas reproducen los del
+// broker con los campos que usan las pruebas.
+
+// esperaPrueba es el tiempo máximo que las pruebas esperan a que se cumpla una condición.
+const esperaPrueba = 10 * time.Second
+
+// capacidadColaPrueba es el número de mensajes que admite cada cola del broker de prueba.
+const capacidadColaPrueba = 1024
+
+// ArgsConectar son los argumentos de `Broker.Conectar`.
+type ArgsConectar struct {
+	Latido     time.Duration
+	Compresion []string
+}
+
+// ReplyConectar es la respuesta de `Broker.Conectar`.
+type ReplyConectar struct {
+	Latido     time.Duration
+	Compresion string
+}
+
+// ArgsLatido son los argumentos de `Broker.Latido`.
+type ArgsLatido struct {
+	Secuencia uint64
+}
+
+// ArgsAbortar son los argumentos de `Broker.Abortar`.
+type ArgsAbortar struct {
+	Llamada uint64
+}
+
+// ArgsDeclararCola son los argumentos de `Broker.Declarar_cola`.
+type ArgsDeclararCola struct {
+	Nombre     string
+	Durability bool
+}
+
+// ArgsPublicar son los argumentos de `Broker.Publicar`.
+type ArgsPublicar struct {
+	Nombre  string
+	Mensaje string
+	Llamada uint64
+}
+
+// ArgsConsumir son los argumentos de `Broker.Consumir`.
+type ArgsConsumir struct {
+	Nombre        string
+	TiempoEntrega time.Duration
+}
+
+// ReplyConsumir es la respuesta de `Broker.Consumir`.
+type ReplyConsumir struct {
+	Tag string
+}
+
+// ArgsSiguienteEntrega son los argumentos de `Broker.SiguienteEntrega`.
+type ArgsSiguienteEntrega struct {
+	Tag string
+}
+
+// ReplyEntrega es la respuesta de `Broker.SiguienteEntrega`.
+type ReplyEntrega struct {
+	Mensaje  string
+	Etiqueta uint64
+	Fin      bool
+}
+
+// ArgsConfirmarEntrega son los argumentos de `Broker.ConfirmarEntrega`.
+type ArgsConfirmarEntrega struct {
+	Tag      string
+	Etiqueta uint64
+	Error    string
+}
+
+// Reply es la respuesta de las llamadas que no devuelven nada más.
+type Reply struct {
+	Mensaje string
+}
+
+// brokerPrueba es el broker de prueba. mux protege el resto de campos: las colas por nombre, las sesiones
+// abiertas, el número de llamadas a `Consumir`, las confirmaciones recibidas, en orden, y los permisos
+// que esperan las publicaciones si se retienen con `retener`.
+type brokerPrueba struct {
+	direccion      string
+	listener       net.Listener
+	mux            sync.Mutex
+	colas          map[string]chan string
+	sesiones       map[*sesionPrueba]struct{}
+	suscripciones  int
+	confirmaciones []ArgsConfirmarEntrega
+	etiquetas      uint64
+	permisos       chan struct{}
+}
+
+// sesionPrueba es la sesión de una conexión con el broker de prueba. fin se cierra al cerrarse la
+// conexión y consumidores guarda la cola de cada etiqueta de consumidor de la sesión.
+type sesionPrueba struct {
+	broker       *brokerPrueba
+	conn         net.Conn
+	fin          chan struct{}
+	consumidores map[string]string
+}
+
+// arrancarBrokerPrueba arranca un broker de prueba en un puerto libre de 127.0.0.1 que se detiene al
+// terminar la prueba.
+func arrancarBrokerPrueba(t *testing.T) *brokerPrueba {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &brokerPrueba{
+		direccion: ln.Addr().String(),
+		listener:  ln,
+		colas:     make(map[string]chan string),
+		sesiones:  make(map[*sesionPrueba]struct{}),
+	}
+	go b.aceptar()
+	t.Cleanup(func() {
+		ln.Close()
+		b.cortar()
+	})
+	return b
+}
+
+// aceptar atiende cada conexión con su propia sesión hasta que se cierra el listener.
+func (b *brokerPrueba) aceptar() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		s := &sesionPrueba{broker: b, conn: conn, fin: make(chan struct{}), consumidores: make(map[string]string)}
+		b.mux.Lock()
+		b.sesiones[s] = struct{}{}
+		b.mux.Unlock()
+		servidor := rpc.NewServer()
+		servidor.RegisterName("Broker", s)
+		go func() {
+			servidor.ServeConn(conn)
+			b.terminar(s)
+		}()
+	}
+}
+
+// terminar cierra la conexión de una sesión y la da por terminada, si no lo estaba ya.
+func (b *brokerPrueba) terminar(s *sesionPrueba) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if _, ok := b.sesiones[s]; !ok {
+		return
+	}
+	delete(b.sesiones, s)
+	s.conn.Close()
+	close(s.fin)
+}
+
+// cortar cierra las conexiones de todas las sesiones, como si se cayera la red.
+func (b *brokerPrueba) cortar() {
+	b.mux.Lock()
+	sesiones := make([]*sesionPrueba, 0, len(b.sesiones))
+	for s := range b.sesiones {
+		sesiones = append(sesiones, s)
+	}
+	b.mux.Unlock()
+	for _, s := range sesiones {
+		b.terminar(s)
+	}
+}
+
+// reiniciar corta todas las conexiones y olvida las colas, como si el broker se reiniciara.
+func (b *brokerPrueba) reiniciar() {
+	b.cortar()
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	clear(b.colas)
+}
+
+// retener hace que cada publicación espere un permiso del canal devuelto antes de añadir el mensaje a su
+// cola; al cerrar el canal se sueltan todas.
+func (b *brokerPrueba) retener() chan<- struct{} {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.permisos = make(chan struct{})
+	return b.permisos
+}
+
+// cola devuelve la cola con el nombre especificado, si existe.
+func (b *brokerPrueba) cola(nombre string) (chan string, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	cola, ok := b.colas[nombre]
+	return cola, ok
+}
+
+// vaciar saca los mensajes que hay en una cola y devuelve sus contenidos.
+func (b *brokerPrueba) vaciar(nombre string) []string {
+	cola, _ := b.cola(nombre)
+	var mensajes []string
+	for {
+		select {
+		case m := <-cola:
+			mensajes = append(mensajes, m)
+		default:
+			return mensajes
+		}
+	}
+}
+
+// numSuscripciones devuelve el número de llamadas a `Consumir` que ha atendido el broker.
+func (b *brokerPrueba) numSuscripciones() int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.suscripciones
+}
+
+// confirmadas devuelve una copia de las confirmaciones recibidas.
+func (b *brokerPrueba) confirmadas() []ArgsConfirmarEntrega {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return slices.Clone(b.confirmaciones)
+}
+
+// Conectar acepta el intervalo de latidos que propone el cliente, sin compresión.
+func (s *sesionPrueba) Conectar(args *ArgsConectar, reply *ReplyConectar) error {
+	reply.Latido = args.Latido
+	return nil
+}
+
+// Latido responde a un latido.
+func (s *sesionPrueba) Latido(args *ArgsLatido, reply *Reply) error {
+	return nil
+}
+
+// Abortar acepta la petición; ninguna llamada del broker de prueba espera.
+func (s *sesionPrueba) Abortar(args *ArgsAbortar, reply *Reply) error {
+	return nil
+}
+
+// Declarar_cola crea la cola si no existe.
+func (s *sesionPrueba) Declarar_cola(args *ArgsDeclararCola, reply *Reply) error {
+	b := s.broker
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if _, ok := b.colas[args.Nombre]; !ok {
+		b.colas[args.Nombre] = make(chan string, capacidadColaPrueba)
+	}
+	return nil
+}
+
+// Publicar añade el mensaje a su cola, o falla si la cola no existe o está llena. Si las publicaciones
+// están retenidas, espera antes un permiso.
+func (s *sesionPrueba) Publicar(args *ArgsPublicar, reply *Reply) error {
+	s.broker.mux.Lock()
+	permisos := s.broker.permisos
+	s.broker.mux.Unlock()
+	if permisos != nil {
+		select {
+		case <-permisos:
+		case <-s.fin:
+			return errors.New("la conexión se ha cerrado")
+		}
+	}
+	cola, ok := s.broker.cola(args.Nombre)
+	if !ok {
+		return fmt.Errorf("la cola %s no existe", args.Nombre)
+	}
+	select {
+	case cola <- args.Mensaje:
+		return nil
+	default:
+		return fmt.Errorf("la cola %s está llena", args.Nombre)
+	}
+}
+
+// Consumir suscribe a la sesión a una cola que exista.
+func (s *sesionPrueba) Consumir(args *ArgsConsumir, reply *ReplyConsumir) error {
+	b := s.broker
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if _, ok := b.colas[args.Nombre]; !ok {
+		return fmt.Errorf("la cola %s no existe", args.Nombre)
+	}
+	b.suscripciones++
+	reply.Tag = fmt.Sprint("ctag-", b.suscripciones)
+	s.consumidores[reply.Tag] = args.Nombre
+	return nil
+}
+
+// SiguienteEntrega espera el siguiente mensaje de la cola de una suscripción de la sesión.
+func (s *sesionPrueba) SiguienteEntrega(args *ArgsSiguienteEntrega, reply *ReplyEntrega) error {
+	b := s.broker
+	b.mux.Lock()
+	nombre, ok := s.consumidores[args.Tag]
+	cola := b.colas[nombre]
+	b.mux.Unlock()
+	if !ok {
+		return fmt.Errorf("etiqueta de consumidor desconocida: %s", args.Tag)
+	}
+	select {
+	case m := <-cola:
+		b.mux.Lock()
+		b.etiquetas++
+		reply.Mensaje, reply.Etiqueta = m, b.etiquetas
+		b.mux.Unlock()
+		return nil
+	case <-s.fin:
+		return errors.New("la conexión se ha cerrado")
+	}
+}
+
+// ConfirmarEntrega apunta el resultado del manejador para una entrega.
+func (s *sesionPrueba) ConfirmarEntrega(args *ArgsConfirmarEntrega, reply *Reply) error {
+	b := s.broker
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.confirmaciones = append(b.confirmaciones, *args)
+	return nil
+}
+
+// esperarCondicion espera hasta `esperaPrueba` a que se cumpla la condición descrita.
+func esperarCondicion(t *testing.T, descripcion string, condicion func() bool) {
+	t.Helper()
+	limite := time.Now().Add(esperaPrueba)
+	for !condicion() {
+		if time.Now().After(limite) {
+			t.Fatal("No se ha cumplido en", esperaPrueba, "la condición:", descripcion)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// conectarPrueba conecta con el broker de prueba y cierra la conexión al terminar la prueba.
+func conectarPrueba(t *testing.T, b *brokerPrueba) *Conexion {
+	t.Helper()
+	conexion, err := Conectar(context.Background(), b.direccion)
+	if err != nil {
+		t.Fatal("Error al conectar con el broker:", err)
+	}
+	t.Cleanup(func() { conexion.Cerrar() })
+	return conexion
+}
@@ -0,0 +1,324 @@
+// Package cliente es la biblioteca con la que los programas en Go hablan con el broker MOM.
+//
+// Una `Conexion` mantiene la sesión con el broker, con latidos y reconexión automática. Sobre ella,
+// un `Publicador` declara colas y publica mensajes, y un `Suscriptor` se suscribe a colas con una
+// función que procesa cada mensaje u obtiene mensajes bajo demanda:
+//
+//	ctx := context.Background()
+//	conexion, err := cliente.Conectar(ctx, "10.0.0.1:9000")
+//	if err != nil {
+//		return err
+//	}
+//	defer conexion.Cerrar()
+//	publicador := cliente.NuevoPublicador(conexion)
+//	if err := publicador.Declarar(ctx, "pedidos", true); err != nil {
+//		return err
+//	}
+//	err = publicador.Publicar(ctx, "pedidos", "hola")
+//
+//	suscriptor := cliente.NuevoSuscriptor(conexion)
+//	tag, err := suscriptor.Suscribir(ctx, "pedidos", true, func(ctx context.Context, e cliente.Entrega) error {
+//		fmt.Println(e.Mensaje)
+//		return nil
+//	})
+//
+// Para publicar sin esperar cada confirmación, `PublicarAsincrono` devuelve una `Publicacion` que se
+// completa cuando el broker confirma el mensaje, y `Vaciar` espera a todas las que están en curso:
+//
+//	for _, cuerpo := range cuerpos {
+//		if _, err := publicador.PublicarAsincrono(ctx, cliente.Mensaje{Cola: "pedidos", Cuerpo: cuerpo}); err != nil {
+//			return err
+//		}
+//	}
+//	err = publicador.Vaciar(ctx)
+//
+// Todas las operaciones reciben un contexto y dejan de esperar cuando se cancela o vence su plazo.
+//
+// Los tipos de los argumentos y respuestas de las llamadas RPC reproducen los del broker; solo se
+// exportan los que aparecen en la API de la biblioteca.
+package cliente
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"time"
+)
+
+// argsDeclararCola representa los argumentos para declarar una nueva cola.
+type argsDeclararCola struct {
+	Nombre     string
+	Durability bool
+}
+
+// argsPublicar representa los argumentos para publicar un mensaje en una cola.
+// Compresion es el algoritmo con que está comprimido Mensaje, o vacío si no lo está.
+// Llamada identifica la llamada para abortarla con `Broker.Abortar`.
+type argsPublicar struct {
+	Nombre     string
+	Mensaje    string
+	TTL        time.Duration
+	Cabeceras  map[string]string
+	Compresion string
+	Llamada    uint64
+}
+
+// argsPublicarLote representa los argumentos para publicar varios mensajes en una sola llamada.
+// Llamada identifica la llamada para abortarla con `Broker.Abortar`.
+type argsPublicarLote struct {
+	Mensajes   []argsPublicar
+	Durability bool
+	Llamada    uint64
+}
+
+// replyLote representa la respuesta del broker a una publicación por lotes.
+type replyLote struct {
+	Errores []string
+}
+
+// argsConsumir representa los argumentos para suscribirse a una cola, con el plazo que tiene el
+// suscriptor para procesar cada mensaje.
+type argsConsumir struct {
+	Nombre        string
+	TiempoEntrega time.Duration
+}
+
+// replyConsumir representa la respuesta del broker a `Broker.Consumir` con la etiqueta de consumidor.
+type replyConsumir struct {
+	Tag string
+}
+
+// argsCancelar representa los argumentos para cancelar una suscripción o pedir sus estadísticas.
+type argsCancelar struct {
+	Tag string
+}
+
+// argsSiguienteEntrega representa los argumentos para recoger la siguiente entrega de una suscripción.
+type argsSiguienteEntrega struct {
+	Tag string
+}
+
+// replyEntrega representa un mensaje entregado por el broker a una suscripción.
+// Fin es verdadero si la suscripción ha terminado.
+type replyEntrega struct {
+	Mensaje    string
+	Etiqueta   uint64
+	Fin        bool
+	ID         string
+	Cabeceras  map[string]string
+	Compresion string
+}
+
+// argsConfirmarEntrega representa el resultado del manejador para una entrega.
+type argsConfirmarEntrega struct {
+	Tag      string
+	Etiqueta uint64
+	Error    string
+}
+
+// EstadisticasConsumidor representa los contadores de entregas de una suscripción.
+type EstadisticasConsumidor struct {
+	Entregados uint64
+	Fallidos   uint64
+	Vencidos   uint64
+}
+
+// argsObtener representa los argumentos para obtener un mensaje de una cola bajo demanda.
+type argsObtener struct {
+	Nombre  string
+	AutoAck bool
+}
+
+// replyObtener representa la respuesta del broker a `Broker.Obtener`.
+type replyObtener struct {
+	Mensaje    string
+	Etiqueta   uint64
+	Vacia      bool
+	ID         string
+	Cabeceras  map[string]string
+	Compresion string
+}
+
+// argsRecibir representa los argumentos para recibir mensajes de una cola con espera y tiempo de visibilidad.
+// Llamada identifica la llamada para abortarla con `Broker.Abortar`.
+type argsRecibir struct {
+	Nombre      string
+	MaxMensajes int
+	Espera      time.Duration
+	Visibilidad time.Duration
+	Llamada     uint64
+}
+
+// mensajeRecibido representa un mensaje devuelto por `Broker.Recibir`.
+type mensajeRecibido struct {
+	Mensaje    string
+	Etiqueta   uint64
+	ID         string
+	Cabeceras  map[string]string
+	Compresion string
+}
+
+// replyRecibir representa la respuesta del broker a `Broker.Recibir`.
+type replyRecibir struct {
+	Mensajes []mensajeRecibido
+}
+
+// argsAck representa los argumentos para confirmar o rechazar un mensaje obtenido sin confirmación automática.
+type argsAck struct {
+	Nombre    string
+	Etiqueta  uint64
+	Reencolar bool
+}
+
+// argsAbortar representa los argumentos para pedir al broker que deje de esperar en una llamada abandonada.
+type argsAbortar struct {
+	Llamada uint64
+}
+
+// argsConectar representa los argumentos con los que se negocia la sesión con el broker.
+type argsConectar struct {
+	Latido     time.Duration
+	Compresion []string
+}
+
+// replyConectar representa la respuesta del broker con el intervalo de latidos y el algoritmo de compresión negociados.
+type replyConectar struct {
+	Latido     time.Duration
+	Compresion string
+}
+
+// argsLatido representa los argumentos de un latido enviado al broker.
+type argsLatido struct {
+	Secuencia uint64
+}
+
+// reply representa la respuesta del broker a las llamadas que no devuelven nada más.
+type reply struct {
+	Mensaje string
+}
+
+// algoritmosCompresion son los algoritmos de compresión que el cliente propone al broker, por orden de preferencia.
+var algoritmosCompresion = []string{"gzip", "zlib"}
+
+// umbralCompresion es el tamaño a partir del cual se comprimen los mensajes publicados.
+const umbralCompresion = 512
+
+// maxCuerpoEntrada es el mayor tamaño que se acepta al descomprimir un mensaje entregado por el broker,
+// el mismo que admite el broker.
+const maxCuerpoEntrada = 1 << 28
+
+// comprimir comprime el mensaje de una publicación con el algoritmo especificado si ocupa al menos
+// `umbralCompresion` bytes y comprimido ocupa menos.
+//
+// Retorna:
+// - La publicación con el mensaje comprimido y el algoritmo en Compresion, o la publicación sin cambios.
+func comprimir(algoritmo string, args argsPublicar) argsPublicar {
+	if algoritmo == "" || len(args.Mensaje) < umbralCompresion {
+		return args
+	}
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch algoritmo {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	default:
+		return args
+	}
+	io.WriteString(w, args.Mensaje)
+	w.Close()
+	if buf.Len() < len(args.Mensaje) {
+		args.Mensaje, args.Compresion = buf.String(), algoritmo
+	}
+	return args
+}
+
+// descomprimir descomprime un mensaje entregado por el broker con el algoritmo especificado; si está
+// vacío, el mensaje no está comprimido. Falla si descomprimido ocupa más de `maxCuerpoEntrada`.
+func descomprimir(algoritmo, mensaje string) (string, error) {
+	var r io.ReadCloser
+	var err error
+	switch algoritmo {
+	case "":
+		return mensaje, nil
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader([]byte(mensaje)))
+	case "zlib":
+		r, err = zlib.NewReader(bytes.NewReader([]byte(mensaje)))
+	default:
+		return "", fmt.Errorf("algoritmo de compresión desconocido: %q", algoritmo)
+	}
+	if err != nil {
+		return "", fmt.Errorf("mensaje comprimido no válido: %w", err)
+	}
+	defer r.Close()
+	datos, err := io.ReadAll(io.LimitReader(r, maxCuerpoEntrada+1))
+	if err != nil {
+		return "", fmt.Errorf("mensaje comprimido no válido: %w", err)
+	}
+	if len(datos) > maxCuerpoEntrada {
+		return "", fmt.Errorf("el mensaje descomprimido ocupa más del máximo de %d bytes", maxCuerpoEntrada)
+	}
+	return string(datos), nil
+}
+
+// latidoPropuesto es el intervalo de latidos que el cliente propone al broker.
+const latidoPropuesto = 5 * time.Second
+
+// latidosPerdidos es el número de intervalos sin respuesta tras los que se da por muerto al broker.
+const latidosPerdidos = 2
+
+// conectar negocia con el broker el intervalo de latidos y la compresión, y lanza la goroutine que envía los latidos.
+//
+// Parámetros:
+// - ctx: El contexto que limita la negociación.
+// - broker: El cliente RPC conectado al broker.
+// - caida: La función a la que se llama si el broker deja de responder a los latidos.
+//
+// Retorna:
+// - El algoritmo de compresión negociado, vacío si no hay ninguno, y un error si la negociación falla.
+func conectar(ctx context.Context, broker *rpc.Client, caida func(error)) (string, error) {
+	var r replyConectar
+	err := llamarCliente(ctx, broker, "Broker.Conectar", &argsConectar{Latido: latidoPropuesto, Compresion: algoritmosCompresion}, &r, 0)
+	if err != nil {
+		return "", err
+	}
+	if r.Latido > 0 {
+		go latir(broker, r.Latido, caida)
+	}
+	return r.Compresion, nil
+}
+
+// latir envía un latido al broker en cada intervalo. Si el broker no responde a un latido en
+// `latidosPerdidos` intervalos o la llamada falla, llama a `caida` para que se dé la conexión por
+// perdida en lugar de que el resto de llamadas se queden bloqueadas.
+//
+// Parámetros:
+// - broker: El cliente RPC conectado al broker.
+// - intervalo: El intervalo de latidos negociado.
+// - caida: La función a la que se llama con el error cuando se da por muerto al broker.
+func latir(broker *rpc.Client, intervalo time.Duration, caida func(error)) {
+	ticker := time.NewTicker(intervalo)
+	defer ticker.Stop()
+	var secuencia uint64
+	for range ticker.C {
+		secuencia++
+		llamada := broker.Go("Broker.Latido", &argsLatido{Secuencia: secuencia}, &reply{}, nil)
+		select {
+		case <-llamada.Done:
+			if llamada.Error != nil {
+				caida(fmt.Errorf("error al enviar el latido: %w", llamada.Error))
+				return
+			}
+		case <-time.After(latidosPerdidos * intervalo):
+			caida(errors.New("el broker no responde a los latidos"))
+			return
+		}
+	}
+}
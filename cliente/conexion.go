@@ -0,0 +1,369 @@
+package cliente
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reconexión con el broker.
+//
+// Una `Conexion` guarda la dirección del broker y, cuando la conexión se rompe (falla una llamada sin
+// respuesta del broker o el broker deja de responder a los latidos), vuelve a conectar en segundo plano con
+// una espera que se duplica tras cada fallo, entre `esperaMinReconexion` y `esperaMaxReconexion`, más una
+// parte aleatoria. Al reconectar negocia de nuevo la sesión y ejecuta las funciones registradas con
+// `alReconectar` antes de que el resto de llamadas usen la nueva conexión; así los publicadores vuelven a
+// declarar sus colas y los suscriptores a suscribirse. Las llamadas hechas mientras se reconecta esperan a
+// que termine.
+//
+// Todas las llamadas reciben un contexto: si se cancela o vence su plazo, la llamada deja de esperar y
+// devuelve el error del contexto. net/rpc no permite cancelar una llamada ya enviada, así que las que
+// pueden esperar en el broker llevan un identificador de llamada y, al abandonarlas, se pide al broker
+// con `Broker.Abortar` que deje de esperar.
+
+// Esperas entre reconexiones con el broker.
+const (
+	esperaMinReconexion = 100 * time.Millisecond
+	esperaMaxReconexion = 30 * time.Second
+)
+
+// esperaConexion es el tiempo máximo que se espera al establecer la conexión TCP con el broker, y
+// esperaRestauracion el que se espera a que se restaure la sesión al reconectar.
+const (
+	esperaConexion     = 10 * time.Second
+	esperaRestauracion = 30 * time.Second
+)
+
+// ErrConexionCerrada es el error que devuelven las llamadas sobre una conexión cerrada con `Cerrar`.
+var ErrConexionCerrada = errors.New("la conexión con el broker está cerrada")
+
+// EstadoConexion es el estado de la conexión con el broker.
+type EstadoConexion int
+
+// Estados de la conexión: tras `Conectar` está conectada; al romperse pasa a desconectada y alterna entre
+// reconectando y desconectada hasta que vuelve a estar conectada, y tras `Cerrar` queda cerrada.
+const (
+	Conectado EstadoConexion = iota
+	Desconectado
+	Reconectando
+	Cerrado
+)
+
+// String devuelve el nombre del estado.
+func (e EstadoConexion) String() string {
+	switch e {
+	case Conectado:
+		return "conectado"
+	case Desconectado:
+		return "desconectado"
+	case Reconectando:
+		return "reconectando"
+	case Cerrado:
+		return "cerrado"
+	}
+	return fmt.Sprintf("EstadoConexion(%d)", int(e))
+}
+
+// Conexion es una conexión con el broker que se restablece sola cuando se rompe.
+type Conexion struct {
+	direccion string
+	// ctx se cancela al cerrar la conexión y llamadas genera los identificadores de las llamadas abortables.
+	ctx      context.Context
+	cancelar context.CancelFunc
+	llamadas atomic.Uint64
+	// mux protege el resto de campos; `listo` se cierra cuando hay un cliente que usar.
+	mux        sync.Mutex
+	listo      chan struct{}
+	cliente    *rpc.Client
+	compresion string
+	estado     EstadoConexion
+	cerrada    bool
+	// alCambiar son las funciones avisadas de los cambios de estado y restaurar las que se
+	// ejecutan con cada nuevo cliente antes de usarlo.
+	alCambiar []func(EstadoConexion, error)
+	restaurar []func(context.Context, *rpc.Client) error
+}
+
+// Conectar establece una conexión con el broker en la dirección especificada y negocia la sesión.
+//
+// Parámetros:
+// - ctx: El contexto que limita el primer intento de conexión; no afecta a la conexión una vez establecida.
+// - direccion: La dirección (ip:puerto) del broker.
+//
+// Retorna:
+// - La conexión, o un error si no se puede conectar; el primer intento no se reintenta.
+func Conectar(ctx context.Context, direccion string) (*Conexion, error) {
+	c := &Conexion{direccion: direccion, listo: make(chan struct{})}
+	c.ctx, c.cancelar = context.WithCancel(context.Background())
+	cliente, compresion, err := c.abrir(ctx)
+	if err != nil {
+		c.cancelar()
+		return nil, err
+	}
+	c.cliente, c.compresion = cliente, compresion
+	close(c.listo)
+	return c, nil
+}
+
+// AlCambiarEstado registra una función a la que se avisa de cada cambio de estado de la conexión, con el
+// error que lo ha provocado si lo hay.
+func (c *Conexion) AlCambiarEstado(f func(EstadoConexion, error)) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.alCambiar = append(c.alCambiar, f)
+}
+
+// alReconectar registra una función que se ejecuta con cada nuevo cliente antes de que lo usen el resto de
+// llamadas, con un contexto que limita lo que puede tardar. Si devuelve un error, se descarta el cliente y
+// se vuelve a intentar la conexión.
+func (c *Conexion) alReconectar(f func(context.Context, *rpc.Client) error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.restaurar = append(c.restaurar, f)
+}
+
+// Estado devuelve el estado actual de la conexión.
+func (c *Conexion) Estado() EstadoConexion {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.estado
+}
+
+// Compresion devuelve el algoritmo de compresión negociado en la conexión actual.
+func (c *Conexion) Compresion() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.compresion
+}
+
+// Llamar hace una llamada RPC al broker, para las operaciones que no ofrecen `Publicador` y `Suscriptor`.
+// Si se está reconectando, espera a que termine. Si la conexión se rompe durante la llamada, empieza a
+// reconectar y devuelve el error; `ConexionRota` indica si es el caso.
+//
+// Si se cancela el contexto, devuelve su error sin esperar la respuesta, que puede llegar después a
+// `respuesta`; en ese caso no se debe volver a usar `respuesta`.
+func (c *Conexion) Llamar(ctx context.Context, metodo string, args, respuesta any) error {
+	return c.llamar(ctx, metodo, args, respuesta, 0)
+}
+
+// llamar es `Llamar` para una llamada que el broker puede abortar con el identificador especificado,
+// obtenido con `nuevaLlamada`; si es cero, la llamada no se puede abortar.
+func (c *Conexion) llamar(ctx context.Context, metodo string, args, respuesta any, llamada uint64) error {
+	cliente, err := c.actual(ctx)
+	if err != nil {
+		return err
+	}
+	err = llamarCliente(ctx, cliente, metodo, args, respuesta, llamada)
+	if ConexionRota(err) {
+		c.romper(cliente, err)
+	}
+	return err
+}
+
+// nuevaLlamada devuelve un identificador para una llamada que el broker puede abortar.
+func (c *Conexion) nuevaLlamada() uint64 {
+	return c.llamadas.Add(1)
+}
+
+// llamarCliente hace una llamada RPC con un cliente y espera la respuesta mientras no se cancele el contexto.
+//
+// Parámetros:
+// - llamada: El identificador de la llamada; si no es cero y se cancela el contexto, se pide al broker
+// que la aborte.
+//
+// Retorna:
+// - El error de la llamada, o el del contexto si se cancela antes de que llegue la respuesta.
+func llamarCliente(ctx context.Context, cliente *rpc.Client, metodo string, args, respuesta any, llamada uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	enCurso := cliente.Go(metodo, args, respuesta, make(chan *rpc.Call, 1))
+	select {
+	case <-enCurso.Done:
+		return enCurso.Error
+	case <-ctx.Done():
+		if llamada != 0 {
+			cliente.Go("Broker.Abortar", &argsAbortar{Llamada: llamada}, &reply{}, make(chan *rpc.Call, 1))
+		}
+		return ctx.Err()
+	}
+}
+
+// reintentar ejecuta una función que hace llamadas con `Llamar` y la repite, una vez reconectado, mientras
+// falle porque se ha perdido la conexión y no se cancele el contexto.
+//
+// Retorna:
+// - El error de la última ejecución, que no se debe a la conexión, o el del contexto.
+func (c *Conexion) reintentar(ctx context.Context, f func() error) error {
+	for {
+		err := f()
+		if !ConexionRota(err) {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// Cerrar cierra la conexión y detiene la reconexión; las llamadas pendientes fallan con `ErrConexionCerrada`.
+func (c *Conexion) Cerrar() error {
+	c.mux.Lock()
+	if c.cerrada {
+		c.mux.Unlock()
+		return nil
+	}
+	c.cerrada = true
+	c.cancelar()
+	var err error
+	if c.cliente != nil {
+		err = c.cliente.Close()
+		c.cliente = nil
+	}
+	c.mux.Unlock()
+	c.cambiarEstado(Cerrado, nil)
+	return err
+}
+
+// ConexionRota indica si un error de una llamada se debe a que se ha perdido la conexión con el broker y no
+// a que el broker ha rechazado la llamada, se ha cerrado la conexión o se ha cancelado el contexto.
+func ConexionRota(err error) bool {
+	if err == nil || errors.Is(err, ErrConexionCerrada) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var errServidor rpc.ServerError
+	return !errors.As(err, &errServidor)
+}
+
+// actual devuelve el cliente en uso, esperando a que termine la reconexión si hace falta.
+//
+// Retorna:
+// - El cliente, `ErrConexionCerrada` si se cierra la conexión o el error del contexto si se cancela antes.
+func (c *Conexion) actual(ctx context.Context) (*rpc.Client, error) {
+	for {
+		c.mux.Lock()
+		cliente, cerrada, listo := c.cliente, c.cerrada, c.listo
+		c.mux.Unlock()
+		if cerrada {
+			return nil, ErrConexionCerrada
+		}
+		if cliente != nil {
+			return cliente, nil
+		}
+		select {
+		case <-listo:
+		case <-c.ctx.Done():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// abrir conecta con el broker y negocia la sesión mientras no se cancele el contexto.
+//
+// Retorna:
+// - El cliente, el algoritmo de compresión negociado y un error si falla la conexión o la negociación.
+func (c *Conexion) abrir(ctx context.Context) (*rpc.Client, string, error) {
+	dialer := net.Dialer{Timeout: esperaConexion}
+	conn, err := dialer.DialContext(ctx, "tcp", c.direccion)
+	if err != nil {
+		return nil, "", err
+	}
+	cliente := rpc.NewClient(conn)
+	compresion, err := conectar(ctx, cliente, func(err error) { c.romper(cliente, err) })
+	if err != nil {
+		cliente.Close()
+		return nil, "", err
+	}
+	return cliente, compresion, nil
+}
+
+// romper da por perdida la conexión del cliente especificado y empieza a reconectar, salvo que el cliente ya
+// no esté en uso.
+func (c *Conexion) romper(cliente *rpc.Client, err error) {
+	c.mux.Lock()
+	if c.cerrada || c.cliente != cliente {
+		c.mux.Unlock()
+		return
+	}
+	c.cliente = nil
+	c.listo = make(chan struct{})
+	cliente.Close()
+	c.mux.Unlock()
+	c.cambiarEstado(Desconectado, err)
+	go c.reconectar()
+}
+
+// reconectar vuelve a conectar con el broker hasta conseguirlo o hasta que se cierra la conexión, con una
+// espera aleatoria entre la mitad y el total de la espera actual, que se duplica tras cada fallo.
+func (c *Conexion) reconectar() {
+	espera := esperaMinReconexion
+	for {
+		c.cambiarEstado(Reconectando, nil)
+		cliente, compresion, err := c.abrir(c.ctx)
+		if err == nil {
+			err = c.restaurarSesion(cliente)
+		}
+		if err == nil {
+			c.mux.Lock()
+			if c.cerrada {
+				c.mux.Unlock()
+				cliente.Close()
+				return
+			}
+			c.cliente, c.compresion = cliente, compresion
+			close(c.listo)
+			c.mux.Unlock()
+			c.cambiarEstado(Conectado, nil)
+			return
+		}
+		if cliente != nil {
+			cliente.Close()
+		}
+		c.cambiarEstado(Desconectado, err)
+		jitter := time.Duration(rand.Int63n(int64(espera)/2 + 1))
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(espera/2 + jitter):
+		}
+		espera = min(2*espera, esperaMaxReconexion)
+	}
+}
+
+// restaurarSesion ejecuta con un nuevo cliente las funciones registradas con `alReconectar`, que tienen
+// `esperaRestauracion` para terminar.
+func (c *Conexion) restaurarSesion(cliente *rpc.Client) error {
+	c.mux.Lock()
+	restaurar := append(([]func(context.Context, *rpc.Client) error)(nil), c.restaurar...)
+	c.mux.Unlock()
+	ctx, cancelar := context.WithTimeout(c.ctx, esperaRestauracion)
+	defer cancelar()
+	for _, f := range restaurar {
+		if err := f(ctx, cliente); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cambiarEstado cambia el estado de la conexión y avisa a las funciones registradas con `AlCambiarEstado`.
+func (c *Conexion) cambiarEstado(estado EstadoConexion, err error) {
+	c.mux.Lock()
+	if c.cerrada && estado != Cerrado {
+		c.mux.Unlock()
+		return
+	}
+	c.estado = estado
+	alCambiar := append(([]func(EstadoConexion, error))(nil), c.alCambiar...)
+	c.mux.Unlock()
+	for _, f := range alCambiar {
+		f(estado, err)
+	}
+}
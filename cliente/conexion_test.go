@@ -0,0 +1,95 @@
+package cliente
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// TestConectar comprueba que `Conectar` negocia la sesión con el broker y que falla sin reintentar si no
+// hay ningún broker en la dirección.
+func TestConectar(t *testing.T) {
+	b := arrancarBrokerPrueba(t)
+	conexion := conectarPrueba(t, b)
+	if estado := conexion.Estado(); estado != Conectado {
+		t.Fatal("La conexión está", estado, "en lugar de conectada")
+	}
+	if err := conexion.Cerrar(); err != nil {
+		t.Fatal("Error al cerrar la conexión:", err)
+	}
+	if estado := conexion.Estado(); estado != Cerrado {
+		t.Fatal("La conexión está", estado, "en lugar de cerrada")
+	}
+	if err := NuevoPublicador(conexion).Publicar(context.Background(), "cola", "hola"); err != ErrConexionCerrada {
+		t.Fatal("Publicar en una conexión cerrada devuelve", err, "en lugar de", ErrConexionCerrada)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	direccion := ln.Addr().String()
+	ln.Close()
+	if _, err := Conectar(context.Background(), direccion); err == nil {
+		t.Fatal("Conectar con", direccion, "no falla sin broker")
+	}
+}
+
+// TestReconexionResuscribe comprueba que, cuando el broker se reinicia, la conexión se restablece sola,
+// el publicador vuelve a declarar sus colas y el suscriptor vuelve a suscribirse y sigue recibiendo
+// mensajes con el mismo manejador.
+func TestReconexionResuscribe(t *testing.T) {
+	b := arrancarBrokerPrueba(t)
+	conexion := conectarPrueba(t, b)
+	var mux sync.Mutex
+	var estados []EstadoConexion
+	conexion.AlCambiarEstado(func(estado EstadoConexion, err error) {
+		mux.Lock()
+		defer mux.Unlock()
+		estados = append(estados, estado)
+	})
+	ctx := context.Background()
+	publicador := NuevoPublicador(conexion)
+	if err := publicador.Declarar(ctx, "cola", true); err != nil {
+		t.Fatal("Error al declarar la cola:", err)
+	}
+	entregas := make(chan Entrega, 10)
+	suscriptor := NuevoSuscriptor(conexion)
+	tag, err := suscriptor.Suscribir(ctx, "cola", true, func(ctx context.Context, e Entrega) error {
+		entregas <- e
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error al suscribirse:", err)
+	}
+	if err := publicador.Publicar(ctx, "cola", "antes"); err != nil {
+		t.Fatal("Error al publicar:", err)
+	}
+	recibirPrueba(t, entregas, "antes")
+	esperarCondicion(t, "el broker recibe la confirmación", func() bool { return len(b.confirmadas()) == 1 })
+
+	b.reiniciar()
+	esperarCondicion(t, "la conexión se restablece", func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(estados) > 0 && estados[len(estados)-1] == Conectado
+	})
+	mux.Lock()
+	if !slices.Contains(estados, Desconectado) || !slices.Contains(estados, Reconectando) {
+		t.Error("La conexión ha pasado por", estados, "sin desconectarse y reconectar")
+	}
+	mux.Unlock()
+	if n := b.numSuscripciones(); n != 2 {
+		t.Fatal("El broker ha atendido", n, "suscripciones en lugar de 2")
+	}
+	if actual := suscriptor.tagActual(tag); actual == tag {
+		t.Fatal("La suscripción restablecida conserva la etiqueta", tag, "de la conexión anterior")
+	}
+	// La cola existe de nuevo porque se ha vuelto a declarar al reconectar.
+	if err := publicador.Publicar(ctx, "cola", "despues"); err != nil {
+		t.Fatal("Error al publicar tras reconectar:", err)
+	}
+	recibirPrueba(t, entregas, "despues")
+}
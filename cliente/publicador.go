@@ -0,0 +1,153 @@
+package cliente
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Mensaje es un mensaje a publicar.
+//
+// - Cola: la cola en la que se publica.
+// - Cuerpo: el contenido del mensaje.
+// - TTL: el tiempo tras el que el mensaje caduca si nadie lo ha consumido; cero para usar el TTL de la
+// cola, que no caduca si la cola no tiene uno.
+// - Cabeceras: las cabeceras que acompañan al mensaje hasta los consumidores.
+type Mensaje struct {
+	Cola      string
+	Cuerpo    string
+	TTL       time.Duration
+	Cabeceras map[string]string
+}
+
+// Publicador publica mensajes en las colas del broker. Guarda la durabilidad de las colas que declara
+// para volver a declararlas al reconectar. enVuelo limita las publicaciones asíncronas sin confirmar;
+// pendientes cuenta las que están en curso, vacio se cierra cuando no queda ninguna y fallidas guarda
+// los errores de las que han fallado hasta el siguiente `Vaciar`. mux protege las colas y las publicaciones
+// pendientes.
+type Publicador struct {
+	conexion   *Conexion
+	mux        sync.Mutex
+	colas      map[string]bool
+	enVuelo    chan struct{}
+	pendientes int
+	vacio      chan struct{}
+	fallidas   []error
+}
+
+// NuevoPublicador crea un publicador sobre la conexión especificada que admite hasta `MaxEnVuelo`
+// publicaciones asíncronas sin confirmar.
+func NuevoPublicador(conexion *Conexion) *Publicador {
+	return NuevoPublicadorLimitado(conexion, MaxEnVuelo)
+}
+
+// NuevoPublicadorLimitado crea un publicador sobre la conexión especificada que admite hasta maxEnVuelo
+// publicaciones asíncronas sin confirmar.
+func NuevoPublicadorLimitado(conexion *Conexion, maxEnVuelo int) *Publicador {
+	vacio := make(chan struct{})
+	close(vacio)
+	p := &Publicador{
+		conexion: conexion,
+		colas:    make(map[string]bool),
+		enVuelo:  make(chan struct{}, max(maxEnVuelo, 1)),
+		vacio:    vacio,
+	}
+	conexion.alReconectar(p.redeclarar)
+	return p
+}
+
+// Declarar declara una cola en el broker, si no existe ya, y la apunta para volver a declararla al reconectar.
+//
+// Parámetros:
+// - cola: El nombre de la cola.
+// - durable: Si la cola se guarda en disco; no cambia la durabilidad de una cola que ya existe.
+func (p *Publicador) Declarar(ctx context.Context, cola string, durable bool) error {
+	err := p.conexion.reintentar(ctx, func() error {
+		return p.conexion.Llamar(ctx, "Broker.Declarar_cola", &argsDeclararCola{Nombre: cola, Durability: durable}, &reply{})
+	})
+	if err != nil {
+		return err
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if _, ok := p.colas[cola]; !ok {
+		p.colas[cola] = durable
+	}
+	return nil
+}
+
+// redeclarar vuelve a declarar en un nuevo cliente las colas declaradas por el publicador, por si el
+// broker se ha reiniciado sin ellas.
+func (p *Publicador) redeclarar(ctx context.Context, cliente *rpc.Client) error {
+	p.mux.Lock()
+	colas := make(map[string]bool, len(p.colas))
+	for nombre, durable := range p.colas {
+		colas[nombre] = durable
+	}
+	p.mux.Unlock()
+	for nombre, durable := range colas {
+		if err := llamarCliente(ctx, cliente, "Broker.Declarar_cola", &argsDeclararCola{Nombre: nombre, Durability: durable}, &reply{}, 0); err != nil {
+			return fmt.Errorf("al volver a declarar la cola %s: %w", nombre, err)
+		}
+	}
+	return nil
+}
+
+// Publicar publica un mensaje en una cola. El broker descarta los mensajes publicados en colas que no existen.
+//
+// Si se pierde la conexión, la publicación se repite al reconectar, así que el mensaje puede llegar dos veces.
+// Si se cancela el contexto, el mensaje puede haberse publicado o no; si el broker estaba esperando sitio en
+// la cola, deja de esperar y no lo publica.
+func (p *Publicador) Publicar(ctx context.Context, cola string, cuerpo string) error {
+	return p.PublicarMensaje(ctx, Mensaje{Cola: cola, Cuerpo: cuerpo})
+}
+
+// PublicarMensaje publica un mensaje con su TTL y sus cabeceras, igual que `Publicar`.
+func (p *Publicador) PublicarMensaje(ctx context.Context, m Mensaje) error {
+	return p.conexion.reintentar(ctx, func() error {
+		args := comprimir(p.conexion.Compresion(), m.args())
+		args.Llamada = p.conexion.nuevaLlamada()
+		return p.conexion.llamar(ctx, "Broker.Publicar", &args, &reply{}, args.Llamada)
+	})
+}
+
+// PublicarLote publica varios mensajes, posiblemente en colas distintas, con una única llamada al broker.
+//
+// Parámetros:
+// - mensajes: Los mensajes a publicar.
+// - durable: La durabilidad con la que se declaran las colas que todavía no existan.
+//
+// Retorna:
+// - Un slice con un error por mensaje (nil si se publicó correctamente) y un error si la llamada falla.
+//
+// Si se pierde la conexión, el lote entero se repite al reconectar.
+func (p *Publicador) PublicarLote(ctx context.Context, mensajes []Mensaje, durable bool) ([]error, error) {
+	var r replyLote
+	err := p.conexion.reintentar(ctx, func() error {
+		compresion := p.conexion.Compresion()
+		args := &argsPublicarLote{Mensajes: make([]argsPublicar, len(mensajes)), Durability: durable, Llamada: p.conexion.nuevaLlamada()}
+		for i, m := range mensajes {
+			args.Mensajes[i] = comprimir(compresion, m.args())
+		}
+		r = replyLote{}
+		return p.conexion.llamar(ctx, "Broker.PublicarLote", args, &r, args.Llamada)
+	})
+	if err != nil {
+		return nil, err
+	}
+	errores := make([]error, len(mensajes))
+	for i, e := range r.Errores {
+		if e != "" {
+			errores[i] = errors.New(e)
+		}
+	}
+	return errores, nil
+}
+
+// args devuelve los argumentos de la llamada que publica el mensaje.
+func (m Mensaje) args() argsPublicar {
+	return argsPublicar{Nombre: m.Cola, Mensaje: m.Cuerpo, TTL: m.TTL, Cabeceras: m.Cabeceras}
+}
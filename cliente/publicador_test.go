@@ -0,0 +1,40 @@
+package cliente
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestPublicar comprueba que los mensajes publicados llegan en orden a la cola declarada y que un error
+// del broker se devuelve sin darse por perdida la conexión.
+func TestPublicar(t *testing.T) {
+	b := arrancarBrokerPrueba(t)
+	conexion := conectarPrueba(t, b)
+	ctx := context.Background()
+	publicador := NuevoPublicador(conexion)
+	if err := publicador.Declarar(ctx, "cola", false); err != nil {
+		t.Fatal("Error al declarar la cola:", err)
+	}
+	esperados := []string{"uno", "dos", "tres"}
+	for _, cuerpo := range esperados {
+		if err := publicador.Publicar(ctx, "cola", cuerpo); err != nil {
+			t.Fatal("Error al publicar:", err)
+		}
+	}
+	if recibidos := b.vaciar("cola"); !slices.Equal(recibidos, esperados) {
+		t.Fatalf("La cola tiene %q en lugar de %q", recibidos, esperados)
+	}
+
+	err := publicador.Publicar(ctx, "inexistente", "hola")
+	if err == nil || !strings.Contains(err.Error(), "no existe") {
+		t.Fatal("Publicar en una cola que no existe devuelve", err)
+	}
+	if ConexionRota(err) {
+		t.Fatal("El error del broker se toma por una conexión perdida:", err)
+	}
+	if estado := conexion.Estado(); estado != Conectado {
+		t.Fatal("La conexión está", estado, "tras el error del broker")
+	}
+}
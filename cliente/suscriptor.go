@@ -0,0 +1,333 @@
+package cliente
+
+import (
+	"context"
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// TiempoEntrega es el plazo que se pide al broker para procesar cada mensaje de una suscripción; si el
+// manejador no termina antes, el broker vuelve a encolar el mensaje.
+const TiempoEntrega = 30 * time.Second
+
+// Entrega es un mensaje entregado por el broker.
+//
+// - Mensaje: el contenido del mensaje, ya descomprimido.
+// - Etiqueta: la etiqueta de entrega con la que se confirma o rechaza el mensaje.
+// - ID, Cabeceras: el identificador y las cabeceras con que se publicó el mensaje.
+type Entrega struct {
+	Mensaje   string
+	Etiqueta  uint64
+	ID        string
+	Cabeceras map[string]string
+}
+
+// Manejador procesa un mensaje de una suscripción. El contexto vence a los `TiempoEntrega` y se cancela
+// si se cancela la suscripción o se cierra la conexión. Si devuelve un error, el broker cuenta la entrega
+// como fallida.
+type Manejador func(context.Context, Entrega) error
+
+// Suscriptor consume mensajes de las colas del broker, por suscripción o bajo demanda. Guarda sus
+// suscripciones por la etiqueta que devolvió `Suscribir`, para volver a suscribirse al reconectar; mux las
+// protege.
+type Suscriptor struct {
+	conexion      *Conexion
+	mux           sync.Mutex
+	suscripciones map[string]*suscripcion
+}
+
+// suscripcion es una suscripción a una cola. tag es la etiqueta de consumidor de la suscripción en la
+// conexión actual, que cambia al volver a suscribirse, y cancelada indica que se ha cancelado y no se
+// debe restablecer. ctx se cancela al cancelar la suscripción.
+type suscripcion struct {
+	cola      string
+	durable   bool
+	manejador Manejador
+	tag       string
+	cancelada bool
+	ctx       context.Context
+	cancelar  context.CancelFunc
+}
+
+// NuevoSuscriptor crea un suscriptor sobre la conexión especificada.
+func NuevoSuscriptor(conexion *Conexion) *Suscriptor {
+	s := &Suscriptor{
+		conexion:      conexion,
+		suscripciones: make(map[string]*suscripcion),
+	}
+	conexion.alReconectar(s.resuscribir)
+	return s
+}
+
+// Suscribir declara una cola y se suscribe a ella. Los mensajes llegan por la misma conexión con el broker
+// y se procesan de uno en uno en segundo plano con el manejador; el resultado se devuelve al broker.
+//
+// Parámetros:
+// - ctx: El contexto que limita la suscripción; no afecta a la suscripción una vez hecha.
+// - cola: El nombre de la cola.
+// - durable: La durabilidad con la que se declara la cola si todavía no existe.
+// - manejador: La función que procesa cada mensaje.
+//
+// Retorna:
+// - La etiqueta de consumidor de la suscripción, que la sigue identificando aunque se restablezca al
+// reconectar con el broker, y un error si no se pudo suscribir.
+func (s *Suscriptor) Suscribir(ctx context.Context, cola string, durable bool, manejador Manejador) (string, error) {
+	sus := &suscripcion{cola: cola, durable: durable, manejador: manejador}
+	sus.ctx, sus.cancelar = context.WithCancel(s.conexion.ctx)
+	err := s.conSuscripciones(ctx, func(cliente *rpc.Client) error {
+		if err := suscribir(ctx, cliente, sus); err != nil {
+			return err
+		}
+		s.suscripciones[sus.tag] = sus
+		return nil
+	})
+	if err != nil {
+		sus.cancelar()
+		return "", err
+	}
+	tag := sus.tag
+	go s.recibirEntregas(tag, sus)
+	return tag, nil
+}
+
+// suscribir declara la cola de una suscripción y se suscribe a ella con el cliente especificado,
+// guardando en la suscripción la nueva etiqueta de consumidor.
+func suscribir(ctx context.Context, cliente *rpc.Client, sus *suscripcion) error {
+	args := &argsDeclararCola{Nombre: sus.cola, Durability: sus.durable}
+	if err := llamarCliente(ctx, cliente, "Broker.Declarar_cola", args, &reply{}, 0); err != nil {
+		return err
+	}
+	var r replyConsumir
+	args2 := &argsConsumir{Nombre: sus.cola, TiempoEntrega: TiempoEntrega}
+	if err := llamarCliente(ctx, cliente, "Broker.Consumir", args2, &r, 0); err != nil {
+		return err
+	}
+	sus.tag = r.Tag
+	return nil
+}
+
+// resuscribir vuelve a suscribirse con un nuevo cliente a las colas de las suscripciones no canceladas.
+func (s *Suscriptor) resuscribir(ctx context.Context, cliente *rpc.Client) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, sus := range s.suscripciones {
+		if err := suscribir(ctx, cliente, sus); err != nil {
+			return fmt.Errorf("al volver a suscribirse a la cola %s: %w", sus.cola, err)
+		}
+	}
+	return nil
+}
+
+// conSuscripciones ejecuta una función con el cliente en uso y las suscripciones bloqueadas, para que una
+// reconexión no las cambie mientras tanto. Si se pierde la conexión, la repite una vez reconectado mientras
+// no se cancele el contexto.
+func (s *Suscriptor) conSuscripciones(ctx context.Context, f func(*rpc.Client) error) error {
+	for {
+		cliente, err := s.conexion.actual(ctx)
+		if err != nil {
+			return err
+		}
+		s.mux.Lock()
+		err = f(cliente)
+		s.mux.Unlock()
+		if !ConexionRota(err) {
+			return err
+		}
+		s.conexion.romper(cliente, err)
+	}
+}
+
+// tagActual devuelve la etiqueta de consumidor en la conexión actual de la suscripción con la etiqueta
+// devuelta por `Suscribir`, o la misma etiqueta si no hay ninguna suscripción con ella.
+func (s *Suscriptor) tagActual(tag string) string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if sus, ok := s.suscripciones[tag]; ok {
+		return sus.tag
+	}
+	return tag
+}
+
+// olvidar marca como cancelada la suscripción con la etiqueta devuelta por `Suscribir` para no restablecerla,
+// y cancela su contexto. Las suscripciones se bloquean antes de llamarla.
+func (s *Suscriptor) olvidar(tag string) {
+	if sus, ok := s.suscripciones[tag]; ok {
+		sus.cancelada = true
+		sus.cancelar()
+		delete(s.suscripciones, tag)
+	}
+}
+
+// Cancelar cancela la suscripción con la etiqueta de consumidor especificada.
+// El broker deja de entregar mensajes y devuelve a la cola el que estuviera sin confirmar.
+//
+// Parámetros:
+// - tag: La etiqueta de consumidor devuelta por `Suscribir`.
+//
+// Retorna:
+// - Un error si la llamada al broker falla.
+func (s *Suscriptor) Cancelar(ctx context.Context, tag string) error {
+	return s.conSuscripciones(ctx, func(cliente *rpc.Client) error {
+		actual := tag
+		if sus, ok := s.suscripciones[tag]; ok {
+			actual = sus.tag
+		}
+		if err := llamarCliente(ctx, cliente, "Broker.Cancelar", &argsCancelar{Tag: actual}, &reply{}, 0); err != nil {
+			return err
+		}
+		s.olvidar(tag)
+		return nil
+	})
+}
+
+// Estadisticas devuelve los contadores de entregas de la suscripción con la etiqueta especificada.
+// Los contadores empiezan de cero cada vez que la suscripción se restablece al reconectar.
+func (s *Suscriptor) Estadisticas(ctx context.Context, tag string) (EstadisticasConsumidor, error) {
+	var r EstadisticasConsumidor
+	err := s.conexion.Llamar(ctx, "Broker.EstadisticasConsumidor", &argsCancelar{Tag: s.tagActual(tag)}, &r)
+	return r, err
+}
+
+// recibirEntregas recoge los mensajes de una suscripción, llama a su manejador con cada uno y
+// devuelve al broker el resultado, hasta que la suscripción termina. Si se pierde la conexión, sigue
+// recogiendo los mensajes de la suscripción restablecida al reconectar; el broker devuelve a la cola
+// el mensaje que se estuviera procesando. Termina también al cerrar la conexión.
+//
+// Parámetros:
+// - tag: La etiqueta de consumidor devuelta por `Suscribir`.
+// - sus: La suscripción.
+func (s *Suscriptor) recibirEntregas(tag string, sus *suscripcion) {
+	for {
+		s.mux.Lock()
+		actual, cancelada := sus.tag, sus.cancelada
+		s.mux.Unlock()
+		if cancelada || sus.ctx.Err() != nil {
+			return
+		}
+		var entrega replyEntrega
+		err := s.conexion.Llamar(sus.ctx, "Broker.SiguienteEntrega", &argsSiguienteEntrega{Tag: actual}, &entrega)
+		if s.repetir(sus, actual, err) {
+			continue
+		}
+		if err != nil {
+			fmt.Println("Error al recibir la entrega:", err)
+			return
+		}
+		if entrega.Fin {
+			s.mux.Lock()
+			s.olvidar(tag)
+			s.mux.Unlock()
+			return
+		}
+		confirmacion := &argsConfirmarEntrega{Tag: actual, Etiqueta: entrega.Etiqueta}
+		if mensaje, err := descomprimir(entrega.Compresion, entrega.Mensaje); err != nil {
+			confirmacion.Error = err.Error()
+		} else if err := s.manejar(sus, Entrega{Mensaje: mensaje, Etiqueta: entrega.Etiqueta, ID: entrega.ID, Cabeceras: entrega.Cabeceras}); err != nil {
+			confirmacion.Error = err.Error()
+		}
+		err = s.conexion.Llamar(sus.ctx, "Broker.ConfirmarEntrega", confirmacion, &reply{})
+		if s.repetir(sus, actual, err) {
+			continue
+		}
+		if err != nil {
+			fmt.Println("Error al confirmar la entrega:", err)
+			return
+		}
+	}
+}
+
+// repetir indica si se debe volver a intentar una llamada de una suscripción que ha fallado con la etiqueta
+// de consumidor `actual`: porque se ha perdido la conexión, porque se ha cancelado la suscripción o porque
+// la suscripción se ha restablecido con otra etiqueta mientras la llamada esperaba a la reconexión.
+func (s *Suscriptor) repetir(sus *suscripcion, actual string, err error) bool {
+	if err == nil {
+		return false
+	}
+	if ConexionRota(err) || sus.ctx.Err() != nil {
+		return true
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return sus.tag != actual
+}
+
+// manejar llama al manejador de una suscripción con un contexto que vence a los `TiempoEntrega`.
+func (s *Suscriptor) manejar(sus *suscripcion, entrega Entrega) error {
+	ctx, cancelar := context.WithTimeout(sus.ctx, TiempoEntrega)
+	defer cancelar()
+	return sus.manejador(ctx, entrega)
+}
+
+// Obtener extrae el siguiente mensaje de una cola.
+//
+// Parámetros:
+// - cola: El nombre de la cola de la que se quiere obtener el mensaje.
+// - autoAck: Si es verdadero, el broker da el mensaje por consumido al entregarlo; si no, hay que
+// confirmarlo con `Ack` o rechazarlo con `Rechazar`; si no se confirma en 30 segundos, vuelve a la cola.
+//
+// Retorna:
+// - El mensaje, si se obtuvo alguno y un error si la llamada falla.
+func (s *Suscriptor) Obtener(ctx context.Context, cola string, autoAck bool) (Entrega, bool, error) {
+	var r replyObtener
+	err := s.conexion.Llamar(ctx, "Broker.Obtener", &argsObtener{Nombre: cola, AutoAck: autoAck}, &r)
+	if err != nil || r.Vacia {
+		return Entrega{}, false, err
+	}
+	mensaje, err := descomprimir(r.Compresion, r.Mensaje)
+	if err != nil {
+		return Entrega{}, false, err
+	}
+	return Entrega{Mensaje: mensaje, Etiqueta: r.Etiqueta, ID: r.ID, Cabeceras: r.Cabeceras}, true, nil
+}
+
+// Recibir espera hasta `espera` a que haya mensajes en una cola y devuelve como mucho `max` de ellos.
+// Los mensajes devueltos quedan ocultos durante `visibilidad`; si no se confirman con `Ack` antes,
+// vuelven a la cola. Si el contexto tiene plazo, el broker no espera más allá; si se cancela, se pide al
+// broker que deje de esperar.
+//
+// Parámetros:
+// - cola: El nombre de la cola de la que se quieren recibir los mensajes.
+// - max: El número máximo de mensajes a recibir.
+// - espera: El tiempo máximo que el broker espera a que llegue algún mensaje.
+// - visibilidad: El tiempo durante el que los mensajes recibidos quedan ocultos a otros consumidores.
+//
+// Retorna:
+// - Los mensajes recibidos y un error si la llamada falla.
+func (s *Suscriptor) Recibir(ctx context.Context, cola string, max int, espera, visibilidad time.Duration) ([]Entrega, error) {
+	if limite, ok := ctx.Deadline(); ok {
+		if resto := time.Until(limite); resto < espera {
+			espera = resto
+		}
+		if espera < 0 {
+			espera = 0
+		}
+	}
+	var r replyRecibir
+	llamada := s.conexion.nuevaLlamada()
+	args := &argsRecibir{Nombre: cola, MaxMensajes: max, Espera: espera, Visibilidad: visibilidad, Llamada: llamada}
+	if err := s.conexion.llamar(ctx, "Broker.Recibir", args, &r, llamada); err != nil {
+		return nil, err
+	}
+	entregas := make([]Entrega, len(r.Mensajes))
+	for i, m := range r.Mensajes {
+		mensaje, err := descomprimir(m.Compresion, m.Mensaje)
+		if err != nil {
+			return nil, err
+		}
+		entregas[i] = Entrega{Mensaje: mensaje, Etiqueta: m.Etiqueta, ID: m.ID, Cabeceras: m.Cabeceras}
+	}
+	return entregas, nil
+}
+
+// Ack confirma un mensaje obtenido con `Obtener` sin confirmación automática o con `Recibir`.
+func (s *Suscriptor) Ack(ctx context.Context, cola string, etiqueta uint64) error {
+	return s.conexion.Llamar(ctx, "Broker.Ack", &argsAck{Nombre: cola, Etiqueta: etiqueta}, &reply{})
+}
+
+// Rechazar rechaza un mensaje obtenido con `Obtener` sin confirmación automática o con `Recibir`,
+// devolviéndolo a la cola si reencolar es verdadero.
+func (s *Suscriptor) Rechazar(ctx context.Context, cola string, etiqueta uint64, reencolar bool) error {
+	return s.conexion.Llamar(ctx, "Broker.Rechazar", &argsAck{Nombre: cola, Etiqueta: etiqueta, Reencolar: reencolar}, &reply{})
+}
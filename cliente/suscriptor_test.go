@@ -0,0 +1,62 @@
+package cliente
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// recibirPrueba espera hasta `esperaPrueba` a que el manejador reciba una entrega y comprueba su contenido.
+func recibirPrueba(t *testing.T, entregas <-chan Entrega, esperado string) Entrega {
+	t.Helper()
+	select {
+	case e := <-entregas:
+		if e.Mensaje != esperado {
+			t.Fatalf("El manejador ha recibido %q en lugar de %q", e.Mensaje, esperado)
+		}
+		return e
+	case <-time.After(esperaPrueba):
+		t.Fatalf("El manejador no ha recibido %q en %v", esperado, esperaPrueba)
+		return Entrega{}
+	}
+}
+
+// TestSuscripcionConfirma comprueba que el manejador de una suscripción recibe los mensajes en orden y
+// que cada entrega se confirma al broker con su etiqueta y con el error del manejador, si lo hay.
+func TestSuscripcionConfirma(t *testing.T) {
+	b := arrancarBrokerPrueba(t)
+	conexion := conectarPrueba(t, b)
+	ctx := context.Background()
+	entregas := make(chan Entrega, 10)
+	suscriptor := NuevoSuscriptor(conexion)
+	tag, err := suscriptor.Suscribir(ctx, "cola", false, func(ctx context.Context, e Entrega) error {
+		entregas <- e
+		if e.Mensaje == "mal" {
+			return errors.New("fallo del manejador")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error al suscribirse:", err)
+	}
+	// Suscribir declara la cola, así que se puede publicar en ella.
+	publicador := NuevoPublicador(conexion)
+	for _, cuerpo := range []string{"bien", "mal"} {
+		if err := publicador.Publicar(ctx, "cola", cuerpo); err != nil {
+			t.Fatal("Error al publicar:", err)
+		}
+	}
+	bien := recibirPrueba(t, entregas, "bien")
+	mal := recibirPrueba(t, entregas, "mal")
+	esperarCondicion(t, "el broker recibe las dos confirmaciones", func() bool { return len(b.confirmadas()) == 2 })
+	esperadas := []ArgsConfirmarEntrega{
+		{Tag: tag, Etiqueta: bien.Etiqueta},
+		{Tag: tag, Etiqueta: mal.Etiqueta, Error: "fallo del manejador"},
+	}
+	for i, confirmacion := range b.confirmadas() {
+		if confirmacion != esperadas[i] {
+			t.Errorf("La confirmación %d es %+v en lugar de %+v", i, confirmacion, esperadas[i])
+		}
+	}
+}
@@ -2,128 +2,157 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"net"
-	"net/rpc"
+	"io"
 	"os"
 	"strconv"
+	"strings"
+
+	"brokerMensajes/cliente"
 )
 
 type Consumidor struct {
-	nombre string
-	broker *rpc.Client
+	nombre     string
+	suscriptor *cliente.Suscriptor
 }
 
 // type consumidor interface{
 // 	Consumir(nombre string, callback func(string))
 // }
 
-func NuevoConsumidor(nombre string, broker *rpc.Client) *Consumidor {
+func NuevoConsumidor(nombre string, broker *cliente.Conexion) *Consumidor {
 	// fmt.Println("Creando ", nombre)
 
 	return &Consumidor{
-		nombre: nombre,
-		broker: broker,
+		nombre:     nombre,
+		suscriptor: cliente.NuevoSuscriptor(broker),
 	}
 
 }
 
-type ArgsCallback struct {
-	Mensaje string
-}
-
-func (c *Consumidor) Callback(args *ArgsCallback, reply *Reply) error {
-	fmt.Println("Consumidor " + c.nombre + " " + args.Mensaje)
+func (c *Consumidor) Callback(ctx context.Context, entrega cliente.Entrega) error {
+	fmt.Println("Consumidor " + c.nombre + " " + entrega.Mensaje)
 	fmt.Println("Ingresa el nombre de la cola: ")
 	return nil
 }
 
-// ArgsDeclararCola representa los argumentos para declarar una nueva cola.
-// Contiene el nombre de la cola que se va a declarar.
-type ArgsDeclararCola struct {
-	Nombre     string
-	Durability bool
-}
-
-// ArgsConsumir representa los argumentos para consumir mensajes de una cola.
-// Contiene el nombre de la cola y una función de callback que se llamará para cada mensaje consumido.
-type ArgsConsumir struct {
-	Nombre   string
-	Callback func(*ArgsCallback, *Reply) error
-	Ip       string
-}
-type Reply struct {
-	Mensaje string
-}
-
 // Método Leer inicia el proceso de consumo de mensajes de una cola.
 // Declara la cola especificada, luego se suscribe para consumir mensajes de esa cola.
+// Los mensajes llegan por la misma conexión con el broker y se procesan en segundo plano.
+// Devuelve la etiqueta de consumidor de la suscripción, o una cadena vacía si no se pudo suscribir.
+// La etiqueta sigue identificando la suscripción aunque se restablezca al reconectar con el broker.
 
-func (c *Consumidor) Leer(nombreCola string, durability string, ip string) {
-	var reply Reply
-
-	durabilityBool, err := strconv.ParseBool(durability)
+func (c *Consumidor) Leer(nombreCola string, durability string) string {
+	durabilityBool, err := strconv.ParseBool(strings.TrimSpace(durability))
 	if err != nil {
 		fmt.Println("Error al convertir la durabilidad:", err)
-		return
+		return ""
 	}
 
-	args := &ArgsDeclararCola{Nombre: nombreCola, Durability: durabilityBool}
-	err = c.broker.Call("Broker.Declarar_cola", args, &reply)
+	tag, err := c.suscriptor.Suscribir(context.Background(), nombreCola, durabilityBool, c.Callback)
 	if err != nil {
 		fmt.Println("Error al llamar al método Multiply:", err)
-		return
+		return ""
 	}
+	return tag
+}
 
-	args2 := &ArgsConsumir{Nombre: nombreCola, Callback: c.Callback, Ip: ip}
-	err = c.broker.Call("Broker.Consumir", args2, &reply)
+// mostrarEstado muestra en la consola los cambios de estado de la conexión con el broker.
+func mostrarEstado(estado cliente.EstadoConexion, err error) {
 	if err != nil {
-		fmt.Println("Error al llamar al método Multiply:", err)
+		fmt.Println("Conexión con el broker:", estado, "-", err)
 		return
 	}
+	fmt.Println("Conexión con el broker:", estado)
+}
+
+// obtenerMensajes lee nombres de cola de la entrada estándar y muestra el siguiente mensaje de cada una
+// utilizando `Suscriptor.Obtener` con confirmación automática.
+func obtenerMensajes(consumidor *Consumidor) {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Println("Ingresa el nombre de la cola: ")
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return
+			}
+			fmt.Println("Error al leer la entrada:", err)
+			continue
+		}
+		entrega, ok, err := consumidor.suscriptor.Obtener(context.Background(), strings.TrimSpace(input), true)
+		if err != nil {
+			fmt.Println("Error al obtener el mensaje:", err)
+		} else if !ok {
+			fmt.Println("La cola está vacía")
+		} else {
+			fmt.Println("Consumidor " + consumidor.nombre + " " + entrega.Mensaje)
+		}
+	}
 }
 
 func main() {
 	// Verificar si se proporcionan los argumentos necesarios
 	args := os.Args
 
-	if len(args) < 4 {
+	if len(args) < 3 {
 		fmt.Println("No se ha proporcionado ningún argumento. Ejemplo de uso:")
-		fmt.Println("  go run productor nombreConsumidor direccionIPBroker:puerto direccionIP:puerto")
+		fmt.Println("  go run productor nombreConsumidor direccionIPBroker:puerto [obtener]")
+		fmt.Println("Con obtener los mensajes se piden bajo demanda en lugar de recibirse por suscripción.")
 		return
 	}
 	// Conectar al servidor Broker RPC
-	broker, err := rpc.Dial("tcp", args[2])
+	broker, err := cliente.Conectar(context.Background(), args[2])
 	if err != nil {
 		fmt.Println("Error al conectar al servidor:", err)
+		return
 	}
-	defer broker.Close()
+	defer broker.Cerrar()
+	broker.AlCambiarEstado(mostrarEstado)
 
 	consumidor1 := NuevoConsumidor(args[1], broker)
-
-	rpc.Register(consumidor1)
-
-	// Iniciar el servidor RPC del consumidor
-	listener, err := net.Listen("tcp", args[3])
-	if err != nil {
-		fmt.Println("ListenTCP error:", err)
+	if len(args) > 3 && args[3] == "obtener" {
+		obtenerMensajes(consumidor1)
+		return
 	}
-	go func() {
-		rpc.Accept(listener)
-	}()
 
 	// Leer el nombre de la cola desde la entrada estándar y comenzar a consumir mensajes
 	reader := bufio.NewReader(os.Stdin)
 
+	// tags asocia cada cola con la etiqueta de consumidor de su suscripción.
+	tags := make(map[string]string)
 	var input string
 	for {
-		fmt.Println("Ingresa el nombre de la cola: ")
+		fmt.Println("Ingresa el nombre de la cola (o cancelar nombreCola / estadisticas nombreCola): ")
 		// Leer una línea de entrada
 		input, err = reader.ReadString('\n')
 		if err != nil {
 			fmt.Println("Error al leer la entrada:", err)
 			continue
 		}
+		if nombre, ok := strings.CutPrefix(strings.TrimSpace(input), "cancelar "); ok {
+			tag, ok := tags[nombre]
+			if !ok {
+				fmt.Println("No hay ninguna suscripción a la cola", nombre)
+				continue
+			}
+			if err := consumidor1.suscriptor.Cancelar(context.Background(), tag); err != nil {
+				fmt.Println("Error al cancelar la suscripción:", err)
+				continue
+			}
+			delete(tags, nombre)
+			continue
+		}
+		if nombre, ok := strings.CutPrefix(strings.TrimSpace(input), "estadisticas "); ok {
+			e, err := consumidor1.suscriptor.Estadisticas(context.Background(), tags[nombre])
+			if err != nil {
+				fmt.Println("Error al obtener las estadísticas:", err)
+				continue
+			}
+			fmt.Println("Entregados:", e.Entregados, "fallidos:", e.Fallidos, "vencidos:", e.Vencidos)
+			continue
+		}
 		fmt.Print("Si es el primer mensaje de la cola, ¿desea que la cola sea durable? (true/false):")
 		// Leer una línea de entrada
 		input2, err := reader.ReadString('\n')
@@ -131,7 +160,10 @@ func main() {
 			fmt.Println("Error al leer la entrada:", err)
 			continue
 		}
-		consumidor1.Leer(input, input2, args[3])
+		nombre := strings.TrimSpace(input)
+		if tag := consumidor1.Leer(nombre, input2); tag != "" {
+			tags[nombre] = tag
+		}
 
 	}
 
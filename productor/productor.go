@@ -5,79 +5,152 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"net/rpc"
+	"io"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+
+	"brokerMensajes/cliente"
 )
 
+// tamLote es el número máximo de mensajes que se envían en cada llamada a `Broker.PublicarLote`.
+const tamLote = 100
+
 // Productor representa a un productor de mensajes que interactúa con un Broker de mensajes.
+// declaradas contiene las colas que el productor ya ha declarado, para declarar cada una una sola vez.
 type Productor struct{
 	nombre string
-	broker *rpc.Client
+	publicador *cliente.Publicador
+	declaradas map[string]bool
 }
 
 // NuevoProductor crea y devuelve una nueva instancia de Productor con el nombre y broker especificados.
 //
 // Parámetros:
 // - nombre: El nombre del productor.
-// - broker: Un puntero al cliente RPC conectado al broker.
+// - broker: La conexión con el broker.
 //
 // Retorna:
 // - Un puntero a una nueva instancia de Productor.
-func NuevoProductor(nombre string, broker *rpc.Client) *Productor{
+func NuevoProductor(nombre string, broker *cliente.Conexion) *Productor{
 	return &Productor{
 		nombre: nombre,
-		broker: broker,
+		publicador: cliente.NuevoPublicador(broker),
+		declaradas: make(map[string]bool),
 	}
 }
 
-// ArgsDeclararCola representa los argumentos necesarios para declarar una nueva cola en el Broker de mensajes.
-type ArgsDeclararCola struct{
-	Nombre string
-	Durability bool
+// Publicar publica un mensaje en la cola especificada sin esperar la confirmación. La primera vez que se
+// publica en una cola, la declara antes en el Broker.
+//
+// Parámetros:
+// - nombreCola: El nombre de la cola en la que se desea publicar el mensaje.
+// - mensaje: El mensaje que se desea publicar en la cola.
+// - durability: La durabilidad con la que se declara la cola si todavía no existe.
+//
+// Retorna:
+// - La publicación en curso, o nil si no se pudo declarar la cola.
+//
+// Si se pierde la conexión, la publicación se repite al reconectar, así que el mensaje puede llegar dos veces.
+func (p *Productor) Publicar(nombreCola string, mensaje string, durability bool) *cliente.Publicacion{
+	if !p.declaradas[nombreCola] {
+		err := p.publicador.Declarar(context.Background(), nombreCola, durability)
+		if err != nil {
+			fmt.Println("Error al declarar la cola:", err)
+			return nil
+		}
+		p.declaradas[nombreCola] = true
+	}
+	publicacion, err := p.publicador.PublicarAsincrono(context.Background(), cliente.Mensaje{Cola: nombreCola, Cuerpo: mensaje})
+	if err != nil {
+        fmt.Println("Error al publicar el mensaje:", err)
+        return nil
+    }
+	return publicacion
 }
 
-// ArgsPublicar representa los argumentos necesarios para publicar un mensaje en una cola del Broker de mensajes.
-type ArgsPublicar struct{
-	Nombre string
-	Mensaje string
+// informar espera a que se complete una publicación y muestra su error si ha fallado.
+func informar(publicacion *cliente.Publicacion){
+	if err := publicacion.Esperar(context.Background()); err != nil {
+		fmt.Println("Error al publicar en", publicacion.Mensaje.Cola, ":", err)
+	}
 }
 
-// Reply representa la respuesta recibida del Broker de mensajes.
-type Reply struct{
-	Mensaje string
+// mostrarEstado muestra en la consola los cambios de estado de la conexión con el broker.
+func mostrarEstado(estado cliente.EstadoConexion, err error) {
+	if err != nil {
+		fmt.Println("Conexión con el broker:", estado, "-", err)
+		return
+	}
+	fmt.Println("Conexión con el broker:", estado)
 }
 
-// Publicar publica un mensaje en la cola especificada en el Broker mediante RPC.
+// cargarFichero publica en lotes los mensajes de un fichero con una línea por mensaje
+// en formato `nombreCola;mensaje`.
 //
 // Parámetros:
-// - nombreCola: El nombre de la cola en la que se desea publicar el mensaje.
-// - mensaje: El mensaje que se desea publicar en la cola.
-func (p *Productor) Publicar(nombreCola string, mensaje string, durability bool){
-    var reply Reply
-	args := &ArgsDeclararCola{Nombre: nombreCola, Durability: durability}
-    err := p.broker.Call("Broker.Declarar_cola", args, &reply)
-	if err != nil {
-        fmt.Println("Error al llamar al método Multiply:", err)
-        return
-    }
-	args2 := &ArgsPublicar{Nombre: nombreCola, Mensaje: mensaje}
-    err = p.broker.Call("Broker.Publicar", args2, &reply)
+// - productor: El productor con el que se publican los mensajes.
+// - ruta: La ruta del fichero a cargar.
+// - durability: La durabilidad con la que se declaran las colas que todavía no existan.
+func cargarFichero(productor *Productor, ruta string, durability bool){
+	file, err := os.Open(ruta)
 	if err != nil {
-        fmt.Println("Error al llamar al método Multiply:", err)
-        return
-    }
+		fmt.Println("Error al abrir el fichero:", err)
+		return
+	}
+	defer file.Close()
+	publicados, fallidos := 0, 0
+	enviar := func(lote []cliente.Mensaje){
+		errores, err := productor.publicador.PublicarLote(context.Background(), lote, durability)
+		if err != nil {
+			fmt.Println("Error al publicar el lote:", err)
+			fallidos += len(lote)
+			return
+		}
+		for i, e := range errores {
+			if e != nil {
+				fmt.Println("Error al publicar en", lote[i].Cola, ":", e)
+				fallidos++
+			} else {
+				publicados++
+			}
+		}
+	}
+	var lote []cliente.Mensaje
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		cola, mensaje, ok := strings.Cut(scanner.Text(), ";")
+		if !ok {
+			fmt.Println("Línea ignorada:", scanner.Text())
+			continue
+		}
+		// Los mensajes se guardan con el salto de línea final, igual que en el modo interactivo.
+		lote = append(lote, cliente.Mensaje{Cola: strings.TrimSpace(cola), Cuerpo: mensaje + "\n"})
+		if len(lote) == tamLote {
+			enviar(lote)
+			lote = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Error al leer el fichero:", err)
+	}
+	if len(lote) > 0 {
+		enviar(lote)
+	}
+	fmt.Println("Mensajes publicados:", publicados, "fallidos:", fallidos)
 }
 
-
 // main es la función principal del programa.
 //
 // Esta función se encarga de leer los argumentos de la línea de comandos para obtener el nombre del productor.
 // Luego, establece una conexión con el Broker de mensajes y entra en un bucle donde solicita al usuario que ingrese
 // el nombre de la cola y el mensaje que desea publicar en ella. Finalmente, llama al método Publicar del productor
-// para publicar el mensaje en la cola especificada.
+// para publicar el mensaje en la cola especificada sin esperar la confirmación; al terminar la entrada espera
+// a que se confirmen los mensajes pendientes.
+// Si se indica un fichero como tercer argumento, publica su contenido en lotes y termina.
 func main(){
 
 	// Obtener los argumentos de la línea de comandos
@@ -85,23 +158,40 @@ func main(){
 	//Verifica número correcto de argumentos
 	if len(args) < 3 {
         fmt.Println("No se ha proporcionado ningún argumento. Ejemplo de uso:")
-        fmt.Println("  go run productor nombreProductor direccionIP:puerto")
+        fmt.Println("  go run productor nombreProductor direccionIP:puerto [fichero [durable]]")
         return
     }
 	//Realizar conexión
-	broker, err := rpc.Dial("tcp", args[2])
+	broker, err := cliente.Conectar(context.Background(), args[2])
     if err != nil {
         fmt.Println("Error al conectar al servidor:", err)
 		return 
     }
-    defer broker.Close()
+    defer broker.Cerrar()
+	broker.AlCambiarEstado(mostrarEstado)
 	reader := bufio.NewReader(os.Stdin)
 	productor := NuevoProductor(args[1], broker)
+	if len(args) > 3 {
+		durable := false
+		if len(args) > 4 {
+			durable, err = strconv.ParseBool(args[4])
+			if err != nil {
+				fmt.Println("Error al convertir el valor a booleano:", err)
+				return
+			}
+		}
+		cargarFichero(productor, args[3], durable)
+		return
+	}
 	//Leer de entrada estandar
+	var informes sync.WaitGroup
 	for {
         fmt.Print("Ingresa el nombre de la cola: ")
         // Leer una línea de entrada
         input1, err := reader.ReadString('\n')
+        if err == io.EOF {
+            break
+        }
         if err != nil {
             fmt.Println("Error al leer la entrada:", err)
             continue
@@ -125,6 +215,15 @@ func main(){
 			fmt.Println("Error al convertir el valor a booleano:", err)
 			continue
 		}
-		go productor.Publicar(input1,input2,durable)
+		if publicacion := productor.Publicar(strings.TrimSpace(input1),input2,durable); publicacion != nil {
+			informes.Add(1)
+			go func() {
+				defer informes.Done()
+				informar(publicacion)
+			}()
+		}
 	}
+	// Los errores de las publicaciones solo los muestra `informar`; se espera a que termine con todas.
+	productor.publicador.Vaciar(context.Background())
+	informes.Wait()
 }
\ No newline at end of file